@@ -6,6 +6,8 @@ require (
 	github.com/aws/aws-sdk-go v1.36.33
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/otiai10/jsonindent v0.0.0-20171116142732-447bf004320b // indirect
 	github.com/otiai10/mint v1.3.2 // indirect
 	github.com/otiai10/yaml2json v0.0.0-20170911100845-ddc967a37458 // indirect
@@ -0,0 +1,338 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains the admin API - operations across the runs of every user
+//
+// - GET  /admin/runs                           lists the active runs of every user, with their running task counts
+// - GET  /admin/users                          lists the users with active runs, with their run and running task counts
+// - POST /admin/runs/{userID}/{runID}/cancel   cancels any user's run
+// - POST /admin/cleanup                        deletes orphaned jobs and pvcs
+//
+// they take the 'admin' action on /mariner/admin - see authz.go
+// the active runs are the engine jobs in the namespace, rather than the run logs, which can't be listed across users
+//
+// orphans are what deleteCompletedJobs leaves behind:
+// - engine jobs which failed - deleteCompletedJobs only deletes jobs which succeeded
+// - task jobs, failed or still active, whose engine job is gone or finished, so nothing is waiting for them -
+//   the failed task job of an active run is kept, since the task may still be retried or cancelled
+// - task pvcs whose job is gone
+// jobs and pvcs younger than 'min_age' (default 10m) are left alone, since a task's pvc is created before its job
+// 'dry_run=true' lists the orphans without deleting them
+
+const (
+	defaultOrphanMinAge = 10 * time.Minute
+
+	auditAdminCancel  = "admin_cancel_run"
+	auditAdminCleanup = "admin_cleanup"
+)
+
+// AdminRun ..
+type AdminRun struct {
+	RunID        string `json:"runID"`
+	UserID       string `json:"userID"`
+	Started      string `json:"started"` // creation of the engine job, RFC 3339
+	RunningTasks int    `json:"runningTasks"`
+}
+
+// AdminRunsJSON ..
+type AdminRunsJSON struct {
+	Runs []*AdminRun `json:"runs"`
+}
+
+// AdminUser ..
+type AdminUser struct {
+	UserID       string `json:"userID"`
+	ActiveRuns   int    `json:"activeRuns"`
+	RunningTasks int    `json:"runningTasks"`
+}
+
+// AdminUsersJSON ..
+type AdminUsersJSON struct {
+	Users []*AdminUser `json:"users"`
+}
+
+// CleanupJSON ..
+type CleanupJSON struct {
+	DryRun        bool     `json:"dryRun"`
+	DeletedJobs   []string `json:"deletedJobs"`   // or, on a dry run, the jobs which would be deleted
+	DeletedClaims []string `json:"deletedClaims"` // same
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// jobFinished is true once the job has succeeded or failed - a job whose pod hasn't started yet is active
+func jobFinished(job *batchv1.Job) bool {
+	return job.Status.Succeeded > 0 || job.Status.Failed > 0
+}
+
+// jobOwner returns the user who submitted the job's run
+func jobOwner(job *batchv1.Job) string {
+	return job.Spec.Template.Annotations[userAnnotation]
+}
+
+// jobRunID returns the ID of the run of a task job, from its containers' environment
+func jobRunID(job *batchv1.Job) string {
+	for _, container := range job.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == "RUN_ID" {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// activeRuns returns the runs whose engine job is active, oldest first
+func activeRuns(engines, tasks []batchv1.Job) []*AdminRun {
+	runningTasks := make(map[string]int)
+	for i := range tasks {
+		if !jobFinished(&tasks[i]) {
+			runningTasks[jobRunID(&tasks[i])]++
+		}
+	}
+	runs := []*AdminRun{}
+	for i := range engines {
+		engine := &engines[i]
+		if jobFinished(engine) {
+			continue
+		}
+		runs = append(runs, &AdminRun{
+			RunID:        engine.Name,
+			UserID:       jobOwner(engine),
+			Started:      engine.CreationTimestamp.UTC().Format(time.RFC3339),
+			RunningTasks: runningTasks[engine.Name],
+		})
+	}
+	sort.Slice(runs, func(i, k int) bool {
+		if runs[i].Started != runs[k].Started {
+			return runs[i].Started < runs[k].Started
+		}
+		return runs[i].RunID < runs[k].RunID
+	})
+	return runs
+}
+
+// activeUsers returns the users with active runs, sorted by user ID
+func activeUsers(runs []*AdminRun) []*AdminUser {
+	byUser := make(map[string]*AdminUser)
+	for _, run := range runs {
+		user, ok := byUser[run.UserID]
+		if !ok {
+			user = &AdminUser{UserID: run.UserID}
+			byUser[run.UserID] = user
+		}
+		user.ActiveRuns++
+		user.RunningTasks += run.RunningTasks
+	}
+	users := []*AdminUser{}
+	for _, user := range byUser {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, k int) bool {
+		return users[i].UserID < users[k].UserID
+	})
+	return users
+}
+
+// orphans returns the names of the orphaned jobs and task pvcs - see above
+func orphans(engines, tasks []batchv1.Job, claims []k8sv1.PersistentVolumeClaim, now time.Time, minAge time.Duration) (jobs, claimNames []string) {
+	jobs, claimNames = []string{}, []string{}
+	old := func(meta metav1.ObjectMeta) bool {
+		return now.Sub(meta.CreationTimestamp.Time) >= minAge
+	}
+
+	activeEngines := make(map[string]bool)
+	for i := range engines {
+		engine := &engines[i]
+		switch {
+		case !jobFinished(engine):
+			activeEngines[engine.Name] = true
+		case engine.Status.Failed > 0 && old(engine.ObjectMeta):
+			jobs = append(jobs, engine.Name)
+		}
+	}
+
+	remaining := make(map[string]bool)
+	for i := range tasks {
+		task := &tasks[i]
+		orphaned := (task.Status.Failed > 0 || !jobFinished(task)) && !activeEngines[jobRunID(task)]
+		if orphaned && old(task.ObjectMeta) {
+			jobs = append(jobs, task.Name)
+			continue
+		}
+		remaining[task.Name] = true
+	}
+
+	for _, claim := range claims {
+		if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != marinerStorageClassName {
+			continue
+		}
+		if !strings.HasSuffix(claim.Name, "-claim") {
+			continue
+		}
+		if job := strings.TrimSuffix(claim.Name, "-claim"); !remaining[job] && old(claim.ObjectMeta) {
+			claimNames = append(claimNames, claim.Name)
+		}
+	}
+	sort.Strings(jobs)
+	sort.Strings(claimNames)
+	return jobs, claimNames
+}
+
+//// k8s ////
+
+// marinerJobs returns the engine and task jobs in the namespace
+func marinerJobs() (engines, tasks []batchv1.Job, err error) {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return nil, nil, err
+	}
+	engineList, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: engineJobSelector})
+	if err != nil {
+		return nil, nil, err
+	}
+	taskList, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: taskJobSelector})
+	if err != nil {
+		return nil, nil, err
+	}
+	return engineList.Items, taskList.Items, nil
+}
+
+//// handlers ////
+
+// '/admin/runs' - GET
+func (server *Server) handleAdminRunsGET(w http.ResponseWriter, r *http.Request) {
+	engines, tasks, err := marinerJobs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to list jobs: %v", err), nil)
+		return
+	}
+	writeJSON(w, &AdminRunsJSON{Runs: activeRuns(engines, tasks)})
+}
+
+// '/admin/users' - GET
+func (server *Server) handleAdminUsersGET(w http.ResponseWriter, r *http.Request) {
+	engines, tasks, err := marinerJobs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to list jobs: %v", err), nil)
+		return
+	}
+	writeJSON(w, &AdminUsersJSON{Users: activeUsers(activeRuns(engines, tasks))})
+}
+
+// '/admin/runs/{userID}/{runID}/cancel' - POST
+func (server *Server) handleAdminCancelRunPOST(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, runID := vars["userID"], vars["runID"]
+	entry := &AuditEntry{Action: auditAdminCancel, Actor: server.userID(r), Owner: userID, RunID: runID, Result: auditSuccess}
+	j, err := server.cancelRun(userID, runID)
+	if err != nil {
+		entry.Result, entry.Details = auditFailed, map[string]interface{}{"error": err.Error()}
+		server.audit(entry)
+		if isNotFound(err) {
+			writeStorageError(w, fmt.Errorf("failed to cancel run: %w", err))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeCancel, fmt.Sprintf("failed to cancel run: %v", err), nil)
+		return
+	}
+	server.audit(entry)
+	writeJSON(w, j)
+}
+
+// '/admin/cleanup' - POST
+func (server *Server) handleAdminCleanupPOST(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	j := &CleanupJSON{Errors: []string{}}
+	minAge := defaultOrphanMinAge
+	var err error
+	if s := q.Get("dry_run"); s != "" {
+		if j.DryRun, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid dry_run: %v", s), nil)
+			return
+		}
+	}
+	if s := q.Get("min_age"); s != "" {
+		if minAge, err = time.ParseDuration(s); err != nil || minAge < 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid min_age, expected a duration like '30m': %v", s), nil)
+			return
+		}
+	}
+
+	engines, tasks, err := marinerJobs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to list jobs: %v", err), nil)
+		return
+	}
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+		return
+	}
+	namespace := os.Getenv("GEN3_NAMESPACE")
+	claimList, err := coreClient.PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to list pvcs: %v", err), nil)
+		return
+	}
+	jobs, claims := orphans(engines, tasks, claimList.Items, time.Now(), minAge)
+	if j.DryRun {
+		j.DeletedJobs, j.DeletedClaims = jobs, claims
+		writeJSON(w, j)
+		return
+	}
+
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+		return
+	}
+	j.DeletedJobs, j.DeletedClaims = []string{}, []string{}
+	propagation := metav1.DeletePropagationBackground
+	var noGrace int64
+	for _, name := range jobs {
+		err = jobsClient.Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagation, GracePeriodSeconds: &noGrace})
+		switch {
+		case err == nil:
+			j.DeletedJobs = append(j.DeletedJobs, name)
+		case !k8serrors.IsNotFound(err):
+			j.Errors = append(j.Errors, fmt.Sprintf("failed to delete job %v: %v", name, err))
+		}
+	}
+	for _, name := range claims {
+		err = coreClient.PersistentVolumeClaims(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		switch {
+		case err == nil:
+			j.DeletedClaims = append(j.DeletedClaims, name)
+		case !k8serrors.IsNotFound(err):
+			j.Errors = append(j.Errors, fmt.Sprintf("failed to delete pvc %v: %v", name, err))
+		}
+	}
+
+	entry := &AuditEntry{
+		Action:  auditAdminCleanup,
+		Actor:   server.userID(r),
+		Result:  auditSuccess,
+		Details: map[string]interface{}{"deletedJobs": j.DeletedJobs, "deletedClaims": j.DeletedClaims},
+	}
+	if len(j.Errors) > 0 {
+		entry.Result, entry.Details["errors"] = auditFailed, j.Errors
+	}
+	server.audit(entry)
+	writeJSON(w, j)
+}
@@ -0,0 +1,106 @@
+package mariner
+
+import (
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testJob(name, user, runID string, created time.Time, succeeded, failed int32) batchv1.Job {
+	job := batchv1.Job{}
+	job.Name = name
+	job.CreationTimestamp = metav1.NewTime(created)
+	job.Spec.Template.Annotations = map[string]string{userAnnotation: user}
+	if runID != "" {
+		job.Spec.Template.Spec.Containers = []k8sv1.Container{{Env: []k8sv1.EnvVar{{Name: "RUN_ID", Value: runID}}}}
+	}
+	job.Status.Succeeded, job.Status.Failed = succeeded, failed
+	return job
+}
+
+func testClaim(name, storageClass string, created time.Time) k8sv1.PersistentVolumeClaim {
+	claim := k8sv1.PersistentVolumeClaim{}
+	claim.Name = name
+	claim.CreationTimestamp = metav1.NewTime(created)
+	claim.Spec.StorageClassName = &storageClass
+	return claim
+}
+
+func TestActiveRuns(t *testing.T) {
+	now := time.Now()
+	engines := []batchv1.Job{
+		testJob("run-b", "bob", "", now.Add(-time.Minute), 0, 0),
+		testJob("run-a", "alice", "", now.Add(-time.Hour), 0, 0),
+		testJob("run-c", "alice", "", now.Add(-time.Minute), 1, 0),
+		testJob("run-d", "alice", "", now, 0, 0),
+	}
+	tasks := []batchv1.Job{
+		testJob("task-1", "alice", "run-a", now, 0, 0),
+		testJob("task-2", "alice", "run-a", now, 0, 0),
+		testJob("task-3", "alice", "run-a", now, 1, 0),
+		testJob("task-4", "bob", "run-b", now, 0, 0),
+	}
+	runs := activeRuns(engines, tasks)
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 active runs, got %v", len(runs))
+	}
+	ids := []string{runs[0].RunID, runs[1].RunID, runs[2].RunID}
+	if !equalStrings(ids, []string{"run-a", "run-b", "run-d"}) {
+		t.Errorf("wrong runs: %v", ids)
+	}
+	if runs[0].UserID != "alice" || runs[0].RunningTasks != 2 || runs[1].RunningTasks != 1 || runs[2].RunningTasks != 0 {
+		t.Errorf("wrong runs: %+v %+v %+v", runs[0], runs[1], runs[2])
+	}
+
+	users := activeUsers(runs)
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", len(users))
+	}
+	if *users[0] != (AdminUser{UserID: "alice", ActiveRuns: 2, RunningTasks: 2}) {
+		t.Errorf("wrong user: %+v", users[0])
+	}
+	if *users[1] != (AdminUser{UserID: "bob", ActiveRuns: 1, RunningTasks: 1}) {
+		t.Errorf("wrong user: %+v", users[1])
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	engines := []batchv1.Job{
+		testJob("run-active", "alice", "", old, 0, 0),
+		testJob("run-done", "alice", "", old, 1, 0),
+		testJob("run-failed", "alice", "", old, 0, 1),
+		testJob("run-failed-new", "alice", "", now, 0, 1),
+	}
+	tasks := []batchv1.Job{
+		testJob("task-running", "alice", "run-active", old, 0, 0),
+		testJob("task-failed", "alice", "run-active", old, 0, 1),
+		testJob("task-failed-done", "alice", "run-done", old, 0, 1),
+		testJob("task-abandoned", "alice", "run-done", old, 0, 0),
+		testJob("task-no-engine", "alice", "run-gone", old, 0, 0),
+		testJob("task-no-engine-new", "alice", "run-gone", now, 0, 0),
+		testJob("task-succeeded", "alice", "run-done", old, 1, 0),
+	}
+	claims := []k8sv1.PersistentVolumeClaim{
+		testClaim("task-running-claim", marinerStorageClassName, old),
+		testClaim("task-failed-claim", marinerStorageClassName, old),
+		testClaim("task-failed-done-claim", marinerStorageClassName, old),
+		testClaim("task-gone-claim", marinerStorageClassName, old),
+		testClaim("task-new-claim", marinerStorageClassName, now),
+		testClaim("task-succeeded-claim", marinerStorageClassName, old),
+		testClaim("other-claim", "standard", old),
+		testClaim("other-volume", marinerStorageClassName, old),
+	}
+	jobs, claimNames := orphans(engines, tasks, claims, now, defaultOrphanMinAge)
+	// the failed task job of an active run may still be retried
+	if !equalStrings(jobs, []string{"run-failed", "task-abandoned", "task-failed-done", "task-no-engine"}) {
+		t.Errorf("wrong orphaned jobs: %v", jobs)
+	}
+	if !equalStrings(claimNames, []string{"task-failed-done-claim", "task-gone-claim"}) {
+		t.Errorf("wrong orphaned claims: %v", claimNames)
+	}
+}
@@ -0,0 +1,57 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains the audit log
+//
+// actions which destroy or expose data are recorded in the audit log -
+// each entry is written to the server's log as one JSON line ("audit: {...}")
+// and stored as its own object in s3, under auditLog/<date>/, so that the record outlives the server's log
+
+const (
+	auditDeleteRun = "delete_run"
+
+	auditSuccess = "success"
+	auditFailed  = "failed"
+
+	// fill with date (YYYY-MM-DD), unix nanos, action, runID
+	pathToAuditLogf = "auditLog/%v/%v-%v-%v.json"
+)
+
+// AuditEntry ..
+type AuditEntry struct {
+	Time    string                 `json:"time"` // RFC 3339
+	Action  string                 `json:"action"`
+	Actor   string                 `json:"actor"` // the user who made the request
+	Owner   string                 `json:"owner"` // the user who owns the run
+	RunID   string                 `json:"runID"`
+	Result  string                 `json:"result"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// audit records the entry - failures to store it are logged, not returned
+func (server *Server) audit(entry *AuditEntry) {
+	t := time.Now().UTC()
+	entry.Time = t.Format(time.RFC3339)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("failed to marshal audit entry: %v\n", err)
+		return
+	}
+	if server.logger != nil {
+		server.logger.logger.Printf("audit: %s", b)
+	} else {
+		fmt.Printf("audit: %s\n", b)
+	}
+
+	key := fmt.Sprintf(pathToAuditLogf, t.Format("2006-01-02"), t.UnixNano(), entry.Action, entry.RunID)
+	if err = storage.PutBytes(server.FileManager, key, b); err != nil {
+		fmt.Printf("failed to store audit entry %v: %v\n", key, err)
+	}
+}
@@ -0,0 +1,286 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// this file contains authorization
+//
+// every endpoint checks that the user may perform an action on a resource:
+// - actions: submit, read, cancel, delete, share, admin
+// - resources are paths, and a permission on a path covers everything under it:
+//   /mariner/users/{userID}/runs          - the user's runs, e.g., to list them or submit one
+//   /mariner/users/{userID}/runs/{runID}  - one run
+//   /mariner/workflows                    - the workflow registry
+//   /mariner/admin                        - admin endpoints
+//
+// the check is made by an Authorizer, chosen by the 'authz' section of the config:
+// - "arborist" (default) asks arborist, with service "mariner" and the action as the method
+// - "static" matches the config's policies
+// - "allow-all" allows everything - for development only
+
+const (
+	authzSubmit = "submit"
+	authzRead   = "read"
+	authzCancel = "cancel"
+	authzDelete = "delete"
+	authzShare  = "share"
+	authzAdmin  = "admin"
+
+	authzService = "mariner"
+
+	authzDriverArborist = "arborist"
+	authzDriverStatic   = "static"
+	authzDriverAllowAll = "allow-all"
+
+	defaultArboristURL = "http://arborist-service"
+	arboristTimeout    = 10 * time.Second
+
+	resourceRoot      = "/mariner"
+	resourceUserRunsf = resourceRoot + "/users/%v/runs" // fill with userID
+	resourceRunf      = resourceUserRunsf + "/%v"       // fill with userID, runID
+	resourceWorkflows = resourceRoot + "/workflows"
+	resourceAdmin     = resourceRoot + "/admin"
+
+	// in the resources of a static policy, stands for the user who makes the request
+	staticPolicyUser = "{user}"
+)
+
+// Authorizer decides whether a user may perform an action on a resource
+type Authorizer interface {
+	Authorize(token, userID, action, resource string) (bool, error)
+	// Groups returns the groups the user belongs to - runs can be shared with groups, see share.go
+	Groups(token, userID string) ([]string, error)
+}
+
+// AuthzConfig ..
+type AuthzConfig struct {
+	Driver      string              `json:"driver"`       // "arborist", "static" or "allow-all" - "" is "arborist"
+	ArboristURL string              `json:"arborist_url"` // defaults to http://arborist-service
+	Policies    []*StaticPolicy     `json:"policies"`     // for "static"
+	Groups      map[string][]string `json:"groups"`       // for "static" - the users of each group
+}
+
+// StaticPolicy allows the users to perform the actions on the resources and everything under them
+// "*" in users or actions matches any
+type StaticPolicy struct {
+	Users     []string `json:"users"`
+	Actions   []string `json:"actions"`
+	Resources []string `json:"resources"`
+}
+
+func newAuthorizer(conf AuthzConfig) (Authorizer, error) {
+	switch conf.Driver {
+	case "", authzDriverArborist:
+		arboristURL := conf.ArboristURL
+		if arboristURL == "" {
+			arboristURL = defaultArboristURL
+		}
+		return &ArboristAuthorizer{URL: strings.TrimSuffix(arboristURL, "/"), client: &http.Client{Timeout: arboristTimeout}}, nil
+	case authzDriverStatic:
+		return &StaticAuthorizer{Policies: conf.Policies, GroupUsers: conf.Groups}, nil
+	case authzDriverAllowAll:
+		return AllowAllAuthorizer{}, nil
+	}
+	return nil, fmt.Errorf("unknown authz driver: %v", conf.Driver)
+}
+
+//// arborist ////
+
+// ArboristAuthorizer asks arborist's auth/request endpoint
+type ArboristAuthorizer struct {
+	URL    string
+	client *http.Client
+}
+
+// Authorize ..
+func (a *ArboristAuthorizer) Authorize(token, userID, action, resource string) (bool, error) {
+	b, err := json.Marshal(&RequestJSON{
+		User: &UserJSON{Token: token},
+		Request: &AuthRequest{
+			Resource: resource,
+			Action:   &AuthAction{Service: authzService, Method: action},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal arborist request: %v", err)
+	}
+	resp, err := a.client.Post(a.URL+"/auth/request", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, fmt.Errorf("failed to ask arborist: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("arborist returned %v", resp.Status)
+	}
+	authResponse := &ArboristResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(authResponse); err != nil {
+		return false, fmt.Errorf("failed to unmarshal arborist response: %v", err)
+	}
+	return authResponse.Auth, nil
+}
+
+// Groups returns the groups arborist has for the user of the token
+// '/user/{username}' is an admin endpoint - '/user' is the caller's own
+func (a *ArboristAuthorizer) Groups(token, userID string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, a.URL+"/user", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask arborist: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// arborist only knows users who've been given policies or groups
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("arborist returned %v", resp.Status)
+	}
+	user := &ArboristUser{}
+	if err = json.NewDecoder(resp.Body).Decode(user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal arborist user: %v", err)
+	}
+	return user.Groups, nil
+}
+
+//// static ////
+
+// StaticAuthorizer allows what its policies allow, and nothing else
+type StaticAuthorizer struct {
+	Policies   []*StaticPolicy
+	GroupUsers map[string][]string
+}
+
+// Authorize ..
+func (a *StaticAuthorizer) Authorize(token, userID, action, resource string) (bool, error) {
+	for _, policy := range a.Policies {
+		if policy.allows(userID, action, resource) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Groups ..
+func (a *StaticAuthorizer) Groups(token, userID string) ([]string, error) {
+	groups := []string{}
+	for group, users := range a.GroupUsers {
+		if contains(users, userID) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (policy *StaticPolicy) allows(userID, action, resource string) bool {
+	if !contains(policy.Users, "*") && !contains(policy.Users, userID) {
+		return false
+	}
+	if !contains(policy.Actions, "*") && !contains(policy.Actions, action) {
+		return false
+	}
+	for _, path := range policy.Resources {
+		if userID != "" {
+			path = strings.ReplaceAll(path, staticPolicyUser, userID)
+		}
+		if resourceCovers(path, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceCovers returns true if the resource is the path or under it
+func resourceCovers(path, resource string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return resource == path || strings.HasPrefix(resource, path+"/")
+}
+
+//// allow-all ////
+
+// AllowAllAuthorizer allows everything - for development only
+type AllowAllAuthorizer struct{}
+
+// Authorize ..
+func (AllowAllAuthorizer) Authorize(token, userID, action, resource string) (bool, error) {
+	return true, nil
+}
+
+// Groups ..
+func (AllowAllAuthorizer) Groups(token, userID string) ([]string, error) {
+	return []string{}, nil
+}
+
+//// resources ////
+
+func (server *Server) userRunsResource(r *http.Request) string {
+	return fmt.Sprintf(resourceUserRunsf, server.userID(r))
+}
+
+func (server *Server) runResource(r *http.Request) string {
+	userID, runID := server.uniqueKey(r)
+	return fmt.Sprintf(resourceRunf, userID, runID)
+}
+
+func workflowsResource(r *http.Request) string {
+	return resourceWorkflows
+}
+
+func adminResource(r *http.Request) string {
+	return resourceAdmin
+}
+
+//// middleware ////
+
+// authorize wraps the handler with the check that the user may perform the action on the request's resource
+//
+// a request for another user's run, '?owner=<userID>', is only allowed by the run's shares, or the admin action -
+// a policy on a parent of the owner's resource, e.g., '/mariner', doesn't reach other users' runs
+func (server *Server) authorize(action string, resource func(r *http.Request) string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := resource(r)
+		var ok bool
+		var err error
+		if owner := r.URL.Query().Get("owner"); owner != "" && owner != server.userID(r) {
+			if ok, err = server.sharedRunAllows(r, action); err == nil && !ok {
+				ok, err = server.authorizer.Authorize(bearerToken(r), server.userID(r), authzAdmin, resourceAdmin)
+			}
+		} else {
+			ok, err = server.authorizer.Authorize(bearerToken(r), server.userID(r), action, path)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to authorize request: %v", err), nil)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusForbidden, errCodeForbidden, fmt.Sprintf("user not authorized to %v %v", action, path), nil)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// bearerToken returns the token of the request's Authorization header - the scheme is case-insensitive
+func bearerToken(r *http.Request) string {
+	parts := strings.Fields(r.Header.Get(authHeader))
+	switch {
+	case len(parts) == 2 && strings.EqualFold(parts[0], "bearer"):
+		return parts[1]
+	case len(parts) == 1 && !strings.EqualFold(parts[0], "bearer"):
+		// a bare token
+		return parts[0]
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// decodes any token as the user named by the token
+type fakeJWTApp struct{}
+
+func (fakeJWTApp) Decode(token string) (*map[string]interface{}, error) {
+	claims := map[string]interface{}{
+		"context": map[string]interface{}{
+			"user": map[string]interface{}{"name": token},
+		},
+	}
+	return &claims, nil
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	a := &StaticAuthorizer{Policies: []*StaticPolicy{
+		{Users: []string{"*"}, Actions: []string{authzSubmit, authzRead, authzCancel}, Resources: []string{"/mariner/users/{user}"}},
+		{Users: []string{"admin@example.org"}, Actions: []string{"*"}, Resources: []string{resourceRoot}},
+		{Users: []string{"*"}, Actions: []string{authzRead}, Resources: []string{resourceWorkflows + "/"}},
+	}}
+	cases := []struct {
+		user, action, resource string
+		allowed                bool
+	}{
+		{"alice", authzSubmit, "/mariner/users/alice/runs", true},
+		{"alice", authzCancel, "/mariner/users/alice/runs/run-1", true},
+		{"alice", authzDelete, "/mariner/users/alice/runs/run-1", false},
+		{"alice", authzRead, "/mariner/users/bob/runs/run-1", false},
+		{"al", authzRead, "/mariner/users/alice/runs", false},
+		{"alice", authzRead, resourceWorkflows, true},
+		{"alice", authzSubmit, resourceWorkflows, false},
+		{"alice", authzAdmin, resourceAdmin, false},
+		{"admin@example.org", authzAdmin, resourceAdmin, true},
+		{"admin@example.org", authzDelete, "/mariner/users/bob/runs/run-1", true},
+		{"admin@example.org", authzRead, "/other", false},
+	}
+	for _, c := range cases {
+		allowed, err := a.Authorize("", c.user, c.action, c.resource)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("%v %v %v: expected %v, got %v", c.user, c.action, c.resource, c.allowed, allowed)
+		}
+	}
+}
+
+func TestArboristAuthorizer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			// the caller's own user, by the token
+			if r.Header.Get("Authorization") != "Bearer reader" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(&ArboristUser{Name: "reader", Groups: []string{"lab"}})
+			return
+		case "/auth/request":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		req := &RequestJSON{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// the token "reader" may only read
+		auth := req.User.Token == "reader" && req.Request.Action.Service == authzService && req.Request.Action.Method == authzRead &&
+			req.Request.Resource == "/mariner/users/reader/runs"
+		json.NewEncoder(w).Encode(&ArboristResponse{Auth: auth})
+	}))
+	defer ts.Close()
+
+	a, err := newAuthorizer(AuthzConfig{Driver: authzDriverArborist, ArboristURL: ts.URL + "/"})
+	if err != nil {
+		t.Fatalf("failed to make authorizer: %v", err)
+	}
+	if allowed, err := a.Authorize("reader", "reader", authzRead, "/mariner/users/reader/runs"); err != nil || !allowed {
+		t.Errorf("expected read allowed, got %v, %v", allowed, err)
+	}
+	if allowed, err := a.Authorize("reader", "reader", authzSubmit, "/mariner/users/reader/runs"); err != nil || allowed {
+		t.Errorf("expected submit denied, got %v, %v", allowed, err)
+	}
+	if groups, err := a.Groups("reader", "reader"); err != nil || !equalStrings(groups, []string{"lab"}) {
+		t.Errorf("expected groups [lab], got %v, %v", groups, err)
+	}
+	if groups, err := a.Groups("other", "other"); err != nil || len(groups) != 0 {
+		t.Errorf("expected no groups for an unknown user, got %v, %v", groups, err)
+	}
+	ts.Close()
+	if _, err := a.Authorize("reader", "reader", authzRead, "/mariner/users/reader/runs"); err == nil {
+		t.Error("expected an error when arborist is unreachable")
+	}
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	a, err := newAuthorizer(AuthzConfig{})
+	if err != nil {
+		t.Fatalf("failed to make default authorizer: %v", err)
+	}
+	if arborist, ok := a.(*ArboristAuthorizer); !ok || arborist.URL != defaultArboristURL {
+		t.Errorf("expected arborist at %v by default, got %+v", defaultArboristURL, a)
+	}
+	if a, _ = newAuthorizer(AuthzConfig{Driver: authzDriverAllowAll}); a == nil {
+		t.Error("expected an allow-all authorizer")
+	} else if allowed, _ := a.Authorize("", "", authzAdmin, resourceAdmin); !allowed {
+		t.Error("allow-all authorizer denied a request")
+	}
+	if _, err = newAuthorizer(AuthzConfig{Driver: "ldap"}); err == nil {
+		t.Error("expected an error for an unknown driver")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	server := server().withJWTApp(fakeJWTApp{}, nil).withAuthorizer(&StaticAuthorizer{Policies: []*StaticPolicy{
+		{Users: []string{"*"}, Actions: []string{authzRead}, Resources: []string{"/mariner/users/{user}"}},
+	}})
+	handler := server.authorize(authzRead, server.userRunsResource, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for user, expected := range map[string]int{"alice": http.StatusNoContent, "": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/runs", nil)
+		r.Header.Set(authHeader, "Bearer "+user)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != expected {
+			t.Errorf("user %q: expected %v, got %v", user, expected, w.Code)
+		}
+	}
+}
+
+func TestAuthorizeOtherUsersRun(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, _ := json.Marshal([]*RunShare{{User: "carol", Actions: []string{authzRead}}})
+	if err = storage.PutBytes(local, fmt.Sprintf(pathToUserRunSharesf, "bob", "run-1"), shares); err != nil {
+		t.Fatal(err)
+	}
+	server := server().withJWTApp(fakeJWTApp{}, nil).withFileManager(&FileManager{Storage: local}).withAuthorizer(&StaticAuthorizer{Policies: []*StaticPolicy{
+		// a grant on the root resource, without the admin action
+		{Users: []string{"alice"}, Actions: []string{authzRead, authzCancel, authzSubmit}, Resources: []string{"/mariner"}},
+		{Users: []string{"admin@example.org"}, Actions: []string{authzAdmin}, Resources: []string{resourceAdmin}},
+	}})
+	handler := server.authorize(authzRead, server.runResource, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	cases := []struct {
+		user, owner string
+		expected    int
+	}{
+		{"alice", "", http.StatusNoContent},
+		{"alice", "alice", http.StatusNoContent},
+		{"alice", "bob", http.StatusForbidden},
+		{"carol", "bob", http.StatusNoContent}, // shared
+		{"admin@example.org", "bob", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/runs/run-1?owner="+c.owner, nil)
+		r = mux.SetURLVars(r, map[string]string{"runID": "run-1"})
+		r.Header.Set(authHeader, "Bearer "+c.user)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.expected {
+			t.Errorf("%v reading %v's run: expected %v, got %v", c.user, c.owner, c.expected, w.Code)
+		}
+	}
+}
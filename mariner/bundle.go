@@ -0,0 +1,329 @@
+package mariner
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uc-cdis/mariner/storage"
+	"github.com/uc-cdis/mariner/wflib"
+	"gopkg.in/yaml.v2"
+)
+
+// this file contains the submission of unpacked workflows
+//
+// instead of packed workflow JSON (see wftool), POST /runs accepts a multipart/form-data upload of the cwl files:
+// - 'workflow_attachment' - one or more .cwl/.yml/.yaml files, or a .zip of them;
+//   the filename of a file may be a relative path, e.g., "tools/align.cwl"
+// - 'entrypoint' - the path of the top-level workflow among them
+// - 'request' - optional, the rest of the WorkflowRequest as JSON, e.g., input, tags, manifest
+//
+// the WES endpoint takes the same attachments, with 'workflow_url' as the entrypoint - see wes.go
+//
+// the server packs the files, and the packed workflow is validated and run like any other -
+// the uploaded files are stored alongside the run's request.json, under workflow/
+
+const (
+	maxBundleFiles = 500
+	maxBundleSize  = 32 << 20              // total size of the uncompressed files
+	maxUploadSize  = maxBundleSize + 1<<20 // the attachments plus the other fields of the form
+)
+
+var bundleExtensions = []string{".cwl", ".yml", ".yaml"}
+
+// WorkflowBundle is an uploaded set of cwl files
+type WorkflowBundle struct {
+	Entrypoint string
+	Files      map[string][]byte // by clean relative path
+	size       int
+}
+
+// WorkflowSources records the uploaded files of a run, stored under the run's workflow/ prefix
+type WorkflowSources struct {
+	Entrypoint string   `json:"entrypoint"`
+	Files      []string `json:"files"`
+}
+
+func newWorkflowBundle(entrypoint string) *WorkflowBundle {
+	return &WorkflowBundle{Entrypoint: entrypoint, Files: make(map[string][]byte)}
+}
+
+// bundlePath returns the clean relative path of a file in a bundle,
+// or an error if the path is absolute or leaves the bundle
+func bundlePath(name string) (string, error) {
+	p := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("invalid path in workflow bundle: %v", name)
+	}
+	return p, nil
+}
+
+// add adds a file to the bundle - files which aren't cwl or yaml are skipped
+func (b *WorkflowBundle) add(name string, content []byte) error {
+	p, err := bundlePath(name)
+	if err != nil {
+		return err
+	}
+	if !contains(bundleExtensions, strings.ToLower(path.Ext(p))) {
+		return nil
+	}
+	if _, ok := b.Files[p]; ok {
+		return fmt.Errorf("duplicate file in workflow bundle: %v", p)
+	}
+	if len(b.Files) == maxBundleFiles {
+		return fmt.Errorf("workflow bundle has more than %v files", maxBundleFiles)
+	}
+	if b.size += len(content); b.size > maxBundleSize {
+		return fmt.Errorf("workflow bundle is larger than %v MB", maxBundleSize>>20)
+	}
+	b.Files[p] = content
+	return nil
+}
+
+// addZip adds the files of a zip archive to the bundle
+func (b *WorkflowBundle) addZip(content []byte) error {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return fmt.Errorf("failed to read zip: %v", err)
+	}
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || !contains(bundleExtensions, strings.ToLower(path.Ext(f.Name))) {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(maxBundleSize-b.size) {
+			return fmt.Errorf("workflow bundle is larger than %v MB", maxBundleSize>>20)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %v from zip: %v", f.Name, err)
+		}
+		// don't trust the size in the header
+		data, err := ioutil.ReadAll(io.LimitReader(rc, int64(maxBundleSize-b.size)+1))
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %v from zip: %v", f.Name, err)
+		}
+		if err = b.add(f.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReferences checks that the entrypoint is a cwl file of the bundle,
+// and that the 'run' of every step refers to another file of the bundle -
+// so packing never reads anything outside of it
+func (b *WorkflowBundle) checkReferences() error {
+	entrypoint, err := bundlePath(b.Entrypoint)
+	if err != nil {
+		return err
+	}
+	if path.Ext(entrypoint) != ".cwl" {
+		return fmt.Errorf("entrypoint must be a .cwl file: %v", b.Entrypoint)
+	}
+	if _, ok := b.Files[entrypoint]; !ok {
+		return fmt.Errorf("entrypoint not found in workflow bundle: %v", b.Entrypoint)
+	}
+	b.Entrypoint = entrypoint
+
+	for p, content := range b.Files {
+		if path.Ext(p) != ".cwl" {
+			continue
+		}
+		doc := new(interface{})
+		if err := yaml.Unmarshal(content, doc); err != nil {
+			return fmt.Errorf("failed to parse %v: %v", p, err)
+		}
+		for _, run := range runReferences(*doc) {
+			if path.IsAbs(run) {
+				return fmt.Errorf("%v: run must be a relative path: %v", p, run)
+			}
+			ref, err := bundlePath(path.Join(path.Dir(p), run))
+			if err != nil {
+				return fmt.Errorf("%v: run refers to a file outside of the bundle: %v", p, run)
+			}
+			if _, ok := b.Files[ref]; !ok {
+				return fmt.Errorf("%v: run refers to a file missing from the bundle: %v", p, run)
+			}
+		}
+	}
+	return nil
+}
+
+// runReferences returns every 'run' which is a path, rather than an inline process
+func runReferences(i interface{}) []string {
+	refs := []string{}
+	switch x := i.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range x {
+			if s, ok := v.(string); ok && k == "run" {
+				refs = append(refs, s)
+				continue
+			}
+			refs = append(refs, runReferences(v)...)
+		}
+	case []interface{}:
+		for _, v := range x {
+			refs = append(refs, runReferences(v)...)
+		}
+	}
+	return refs
+}
+
+// pack packs the bundle into a packed workflow, as wftool would
+func (b *WorkflowBundle) pack() (json.RawMessage, error) {
+	if err := b.checkReferences(); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bundle directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for p, content := range b.Files {
+		f := filepath.Join(dir, filepath.FromSlash(p))
+		if err = os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			return nil, fmt.Errorf("failed to write bundle: %v", err)
+		}
+		if err = ioutil.WriteFile(f, content, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write bundle: %v", err)
+		}
+	}
+
+	wf, err := wflib.PackWorkflow(filepath.Join(dir, filepath.FromSlash(b.Entrypoint)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack workflow: %v", err)
+	}
+	workflow, err := json.Marshal(wf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal packed workflow: %v", err)
+	}
+	return workflow, nil
+}
+
+// sources returns the record of the bundle's files, sorted by path
+func (b *WorkflowBundle) sources() *WorkflowSources {
+	s := &WorkflowSources{Entrypoint: b.Entrypoint, Files: []string{}}
+	for p := range b.Files {
+		s.Files = append(s.Files, p)
+	}
+	sort.Strings(s.Files)
+	return s
+}
+
+//// requests ////
+
+// packBundle packs the uploaded bundle of the request, if there is one, into its workflow
+func (request *WorkflowRequest) packBundle() error {
+	if request.bundle == nil {
+		// only the server fills this in
+		request.WorkflowSources = nil
+		return nil
+	}
+	if len(request.Workflow) > 0 || request.WorkflowRef != nil {
+		return fmt.Errorf("give either a workflow bundle, a workflow or a workflowRef")
+	}
+	workflow, err := request.bundle.pack()
+	if err != nil {
+		return err
+	}
+	request.Workflow = workflow
+	request.WorkflowSources = request.bundle.sources()
+	return nil
+}
+
+// bundleFromForm collects the 'workflow_attachment' files of a multipart form into a bundle
+func bundleFromForm(form *multipart.Form, entrypoint string) (*WorkflowBundle, error) {
+	if entrypoint == "" {
+		return nil, fmt.Errorf("missing workflow entrypoint")
+	}
+	b := newWorkflowBundle(entrypoint)
+	for _, header := range form.File["workflow_attachment"] {
+		name := attachmentPath(header)
+		ext := strings.ToLower(path.Ext(name))
+		if ext != ".zip" && !contains(bundleExtensions, ext) {
+			continue
+		}
+		if header.Size > int64(maxBundleSize-b.size) {
+			return nil, fmt.Errorf("workflow bundle is larger than %v MB", maxBundleSize>>20)
+		}
+		f, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open workflow attachment: %v", err)
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workflow attachment: %v", err)
+		}
+		if ext == ".zip" {
+			err = b.addZip(content)
+		} else {
+			err = b.add(name, content)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b.Files) == 0 {
+		return nil, fmt.Errorf("no .cwl, .yml or .yaml workflow_attachment")
+	}
+	return b, nil
+}
+
+// attachmentPath returns the filename of an uploaded file as given by the client -
+// header.Filename has been stripped of its directories
+func attachmentPath(header *multipart.FileHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return header.Filename
+}
+
+// workflowRequestFromBundleForm builds a WorkflowRequest from a multipart upload of cwl files - see above
+// the caller limits the body to maxUploadSize
+func workflowRequestFromBundleForm(r *http.Request) (*WorkflowRequest, error) {
+	if err := r.ParseMultipartForm(maxBundleSize); err != nil {
+		return nil, fmt.Errorf("failed to parse multipart form: %v", err)
+	}
+	workflowRequest := &WorkflowRequest{}
+	if v := r.MultipartForm.Value["request"]; len(v) > 0 {
+		if err := json.Unmarshal([]byte(v[0]), workflowRequest); err != nil {
+			return nil, fmt.Errorf("invalid request: %v", err)
+		}
+	}
+	entrypoint := ""
+	if v := r.MultipartForm.Value["entrypoint"]; len(v) > 0 {
+		entrypoint = v[0]
+	}
+	bundle, err := bundleFromForm(r.MultipartForm, entrypoint)
+	if err != nil {
+		return nil, err
+	}
+	workflowRequest.bundle = bundle
+	return workflowRequest, nil
+}
+
+//// s3 ////
+
+// storeWorkflowSources stores the files of the request's bundle under the run's workflow/ prefix
+func (server *Server) storeWorkflowSources(request *WorkflowRequest) error {
+	for p, content := range request.bundle.Files {
+		key := fmt.Sprintf(pathToUserWorkflowSourcef, request.UserID, request.JobName, p)
+		if err := storage.PutBytes(server.FileManager, key, content); err != nil {
+			return fmt.Errorf("failed to store %v: %v", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package mariner
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/uc-cdis/mariner/wflib"
+)
+
+const noInputCWLDir = "../testdata/no_input_test/workflow/cwl"
+
+func TestBundlePath(t *testing.T) {
+	valid := map[string]string{
+		"main.cwl":          "main.cwl",
+		"./tools/align.cwl": "tools/align.cwl",
+		"tools/../main.cwl": "main.cwl",
+		"tools\\sub\\x.cwl": "tools/sub/x.cwl",
+	}
+	for name, expected := range valid {
+		if p, err := bundlePath(name); err != nil || p != expected {
+			t.Errorf("%v: expected %v, got %v, %v", name, expected, p, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../main.cwl", "tools/../../main.cwl", "/etc/main.cwl"} {
+		if _, err := bundlePath(name); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestWorkflowBundleReferences(t *testing.T) {
+	newBundle := func(files map[string]string) *WorkflowBundle {
+		b := newWorkflowBundle("main.cwl")
+		for p, content := range files {
+			if err := b.add(p, []byte(content)); err != nil {
+				t.Fatalf("failed to add %v: %v", p, err)
+			}
+		}
+		return b
+	}
+	main := "class: Workflow\nsteps:\n  a:\n    run: %v\n  b:\n    run:\n      class: ExpressionTool\n"
+	cases := []struct {
+		run   string
+		valid bool
+	}{
+		{"tools/a.cwl", true},
+		{"./tools/a.cwl", true},
+		{"tools/missing.cwl", false},
+		{"../a.cwl", false},
+		{"/etc/a.cwl", false},
+	}
+	for _, c := range cases {
+		b := newBundle(map[string]string{
+			"main.cwl":    strings.Replace(main, "%v", c.run, 1),
+			"tools/a.cwl": "class: CommandLineTool\n",
+			"README.md":   "skipped",
+		})
+		if err := b.checkReferences(); (err == nil) != c.valid {
+			t.Errorf("run %v: expected valid %v, got error %v", c.run, c.valid, err)
+		}
+	}
+
+	b := newBundle(map[string]string{"main.cwl": "class: Workflow\n"})
+	for _, entrypoint := range []string{"other.cwl", "main.yml", "../main.cwl"} {
+		b.Entrypoint = entrypoint
+		if err := b.checkReferences(); err == nil {
+			t.Errorf("entrypoint %v: expected an error", entrypoint)
+		}
+	}
+
+	if err := b.add("./main.cwl", []byte("class: Workflow\n")); err == nil {
+		t.Error("expected an error adding a duplicate file")
+	}
+}
+
+func TestWorkflowBundlePack(t *testing.T) {
+	// zip up the cwl files of the no-input test under a top-level directory
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	paths, err := filepath.Glob(filepath.Join(noInputCWLDir, "*.cwl"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("failed to find test cwl files: %v", err)
+	}
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", p, err)
+		}
+		f, err := archive.Create("cwl/" + filepath.Base(p))
+		if err != nil {
+			t.Fatalf("failed to write zip: %v", err)
+		}
+		f.Write(content)
+	}
+	if err = archive.Close(); err != nil {
+		t.Fatalf("failed to write zip: %v", err)
+	}
+
+	b := newWorkflowBundle("cwl/gen3_test.cwl")
+	if err = b.addZip(buf.Bytes()); err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+	request := &WorkflowRequest{bundle: b}
+	if err = request.packBundle(); err != nil {
+		t.Fatalf("failed to pack bundle: %v", err)
+	}
+	if valid, grievances := wflib.ValidateJSON(request.Workflow, nil); !valid {
+		t.Errorf("packed workflow is invalid: %+v", grievances)
+	}
+
+	// same processes as wftool packs - the order of the graph varies from one pack to the next
+	expected, err := wflib.PackWorkflow(filepath.Join(noInputCWLDir, "gen3_test.cwl"))
+	if err != nil {
+		t.Fatalf("failed to pack workflow: %v", err)
+	}
+	packed := &wflib.WorkflowJSON{}
+	if err = json.Unmarshal(request.Workflow, packed); err != nil {
+		t.Fatalf("failed to unmarshal packed workflow: %v", err)
+	}
+	if !equalStrings(graphIDs(packed), graphIDs(expected)) {
+		t.Errorf("bundle packed differently from the workflow's files: %v, %v", graphIDs(packed), graphIDs(expected))
+	}
+
+	if request.WorkflowSources.Entrypoint != "cwl/gen3_test.cwl" || len(request.WorkflowSources.Files) != len(paths) {
+		t.Errorf("wrong sources: %+v", request.WorkflowSources)
+	}
+
+	// a bundle can't come with a workflow too
+	request = &WorkflowRequest{bundle: b, Workflow: request.Workflow}
+	if err = request.packBundle(); err == nil {
+		t.Error("expected an error packing a bundle along with a workflow")
+	}
+}
+
+func graphIDs(wf *wflib.WorkflowJSON) []string {
+	ids := []string{}
+	for _, process := range *wf.Graph {
+		ids = append(ids, process["id"].(string))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestWorkflowRequestFromBundleFormLimits(t *testing.T) {
+	form := func(files map[string]string) *http.Request {
+		body, contentType := multipartRequest(t, map[string]string{"entrypoint": "main.cwl"}, files)
+		r := httptest.NewRequest("POST", "/runs", body)
+		r.Header.Set("Content-Type", contentType)
+		r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, maxUploadSize)
+		return r
+	}
+	large := strings.Repeat("x", maxBundleSize+1)
+
+	// attachments which aren't cwl or zip are skipped without being read
+	request, err := workflowRequestFromBundleForm(form(map[string]string{"main.cwl": "cwlVersion: v1.0", "reads.fastq": large}))
+	if err != nil {
+		t.Fatalf("failed to parse form: %v", err)
+	}
+	if len(request.bundle.Files) != 1 {
+		t.Errorf("expected only main.cwl in the bundle, got %v files", len(request.bundle.Files))
+	}
+
+	if _, err = workflowRequestFromBundleForm(form(map[string]string{"main.cwl": large})); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected a too large bundle, got %v", err)
+	}
+	if _, err = workflowRequestFromBundleForm(form(map[string]string{"main.cwl": "cwlVersion: v1.0", "a.zip": large, "b.zip": large})); err == nil {
+		t.Error("expected an error parsing a body larger than the upload limit")
+	}
+}
@@ -0,0 +1,240 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/uc-cdis/mariner/storage"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains the delete-run endpoint
+//
+// DELETE /runs/{runID} removes a run:
+// 1. the run's engine and task jobs, and the task jobs' pvcs, if they're still around
+// 2. every object under the run's prefix in s3 - request.json, intermediate and output files,
+//    task logs, the output archives - and, last, marinerLog.json, so that a failed purge can be retried
+// 3. the run's entry in the run index
+//
+// a run which is still active is refused (409) unless 'force=true' is passed,
+// in which case its jobs are killed without a grace period first
+//
+// every deletion, successful or not, is recorded in the audit log - see audit.go
+
+// max number of keys per Delete call - one s3 DeleteObjects call
+const maxDeleteBatch = 1000
+
+// DeleteRunJSON ..
+type DeleteRunJSON struct {
+	RunID          string   `json:"runID"`
+	Status         string   `json:"status"` // of the run when it was deleted
+	Forced         bool     `json:"forced"`
+	DeletedObjects int      `json:"deletedObjects"`
+	DeletedJobs    []string `json:"deletedJobs"`
+	DeletedClaims  []string `json:"deletedClaims"`
+	Errors         []string `json:"errors,omitempty"` // failures to clean up k8s resources - the run is deleted regardless
+}
+
+// runJobNames returns the names of the engine job and of every task job of the run
+func runJobNames(runID string, runLog *MainLog) (engineJob string, taskJobs []string) {
+	engineJob = runID
+	if runLog.Request != nil && runLog.Request.JobName != "" {
+		engineJob = runLog.Request.JobName
+	}
+	var walk func(log *Log)
+	walk = func(log *Log) {
+		if log == nil {
+			return
+		}
+		if log.JobName != "" && log.JobName != engineJob {
+			taskJobs = append(taskJobs, log.JobName)
+		}
+		for _, subtask := range log.Scatter {
+			walk(subtask)
+		}
+	}
+	for _, log := range runLog.ByProcess {
+		walk(log)
+	}
+	return engineJob, taskJobs
+}
+
+//// handlers ////
+
+// '/runs/{runID}' - DELETE
+func (server *Server) handleRunDELETE(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	force := false
+	if s := r.URL.Query().Get("force"); s != "" {
+		var err error
+		if force, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid force: %v", s), nil)
+			return
+		}
+	}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	status := runLog.Main.Status
+	active := !finalStatus(status)
+	if active && !force {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("run is %v - cancel it first, or pass force=true", status), nil)
+		return
+	}
+
+	j := &DeleteRunJSON{RunID: runID, Status: status, Forced: active}
+	entry := &AuditEntry{
+		Action:  auditDeleteRun,
+		Actor:   server.userID(r),
+		Owner:   userID,
+		RunID:   runID,
+		Details: map[string]interface{}{"status": status, "forced": active},
+	}
+
+	// the run can't be listed as shared anymore
+	if shares, err := server.fetchRunShares(userID, runID); err != nil {
+		j.Errors = append(j.Errors, fmt.Sprintf("failed to fetch shares: %v", err))
+	} else if err = server.deleteShareMarkers(removedShareMarkers(shares, nil, userID, runID)); err != nil {
+		j.Errors = append(j.Errors, fmt.Sprintf("failed to delete share markers: %v", err))
+	}
+
+	if status == queued {
+		if err = server.dequeueRun(userID, runID); err != nil {
+			j.Errors = append(j.Errors, fmt.Sprintf("failed to take run off the queue: %v", err))
+		}
+	}
+
+	engineJob, taskJobs := runJobNames(runID, runLog)
+	var errs []string
+	j.DeletedJobs, j.DeletedClaims, errs = deleteRunJobs(engineJob, taskJobs, active)
+	j.Errors = append(j.Errors, errs...)
+
+	j.DeletedObjects, err = server.purgeRunObjects(userID, runID)
+	entry.Details["deletedObjects"] = j.DeletedObjects
+	if err != nil {
+		entry.Result, entry.Details["error"] = auditFailed, err.Error()
+		server.audit(entry)
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to delete run objects from s3 - %v deleted: %v", j.DeletedObjects, err), nil)
+		return
+	}
+	if server.runIndex != nil {
+		if err = server.runIndex.Delete(userID, runID); err != nil {
+			j.Errors = append(j.Errors, fmt.Sprintf("failed to delete run from index: %v", err))
+		}
+	}
+
+	entry.Result = auditSuccess
+	entry.Details["deletedJobs"], entry.Details["deletedClaims"] = j.DeletedJobs, j.DeletedClaims
+	if len(j.Errors) > 0 {
+		entry.Details["errors"] = j.Errors
+	}
+	server.audit(entry)
+	writeJSON(w, j)
+}
+
+//// k8s ////
+
+// deleteRunJobs deletes the jobs of the run and the pvcs of its task jobs, skipping those which are already gone
+// if kill is true, the jobs' pods are deleted right away, so the engine can't write to the run's prefix anymore
+func deleteRunJobs(engineJob string, taskJobs []string, kill bool) (jobs, claims, errs []string) {
+	jobs, claims, errs = []string{}, []string{}, []string{}
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return jobs, claims, append(errs, err.Error())
+	}
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return jobs, claims, append(errs, err.Error())
+	}
+	namespace := os.Getenv("GEN3_NAMESPACE")
+	propagation := metav1.DeletePropagationBackground
+	var noGrace int64
+
+	for i, name := range append([]string{engineJob}, taskJobs...) {
+		err = jobsClient.Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		switch {
+		case err == nil:
+			jobs = append(jobs, name)
+		case !k8serrors.IsNotFound(err):
+			errs = append(errs, fmt.Sprintf("failed to delete job %v: %v", name, err))
+		}
+		if kill {
+			err = coreClient.Pods(namespace).DeleteCollection(context.TODO(),
+				metav1.DeleteOptions{GracePeriodSeconds: &noGrace},
+				metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%v", name)})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				errs = append(errs, fmt.Sprintf("failed to kill pods of job %v: %v", name, err))
+			}
+		}
+		// only task jobs have a pvc
+		if i == 0 {
+			continue
+		}
+		claim := fmt.Sprintf("%s-claim", name)
+		err = coreClient.PersistentVolumeClaims(namespace).Delete(context.TODO(), claim, metav1.DeleteOptions{})
+		switch {
+		case err == nil:
+			claims = append(claims, claim)
+		case !k8serrors.IsNotFound(err):
+			errs = append(errs, fmt.Sprintf("failed to delete pvc %v: %v", claim, err))
+		}
+	}
+	return jobs, claims, errs
+}
+
+//// s3 ////
+
+// purgeRunObjects deletes every object under the run's prefix, the run's log last
+// returns the number of objects deleted
+func (server *Server) purgeRunObjects(userID, runID string) (int, error) {
+	prefix := fmt.Sprintf(pathToUserRunsf, userID) + runID + "/"
+	logKey := fmt.Sprintf(pathToUserRunLogf, userID, runID)
+
+	keys := []string{}
+	hasLog := false
+	err := storage.Walk(server.FileManager, prefix, func(obj *storage.ObjectInfo) bool {
+		if obj.Key == logKey {
+			hasLog = true
+		} else {
+			keys = append(keys, obj.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list run objects: %v", err)
+	}
+
+	deleted := 0
+	for _, batch := range deleteBatches(keys, maxDeleteBatch) {
+		if err = server.FileManager.Delete(batch...); err != nil {
+			return deleted, err
+		}
+		deleted += len(batch)
+	}
+	if hasLog {
+		if err = server.FileManager.Delete(logKey); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteBatches splits the keys into batches of at most n keys, keeping their order
+func deleteBatches(keys []string, n int) [][]string {
+	batches := [][]string{}
+	for len(keys) > n {
+		batches = append(batches, keys[:n])
+		keys = keys[n:]
+	}
+	if len(keys) > 0 {
+		batches = append(batches, keys)
+	}
+	return batches
+}
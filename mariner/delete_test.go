@@ -0,0 +1,34 @@
+package mariner
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestRunJobNames(t *testing.T) {
+	runLog := mainLog("")
+	runLog.Request = &WorkflowRequest{JobName: "run-1"}
+	runLog.Main.JobName = "run-1"
+	align, scatter, notRun := logger(), logger(), logger()
+	align.JobName = "job-a"
+	scatter.Scatter = map[int]*Log{0: logger(), 1: logger()}
+	scatter.Scatter[0].JobName, scatter.Scatter[1].JobName = "job-s0", "job-s1"
+	runLog.ByProcess = map[string]*Log{"#main": runLog.Main, "#main/align": align, "#main/scatter": scatter, "#main/next": notRun}
+
+	engineJob, taskJobs := runJobNames("run-1", runLog)
+	sort.Strings(taskJobs)
+	if engineJob != "run-1" || !equalStrings(taskJobs, []string{"job-a", "job-s0", "job-s1"}) {
+		t.Errorf("wrong jobs: engine %v, tasks %v", engineJob, taskJobs)
+	}
+}
+
+func TestDeleteBatches(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+	batches := deleteBatches(keys, 2)
+	if len(batches) != 3 || !equalStrings(batches[0], []string{"a", "b"}) || !equalStrings(batches[2], []string{"e"}) {
+		t.Errorf("wrong batches: %v", batches)
+	}
+	if batches = deleteBatches(nil, 2); len(batches) != 0 {
+		t.Errorf("expected no batches, got %v", batches)
+	}
+}
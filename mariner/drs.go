@@ -0,0 +1,284 @@
+package mariner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the resolution of DRS URIs and commons GUIDs in the input
+//
+// a File input can name a commons object directly, without listing it in the request's manifest:
+// - "COMMONS/<guid>"
+// - "drs://<host>/<guid>" - hostname-based DRS URI - the host must be the commons' DRS server,
+//   i.e., the host of the config's 'drs.url', or one of 'drs.hosts', e.g., the commons' public hostname
+// - "drs://<prefix>:<id>" - compact identifier, the GUID "<prefix>/<id>", e.g., drs://dg.4503:abc -> dg.4503/abc
+//
+// when a run is submitted, the server looks up every such object on the commons' DRS server,
+// adds its GUID to the manifest - so that gen3fuse mounts it in the task pods -
+// and records the object and its access URLs in the request, and so in the run's log
+// an object which the DRS server doesn't know of is reported as invalid input
+//
+// in the engine, "drs://" locations map to the gen3fuse mount, the same as "COMMONS/<guid>" - see processFile
+
+const (
+	drsScheme        = "drs://"
+	drsObjectsPath   = "/ga4gh/drs/v1/objects/"
+	defaultDRSServer = "http://indexd-service"
+	drsTimeout       = 10 * time.Second
+)
+
+var errDRSObjectNotFound = errors.New("object not found")
+
+// DRSConfig ..
+type DRSConfig struct {
+	URL   string   `json:"url"`   // DRS server of the commons - defaults to indexd
+	Hosts []string `json:"hosts"` // other hostnames of the DRS server which DRS URIs may name
+}
+
+// servesHost is true if DRS URIs naming the host are resolved on the configured DRS server
+func (c *DRSConfig) servesHost(host string) bool {
+	server := c.URL
+	if server == "" {
+		server = defaultDRSServer
+	}
+	if u, err := url.Parse(server); err == nil && strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, h := range c.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// DRSObject is the part of a GA4GH DRS object which mariner uses
+type DRSObject struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name,omitempty"`
+	SelfURI       string            `json:"self_uri,omitempty"`
+	Size          int64             `json:"size"`
+	AccessMethods []DRSAccessMethod `json:"access_methods,omitempty"`
+}
+
+// DRSAccessMethod ..
+type DRSAccessMethod struct {
+	Type      string        `json:"type"`
+	AccessID  string        `json:"access_id,omitempty"`
+	AccessURL *DRSAccessURL `json:"access_url,omitempty"`
+}
+
+// DRSAccessURL ..
+type DRSAccessURL struct {
+	URL string `json:"url"`
+}
+
+// ResolvedObject is a commons object named in the input, as resolved at submission
+type ResolvedObject struct {
+	Location   string   `json:"location"` // as given in the input
+	GUID       string   `json:"guid"`
+	Name       string   `json:"name,omitempty"`
+	Size       int64    `json:"size"`
+	AccessURLs []string `json:"accessURLs,omitempty"`
+}
+
+// DRSClient looks up objects on a DRS server
+type DRSClient struct {
+	URL    string
+	client *http.Client
+}
+
+func newDRSClient(url string) *DRSClient {
+	if url == "" {
+		url = defaultDRSServer
+	}
+	return &DRSClient{
+		URL:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: drsTimeout},
+	}
+}
+
+// object fetches the DRS object with the given id, on behalf of the user with the given token
+func (c *DRSClient) object(id, token string) (*DRSObject, error) {
+	req, err := http.NewRequest(http.MethodGet, c.URL+drsObjectsPath+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(authHeader, "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach DRS server: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errDRSObjectNotFound
+	default:
+		return nil, fmt.Errorf("DRS server returned %v for %v", resp.Status, id)
+	}
+	obj := &DRSObject{}
+	if err = json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal DRS object %v: %v", id, err)
+	}
+	return obj, nil
+}
+
+// accessURLs returns the URLs of the object's access methods which have one
+// methods with only an access_id need a signed URL, which isn't recorded
+func (obj *DRSObject) accessURLs() []string {
+	urls := []string{}
+	for _, method := range obj.AccessMethods {
+		if method.AccessURL != nil && method.AccessURL.URL != "" {
+			urls = append(urls, method.AccessURL.URL)
+		}
+	}
+	return urls
+}
+
+// parseDRSURI returns the GUID named by a DRS URI
+func parseDRSURI(uri string) (string, error) {
+	rest := strings.TrimPrefix(uri, drsScheme)
+	if rest == uri || rest == "" {
+		return "", fmt.Errorf("invalid DRS URI: %v", uri)
+	}
+	var guid string
+	if i := strings.Index(rest, "/"); i >= 0 {
+		// drs://<host>/<guid>
+		if i == 0 {
+			return "", fmt.Errorf("invalid DRS URI - no host: %v", uri)
+		}
+		if host := rest[:i]; !Config.DRS.servesHost(host) {
+			return "", fmt.Errorf("invalid DRS URI - %v isn't the commons' DRS server: %v", host, uri)
+		}
+		guid = rest[i+1:]
+	} else {
+		// drs://<prefix>:<id>
+		guid = strings.Replace(rest, ":", "/", 1)
+	}
+	if guid == "" || strings.HasPrefix(guid, "/") || strings.HasSuffix(guid, "/") {
+		return "", fmt.Errorf("invalid DRS URI - no object id: %v", uri)
+	}
+	return guid, nil
+}
+
+// commonsGUID returns the GUID of a commons object's location, and whether it names one
+func commonsGUID(location string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(location, commonsPrefix):
+		guid := strings.TrimPrefix(location, commonsPrefix)
+		if guid == "" {
+			return "", true, fmt.Errorf("invalid commons location - no GUID: %v", location)
+		}
+		return guid, true, nil
+	case strings.HasPrefix(location, drsScheme):
+		guid, err := parseDRSURI(location)
+		return guid, true, err
+	}
+	return "", false, nil
+}
+
+// fileLocations collects the locations of every File object in an input value, secondaryFiles included
+func fileLocations(val interface{}) []string {
+	locations := []string{}
+	switch x := val.(type) {
+	case map[string]interface{}:
+		if x["class"] == CWLFileType {
+			for _, field := range []string{"location", "path"} {
+				if location, ok := x[field].(string); ok {
+					locations = append(locations, location)
+					break
+				}
+			}
+		}
+		for _, v := range x {
+			locations = append(locations, fileLocations(v)...)
+		}
+	case []interface{}:
+		for _, v := range x {
+			locations = append(locations, fileLocations(v)...)
+		}
+	}
+	return locations
+}
+
+// addToManifest adds a GUID to the manifest, unless it's there already
+func (m *Manifest) addToManifest(guid string) {
+	for _, entry := range *m {
+		if entry.GUID == guid {
+			return
+		}
+	}
+	*m = append(*m, ManifestEntry{GUID: guid})
+}
+
+// resolveCommonsInputs resolves the commons objects named in the request's input, and adds them to its manifest
+// objects which can't be resolved are returned as grievances by input - an error means the DRS server couldn't be asked
+func (server *Server) resolveCommonsInputs(request *WorkflowRequest, token string) (*wflib.InputGrievances, error) {
+	request.ResolvedObjects = nil
+	if len(request.Input) == 0 {
+		return nil, nil
+	}
+	input := map[string]interface{}{}
+	if err := json.Unmarshal(request.Input, &input); err != nil {
+		// ValidateInput has already checked the input
+		return nil, nil
+	}
+	ids := make([]string, 0, len(input))
+	for id := range input {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	grievances := &wflib.InputGrievances{ByInput: map[string]wflib.Grievances{}}
+	resolved := map[string]bool{}
+	for _, id := range ids {
+		for _, location := range fileLocations(input[id]) {
+			guid, ok, err := commonsGUID(location)
+			if !ok || resolved[location] {
+				continue
+			}
+			if err != nil {
+				grievances.ByInput[id] = append(grievances.ByInput[id], err.Error())
+				continue
+			}
+			obj := &ResolvedObject{Location: location, GUID: guid}
+			if server.drs != nil {
+				drsObj, err := server.drs.object(guid, token)
+				switch {
+				case errors.Is(err, errDRSObjectNotFound):
+					grievances.ByInput[id] = append(grievances.ByInput[id], fmt.Sprintf("%v: object %v not found on the commons' DRS server", location, guid))
+					continue
+				case err != nil:
+					return nil, err
+				}
+				obj.Name, obj.Size, obj.AccessURLs = drsObj.Name, drsObj.Size, drsObj.accessURLs()
+			}
+			resolved[location] = true
+			request.Manifest.addToManifest(guid)
+			request.ResolvedObjects = append(request.ResolvedObjects, obj)
+		}
+	}
+	if len(grievances.ByInput) > 0 {
+		return grievances, nil
+	}
+	return nil, nil
+}
+
+// requestToken returns the access token of the request's authenticated user, if any
+func requestToken(r *http.Request) string {
+	if info, ok := r.Context().Value(tokenContextKey{}).(*TokenInfo); ok {
+		return info.Token
+	}
+	return bearerToken(r)
+}
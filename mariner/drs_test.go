@@ -0,0 +1,134 @@
+package mariner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// drsServer stubs a DRS server which knows of the given objects
+func drsServer(t *testing.T, objects ...*DRSObject) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authHeader) != "Bearer token" {
+			t.Errorf("expected the user's token, got %q", r.Header.Get(authHeader))
+		}
+		id := strings.TrimPrefix(r.URL.Path, drsObjectsPath)
+		for _, obj := range objects {
+			if obj.ID == id {
+				json.NewEncoder(w).Encode(obj)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+// withDRSHosts makes DRS URIs naming the hosts resolvable, until the returned func is called
+func withDRSHosts(hosts ...string) func() {
+	drs := Config.DRS
+	Config.DRS = DRSConfig{Hosts: hosts}
+	return func() { Config.DRS = drs }
+}
+
+func TestParseDRSURI(t *testing.T) {
+	defer withDRSHosts("example.org")()
+	cases := map[string]string{
+		"drs://example.org/abc":         "abc",
+		"drs://example.org/dg.4503/abc": "dg.4503/abc",
+		"drs://dg.4503:abc":             "dg.4503/abc",
+	}
+	for uri, expected := range cases {
+		guid, err := parseDRSURI(uri)
+		if err != nil || guid != expected {
+			t.Errorf("%v: expected %v, got %v (%v)", uri, expected, guid, err)
+		}
+	}
+	for _, uri := range []string{"drs://", "drs:///abc", "drs://example.org/", "s3://bucket/key", "drs://other.example.org/abc"} {
+		if _, err := parseDRSURI(uri); err == nil {
+			t.Errorf("expected an error for %v", uri)
+		}
+	}
+}
+
+func TestDRSServesHost(t *testing.T) {
+	cases := []struct {
+		config DRSConfig
+		host   string
+		serves bool
+	}{
+		{DRSConfig{}, "indexd-service", true},
+		{DRSConfig{}, "example.org", false},
+		{DRSConfig{URL: "https://data.example.org/index"}, "data.example.org", true},
+		{DRSConfig{URL: "https://data.example.org/index"}, "DATA.example.org", true},
+		{DRSConfig{URL: "https://data.example.org/index"}, "indexd-service", false},
+		{DRSConfig{Hosts: []string{"data.example.org"}}, "data.example.org", true},
+		{DRSConfig{Hosts: []string{"data.example.org"}}, "evil.example.org", false},
+	}
+	for _, c := range cases {
+		if serves := c.config.servesHost(c.host); serves != c.serves {
+			t.Errorf("%+v serves %v: expected %v", c.config, c.host, c.serves)
+		}
+	}
+}
+
+func TestProcessDRSFile(t *testing.T) {
+	defer withDRSHosts("example.org")()
+	f, err := processFile(map[string]interface{}{"class": "File", "location": "drs://example.org/dg.4503/abc"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Path != pathToCommonsData+"dg.4503/abc" {
+		t.Errorf("wrong path: %v", f.Path)
+	}
+}
+
+func TestResolveCommonsInputs(t *testing.T) {
+	defer withDRSHosts("example.org")()
+	ts := drsServer(t,
+		&DRSObject{ID: "abc", Name: "a.bam", Size: 10, AccessMethods: []DRSAccessMethod{
+			{Type: "s3", AccessID: "s3", AccessURL: &DRSAccessURL{URL: "s3://bucket/a.bam"}},
+			{Type: "https", AccessID: "signed"},
+		}},
+		&DRSObject{ID: "dg.4503/def", Name: "a.bam.bai"},
+	)
+	defer ts.Close()
+	server := server().withDRS(newDRSClient(ts.URL))
+
+	request := &WorkflowRequest{
+		Manifest: Manifest{{GUID: "abc"}},
+		Input: json.RawMessage(`{
+			"bam": {"class": "File", "location": "drs://example.org/abc", "secondaryFiles": [{"class": "File", "location": "drs://dg.4503:def"}]},
+			"same": {"class": "File", "path": "COMMONS/abc"},
+			"local": {"class": "File", "location": "USER/ref.fa"},
+			"n": 1
+		}`),
+	}
+	grievances, err := server.resolveCommonsInputs(request, "token")
+	if err != nil || grievances != nil {
+		t.Fatalf("unexpected error: %v %+v", err, grievances)
+	}
+	if len(request.Manifest) != 2 || request.Manifest[1].GUID != "dg.4503/def" {
+		t.Errorf("wrong manifest: %+v", request.Manifest)
+	}
+	if len(request.ResolvedObjects) != 3 {
+		t.Fatalf("expected 3 resolved objects, got %+v", request.ResolvedObjects)
+	}
+	obj := request.ResolvedObjects[0]
+	if obj.Location != "drs://example.org/abc" || obj.GUID != "abc" || obj.Name != "a.bam" || obj.Size != 10 {
+		t.Errorf("wrong object: %+v", obj)
+	}
+	if !equalStrings(obj.AccessURLs, []string{"s3://bucket/a.bam"}) {
+		t.Errorf("wrong access urls: %v", obj.AccessURLs)
+	}
+
+	request.Input = json.RawMessage(`{"bam": {"class": "File", "location": "COMMONS/missing"}, "ref": [{"class": "File", "location": "drs://"}]}`)
+	grievances, err = server.resolveCommonsInputs(request, "token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grievances == nil || len(grievances.ByInput["bam"]) != 1 || len(grievances.ByInput["ref"]) != 1 {
+		t.Errorf("expected a grievance for each input, got %+v", grievances)
+	}
+}
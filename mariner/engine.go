@@ -1,20 +1,19 @@
 package mariner
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/robertkrimen/otto"
 	cwl "github.com/uc-cdis/cwl.go"
+	"github.com/uc-cdis/mariner/storage"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -30,7 +29,7 @@ import (
 // ----- create some field, define a sensible data structure to easily collect/store/retreive logs
 type K8sEngine struct {
 	sync.RWMutex    `json:"-"`
-	S3FileManager   *S3FileManager
+	FileManager     *FileManager
 	TaskSequence    []string            // for testing purposes
 	UnfinishedProcs map[string]bool     // engine's stack of CLT's that are running; (task.Root.ID, Process) pairs
 	FinishedProcs   map[string]bool     // engine's stack of completed processes; (task.Root.ID, Process) pairs
@@ -40,6 +39,9 @@ type K8sEngine struct {
 	Manifest        *Manifest           // to pass the manifest to the gen3fuse container of each task pod
 	Log             *MainLog            //
 	KeepFiles       map[string]bool     // all the paths to not delete during basic file cleanup
+	runIndex        RunIndex            // nil unless the run index is shared with the server - see index.go
+	indexedStatus   string              // status of the run last written to the run index
+	notifier        *notifier           // nil unless the request asks for webhook notifications - see notify.go
 }
 
 // Tool represents a leaf in the graph of a workflow
@@ -87,9 +89,13 @@ type ToolS3Input struct {
 func Engine(runID string) (err error) {
 	engine := engine(runID)
 
+	// runs last, so that the final status notification gets out
+	defer func() {
+		engine.notifier.wait(webhookDrainTimeout)
+	}()
 	defer func() {
 		if r := recover(); r != nil {
-			engine.Log.Main.Status = failed
+			engine.Log.Main.setStatus(failed)
 			err = engine.errorf("mariner panicked: %v", r)
 		}
 	}()
@@ -98,6 +104,8 @@ func Engine(runID string) (err error) {
 		return engine.errorf("failed to load workflow request: %v", err)
 	}
 	if err = engine.runWorkflow(); err != nil {
+		engine.Log.Main.setStatus(failed)
+		engine.writeLogToS3()
 		return engine.errorf("failed to run workflow: %v", err)
 	}
 
@@ -116,23 +124,13 @@ func Engine(runID string) (err error) {
 //
 // key := fmt.Sprintf("/%s/workflowRuns/%s/%s", engine.UserID, engine.RunID, requestFile)
 func (engine *K8sEngine) fetchRequestFromS3() (*WorkflowRequest, error) {
-	sess := engine.S3FileManager.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
-	buf := &aws.WriteAtBuffer{}
-
 	key := fmt.Sprintf("/%s/workflowRuns/%s/%s", engine.UserID, engine.RunID, requestFile)
 
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-	}
-
-	_, err := downloader.Download(buf, s3Obj)
+	b, err := storage.ReadAll(engine.FileManager, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
 
-	b := buf.Bytes()
 	r := &WorkflowRequest{}
 	err = json.Unmarshal(b, r)
 	if err != nil {
@@ -152,12 +150,29 @@ func engine(runID string) *K8sEngine {
 		Log:             mainLog(fmt.Sprintf(pathToLogf, runID)),
 	}
 
-	fm := &S3FileManager{}
-	if err := fm.setup(); err != nil {
+	fm := &FileManager{}
+	if err := fm.setup(e.UserID); err != nil {
 		// fixme: log
-		fmt.Println("FAILED TO SETUP S3FILEMANAGER")
+		fmt.Println("FAILED TO SETUP FILEMANAGER:", err)
+	}
+	e.FileManager = fm
+
+	// the engine's log replaces the one the server wrote on submission
+	// keep the server's journal entries so that journal offsets stay valid, and the link to the parent run
+	if submitted, err := fetchMainLog(fm, e.UserID, runID); err == nil {
+		e.Log.Journal = submitted.Journal
+		e.Log.Journal.attach(mainProcessID, e.Log.Main)
+		e.Log.ParentRunID = submitted.ParentRunID
+	}
+
+	// only a postgres index is reachable from both the server and the engine
+	if Config.RunIndex.Driver == runIndexPostgres {
+		index, err := openRunIndex(Config.RunIndex)
+		if err != nil {
+			fmt.Println("failed to open run index: ", err)
+		}
+		e.runIndex = index
 	}
-	e.S3FileManager = fm
 	return e
 }
 
@@ -169,6 +184,8 @@ func (engine *K8sEngine) loadRequest() error {
 	}
 	engine.Manifest = &request.Manifest
 	engine.Log.Request = request
+	engine.notifier = newNotifier(engine.RunID, request)
+	engine.notifier.watch(engine.Log.Journal)
 	engine.infof("end load workflow request")
 	return nil
 }
@@ -185,6 +202,13 @@ func (engine *K8sEngine) dispatchTask(task *Task) (err error) {
 		return engine.errorf("failed to setup tool: %v; error: %v", task.Root.ID, err)
 	}
 	if err = engine.runTool(tool); err != nil {
+		// the job of a failed task is kept for its logs, the cleanup endpoint deletes it later - see admin.go
+		if err := engine.deletePVC(tool); err != nil {
+			engine.warnf("failed to delete pvc for tool: %v", task.Root.ID)
+		}
+		if err := engine.deleteTaskTokenSecret(tool); err != nil {
+			engine.warnf("failed to delete token secret for tool: %v", task.Root.ID)
+		}
 		return engine.errorf("failed to run tool: %v; error: %v", task.Root.ID, err)
 	}
 	if err = engine.collectOutput(tool); err != nil {
@@ -193,6 +217,9 @@ func (engine *K8sEngine) dispatchTask(task *Task) (err error) {
 	if err = engine.deletePVC(tool); err != nil {
 		engine.warnf("failed to delete pvc for tool: %v", task.Root.ID)
 	}
+	if err = engine.deleteTaskTokenSecret(tool); err != nil {
+		engine.warnf("failed to delete token secret for tool: %v", task.Root.ID)
+	}
 	engine.infof("end dispatch task: %v", task.Root.ID)
 	return nil
 }
@@ -281,6 +308,7 @@ func (task *Task) tool(runID string) *Tool {
 			Paths: []string{},
 		},
 	}
+	task.Log.WorkingDir = tool.WorkingDir
 	tool.JSVM = tool.newJSVM()
 	task.infof("end make tool object")
 	return tool
@@ -335,27 +363,26 @@ func (task *Task) workingDir(runID string) string {
 	return dir
 }
 
+// taskLogDir is where the console output of the task container is captured
+// it sits next to the task working dir, rather than in it, so output globs never pick it up
+// "/engine-workspace/workflowRuns/<runID>/<step>-<rand>/" -> "/engine-workspace/workflowRuns/<runID>/<step>-<rand>.logs/"
+func taskLogDir(workingDir string) string {
+	return strings.TrimSuffix(workingDir, "/") + ".logs/"
+}
+
 func (engine *K8sEngine) writeFileInputListToS3(tool *Tool) error {
 	tool.Task.infof("being write file input list to s3")
-	sess := engine.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
-
-	key := filepath.Join(engine.S3FileManager.s3Key(tool.WorkingDir, engine.UserID), inputFileListName)
+	key := filepath.Join(engine.FileManager.s3Key(tool.WorkingDir, engine.UserID), inputFileListName)
 
 	b, err := json.Marshal(tool.S3Input)
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(b),
-	})
-	if err != nil {
+	if err = storage.PutBytes(engine.FileManager, key, b); err != nil {
 		return fmt.Errorf("failed to upload file list to s3")
 	}
-	fmt.Println("wrote input file list to s3 location:", result.Location)
+	fmt.Println("wrote input file list to s3 location:", key)
 	tool.Task.infof("end write file input list to s3")
 	return nil
 }
@@ -403,7 +430,9 @@ func (engine *K8sEngine) runTool(tool *Tool) (err error) {
 			return engine.errorf("failed to run CommandLineTool: %v; error: %v", tool.Task.Root.ID, err)
 		}
 		go engine.collectResourceMetrics(tool)
-		if err = engine.listenForDone(tool); err != nil {
+		err = engine.listenForDone(tool)
+		engine.recordExitCode(tool)
+		if err != nil {
 			return engine.errorf("failed to listen for task to finish: %v; error: %v", tool.Task.Root.ID, err)
 		}
 	default:
@@ -430,19 +459,60 @@ func (engine *K8sEngine) runCommandLineTool(tool *Tool) (err error) {
 	return nil
 }
 
+// recordExitCode reads the exit status of the task's command, which the sidecar uploads with its console output,
+// into the task's log - it's left out if the command didn't run to the end
+func (engine *K8sEngine) recordExitCode(tool *Tool) {
+	key := engine.FileManager.s3Key(taskLogDir(tool.WorkingDir)+taskExitCodeFile, engine.UserID)
+	b, err := storage.ReadAll(engine.FileManager, key)
+	if err != nil {
+		engine.warnf("failed to fetch exit code of task: %v; error: %v", tool.Task.Root.ID, err)
+		return
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		engine.warnf("invalid exit code of task: %v; error: %v", tool.Task.Root.ID, err)
+		return
+	}
+	tool.Task.Log.ExitCode = &code
+}
+
 // ListenForDone listens to k8s until the job status is COMPLETED
 // once that happens, calls a function to collect output and update engine's proc stacks
-// TODO: implement error handling, listen for errors and failures, retries as well
-// ----- handle the cases where the job status is not COMPLETED or RUNNING
+// cancel and retry requests for the task are handled while listening - see tasks.go
+// a failed job is not retried automatically - the task fails, returning errTaskFailed,
+// unless the run set a retryWait, in which case the task waits that long for a retry or cancel request
 func (engine *K8sEngine) listenForDone(tool *Tool) (err error) {
 	engine.infof("begin listen for task to finish: %v", tool.Task.Root.ID)
+	wait, _ := retryWait(engine.Log.Request) // validated on submission
+	var failedAt time.Time
 	status := ""
 	for status != completed {
+		if err = engine.handleTaskControl(tool); err != nil {
+			return err
+		}
 		jobInfo, err := jobStatusByID(tool.JobID)
 		if err != nil {
 			return engine.errorf("failed to get task job info: %v; error: %v", tool.Task.Root.ID, err)
 		}
+		if jobInfo.Status == failed && status != failed {
+			tool.Task.Log.Stats.NFailures++
+			tool.Task.Log.setStatus(failed)
+			if wait == 0 {
+				engine.warnf("task job failed: %v", tool.Task.Root.ID)
+				return errTaskFailed
+			}
+			failedAt = time.Now()
+			engine.warnf("task job failed: %v; waiting %v for retry or cancel", tool.Task.Root.ID, wait)
+			engine.writeLogToS3()
+		}
+		if jobInfo.Status == failed && time.Since(failedAt) > wait {
+			engine.warnf("task job failed: %v; no retry within %v", tool.Task.Root.ID, wait)
+			return errTaskFailed
+		}
 		status = jobInfo.Status
+		if status != completed {
+			time.Sleep(taskPollInterval)
+		}
 	}
 	engine.infof("end listen for task to finish: %v", tool.Task.Root.ID)
 	return nil
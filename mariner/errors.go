@@ -0,0 +1,98 @@
+package mariner
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/uc-cdis/mariner/storage"
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the error document returned by every endpoint of the mariner server
+// every failed request gets a JSON body like:
+//
+// {
+//     "status": 400,
+//     "code": "invalid_input",
+//     "message": "invalid workflow input",
+//     "grievances": {"input": {"main": [], "byInput": {"input_bam": ["missing value for required input"]}}}
+// }
+//
+// 'code' is machine-readable and stable - clients should switch on 'code', not on 'message'
+//
+// 'msg' and 'status_code' repeat 'message' and 'status'
+// so that the same document is also a valid WES ErrorResponse
+
+// error codes
+const (
+	errCodeInvalidBody     = "invalid_request_body"
+	errCodeInvalidQuery    = "invalid_query"
+	errCodeInvalidWorkflow = "invalid_workflow"
+	errCodeInvalidInput    = "invalid_input"
+	errCodeUnauthorized    = "unauthorized"
+	errCodeForbidden       = "forbidden"
+	errCodeNotFound        = "not_found"
+	errCodeMethod          = "method_not_allowed"
+	errCodeStorage         = "storage_error"
+	errCodeDispatch        = "dispatch_failed"
+	errCodeCancel          = "cancel_failed"
+	errCodeConflict        = "conflict"
+	errCodeQuotaExceeded   = "quota_exceeded"
+	errCodeInternal        = "internal_error"
+)
+
+// ErrorJSON is the response body for every failed request
+type ErrorJSON struct {
+	Status     int                `json:"status"`
+	Code       string             `json:"code"`
+	Message    string             `json:"message"`
+	Grievances *RequestGrievances `json:"grievances,omitempty"`
+
+	// WES ErrorResponse fields
+	Msg        string `json:"msg"`
+	StatusCode int    `json:"status_code"`
+}
+
+// RequestGrievances collects everything wrong with a workflow request
+type RequestGrievances struct {
+	Request  wflib.Grievances          `json:"request,omitempty"`
+	Workflow *wflib.WorkflowGrievances `json:"workflow,omitempty"`
+	Input    *wflib.InputGrievances    `json:"input,omitempty"`
+}
+
+// writeError writes the error document with the given status code
+func writeError(w http.ResponseWriter, status int, code string, message string, grievances *RequestGrievances) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, &ErrorJSON{
+		Status:     status,
+		Code:       code,
+		Message:    message,
+		Grievances: grievances,
+		Msg:        message,
+		StatusCode: status,
+	})
+}
+
+// writeStorageError reports a failure to read some run object from s3
+// a missing object means the run (or the part of it asked for) doesn't exist
+func writeStorageError(w http.ResponseWriter, err error) {
+	if isNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error(), nil)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, errCodeStorage, err.Error(), nil)
+}
+
+// isNotFound returns true if err indicates the requested object doesn't exist
+func isNotFound(err error) bool {
+	return errors.Is(err, storage.ErrNotFound)
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, errCodeNotFound, "no such endpoint: "+r.URL.Path, nil)
+}
+
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, errCodeMethod, "method not allowed: "+r.Method, nil)
+}
@@ -0,0 +1,84 @@
+package mariner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+	"github.com/uc-cdis/mariner/wflib"
+)
+
+// errorDocument decodes the error document of the response, and checks its status and code
+func errorDocument(t *testing.T, w *httptest.ResponseRecorder, status int, code string) *ErrorJSON {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("expected status %v, got %v", status, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON document, got '%v'", ct)
+	}
+	doc := &ErrorJSON{}
+	if err := json.Unmarshal(w.Body.Bytes(), doc); err != nil {
+		t.Fatalf("failed to unmarshal error document: %v", err)
+	}
+	if doc.Status != status || doc.StatusCode != status || doc.Code != code {
+		t.Errorf("expected status %v and code '%v', got %+v", status, code, doc)
+	}
+	if doc.Msg != doc.Message {
+		t.Errorf("expected msg to repeat message, got '%v' and '%v'", doc.Msg, doc.Message)
+	}
+	return doc
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusBadRequest, errCodeInvalidInput, "invalid workflow input", &RequestGrievances{
+		Input: &wflib.InputGrievances{
+			ByInput: map[string]wflib.Grievances{"input_bam": {"missing value for required input"}},
+		},
+	})
+	doc := errorDocument(t, w, http.StatusBadRequest, errCodeInvalidInput)
+	if doc.Message != "invalid workflow input" {
+		t.Errorf("wrong message: %v", doc.Message)
+	}
+	if doc.Grievances == nil || doc.Grievances.Input == nil || len(doc.Grievances.Input.ByInput["input_bam"]) != 1 {
+		t.Errorf("expected the input grievances, got %+v", doc.Grievances)
+	}
+
+	// no grievances
+	w = httptest.NewRecorder()
+	writeError(w, http.StatusInternalServerError, errCodeInternal, "oops", nil)
+	if doc = errorDocument(t, w, http.StatusInternalServerError, errCodeInternal); doc.Grievances != nil {
+		t.Errorf("expected no grievances, got %+v", doc.Grievances)
+	}
+}
+
+func TestWriteStorageError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeStorageError(w, fmt.Errorf("failed to fetch log of run 123: %w", fmt.Errorf("%w: NoSuchKey", storage.ErrNotFound)))
+	errorDocument(t, w, http.StatusNotFound, errCodeNotFound)
+
+	w = httptest.NewRecorder()
+	writeStorageError(w, errors.New("connection reset"))
+	errorDocument(t, w, http.StatusInternalServerError, errCodeStorage)
+}
+
+func TestRouterErrors(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/nowhere", nil))
+	errorDocument(t, w, http.StatusNotFound, errCodeNotFound)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/runs", nil))
+	errorDocument(t, w, http.StatusMethodNotAllowed, errCodeMethod)
+}
@@ -0,0 +1,329 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains the run journal and the live event stream built on it
+//
+// the journal is the ordered record of everything that happens in a run -
+// every EventLog entry and every status transition, of the engine and of every task
+// each entry has an offset, its position in the journal, which never changes
+// so a client can resume the stream from the last offset it saw
+//
+// the journal is stored in the run's log in s3, and again as JSON lines next to it (journalFile)
+// entries are only ever appended, so the server polls the journal object for new entries by reading only its new bytes
+//
+// GET /runs/{runID}/events streams the journal as Server-Sent Events:
+//
+// id: 12
+// event: status
+// data: {"offset":12,"time":"2021/3/4 10:2:33","process":"#main/align","type":"status","status":"running"}
+//
+// the stream starts after the offset in the Last-Event-ID header, or else from the 'offset' query parameter
+// it ends with an 'end' event once the run is finished
+// streams are also closed after eventStreamDuration - EventSource clients reconnect automatically
+// the server has no write timeout of its own, the stream gets a write deadline past its duration - see writeDeadlines
+
+const (
+	eventEntry  = "event"
+	statusEntry = "status"
+
+	eventStreamPollInterval = 2 * time.Second
+	eventStreamRetry        = 1 * time.Second
+	eventStreamDuration     = 30 * time.Minute
+)
+
+// Journal ..
+type Journal struct {
+	sync.Mutex
+	Entries []*JournalEntry `json:"entries"`
+
+	onStatus func(entry *JournalEntry) // called on each status transition, e.g., to send webhook notifications
+}
+
+// JournalEntry is either an EventLog entry or a status transition of one process
+type JournalEntry struct {
+	Offset  int    `json:"offset"`
+	Time    string `json:"time"`
+	Process string `json:"process"` // "#main" for the engine, the step ID for a task, "<step ID>[i]" for a scatter subtask
+	Type    string `json:"type"`    // "event" or "status"
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+	Status  string `json:"status,omitempty"`
+}
+
+func (journal *Journal) add(entry *JournalEntry) {
+	journal.Lock()
+	if entry.Time == "" {
+		entry.Time = ts()
+	}
+	entry.Offset = len(journal.Entries)
+	journal.Entries = append(journal.Entries, entry)
+	onStatus := journal.onStatus
+	journal.Unlock()
+
+	if onStatus != nil && entry.Type == statusEntry {
+		onStatus(entry)
+	}
+}
+
+// MarshalJSON holds the lock so the log can be written while events are being added
+func (journal *Journal) MarshalJSON() ([]byte, error) {
+	journal.Lock()
+	defer journal.Unlock()
+	return json.Marshal(struct {
+		Entries []*JournalEntry `json:"entries"`
+	}{journal.Entries})
+}
+
+// lines returns the journal as JSON lines, one entry per line
+func (journal *Journal) lines() ([]byte, error) {
+	journal.Lock()
+	defer journal.Unlock()
+	var buf bytes.Buffer
+	for _, entry := range journal.Entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// parseJournalLines returns the entries in the complete lines of b, and the number of bytes they take up
+func parseJournalLines(b []byte) ([]*JournalEntry, int64, error) {
+	entries := []*JournalEntry{}
+	n := bytes.LastIndexByte(b, '\n') + 1
+	for _, line := range bytes.Split(b[:n], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, 0, fmt.Errorf("invalid journal entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, int64(n), nil
+}
+
+// since returns the entries from the given offset on
+func (journal *Journal) since(offset int) []*JournalEntry {
+	journal.Lock()
+	defer journal.Unlock()
+	if offset >= len(journal.Entries) {
+		return nil
+	}
+	return journal.Entries[offset:]
+}
+
+// attach makes the log of a process write its events and status transitions to the journal
+// the logs of scatter subtasks are attached as well
+func (journal *Journal) attach(process string, log *Log) {
+	if log == nil || log.Event == nil {
+		return
+	}
+	log.Event.journal = journal
+	log.Event.process = process
+	for i, subtask := range log.Scatter {
+		journal.attach(scatterProcess(process, i), subtask)
+	}
+}
+
+// attachScatter adds the log of scatter subtask i to the task's log
+func (log *Log) attachScatter(i int, subtask *Log) {
+	log.Scatter[i] = subtask
+	if log.Event != nil && log.Event.journal != nil {
+		log.Event.journal.attach(scatterProcess(log.Event.process, i), subtask)
+	}
+}
+
+func scatterProcess(process string, i int) string {
+	return fmt.Sprintf("%v[%v]", process, i)
+}
+
+// attachJournal attaches every process log to the journal, e.g., after loading the log from s3
+// logs written before the journal existed get an empty one
+func (mainLog *MainLog) attachJournal() {
+	if mainLog.Journal == nil {
+		mainLog.Journal = &Journal{}
+	}
+	mainLog.Journal.attach(mainProcessID, mainLog.Main)
+	for process, log := range mainLog.ByProcess {
+		mainLog.Journal.attach(process, log)
+	}
+}
+
+//// handlers ////
+
+// '/runs/{runID}/events' - GET
+func (server *Server) handleRunEventsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	offset, err := eventOffset(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "streaming not supported", nil)
+		return
+	}
+	// runs from before the journal was stored on its own are streamed from their log
+	entries, pos, err := server.readJournalTail(userID, runID, 0)
+	fromLog := isNotFound(err)
+	status := ""
+	if fromLog {
+		var runLog *MainLog
+		if runLog, err = server.fetchMainLog(userID, runID); err == nil {
+			entries, status = runLog.Journal.since(0), runLog.Main.Status
+		}
+	}
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch journal: %w", err))
+		return
+	}
+
+	setWriteDeadline(r, time.Now().Add(eventStreamDuration+eventStreamPollInterval+serverWriteTimeout))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let the proxy buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry.Milliseconds())
+
+	deadline := time.Now().Add(eventStreamDuration)
+	for {
+		for _, entry := range entries {
+			if entry.Process == mainProcessID && entry.Type == statusEntry {
+				status = entry.Status
+			}
+			if entry.Offset < offset {
+				continue
+			}
+			writeEvent(w, strconv.Itoa(entry.Offset), entry.Type, entry)
+			offset = entry.Offset + 1
+		}
+		if finalStatus(status) {
+			writeEvent(w, "", "end", &StatusJSON{Status: status})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventStreamPollInterval):
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		if fromLog {
+			var runLog *MainLog
+			if runLog, err = server.fetchMainLog(userID, runID); err == nil {
+				entries, status = runLog.Journal.since(offset), runLog.Main.Status
+			}
+		} else {
+			var tail []*JournalEntry
+			if tail, pos, err = server.readJournalTail(userID, runID, pos); err == nil {
+				entries = tail
+			}
+		}
+		if err != nil {
+			writeEvent(w, "", "error", &ErrorJSON{
+				Status:     http.StatusInternalServerError,
+				Code:       errCodeStorage,
+				Message:    fmt.Sprintf("failed to fetch journal: %v", err),
+				Msg:        fmt.Sprintf("failed to fetch journal: %v", err),
+				StatusCode: http.StatusInternalServerError,
+			})
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// the offset of the first entry to send
+// Last-Event-ID wins over the query - EventSource reconnects with the URL it started with,
+// so the query only says where the first connection starts
+func eventOffset(r *http.Request) (int, error) {
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		last, err := strconv.Atoi(s)
+		if err != nil || last < 0 {
+			return 0, fmt.Errorf("invalid Last-Event-ID: %v", s)
+		}
+		return last + 1, nil
+	}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, fmt.Errorf("invalid offset: %v", s)
+		}
+		return offset, nil
+	}
+	return 0, nil
+}
+
+func writeEvent(w http.ResponseWriter, id, event string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		b = []byte("{}")
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %v\n", id)
+	}
+	fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event, b)
+}
+
+//// s3 ////
+
+// writeJournal stores the journal as JSON lines next to the run's log
+func writeJournal(s storage.Storage, userID, runID string, journal *Journal) error {
+	if journal == nil {
+		return nil
+	}
+	b, err := journal.lines()
+	if err != nil {
+		return err
+	}
+	return storage.PutBytes(s, fmt.Sprintf(pathToUserRunJournalf, userID, runID), b)
+}
+
+// readJournalTail returns the entries of the run's journal after byte position pos, and the position after them
+// only the bytes after pos are fetched
+func (server *Server) readJournalTail(userID, runID string, pos int64) ([]*JournalEntry, int64, error) {
+	key := fmt.Sprintf(pathToUserRunJournalf, userID, runID)
+	info, err := server.FileManager.Stat(key)
+	if err != nil {
+		return nil, pos, err
+	}
+	if info.Size <= pos {
+		return nil, pos, nil
+	}
+	body, _, err := server.FileManager.GetRange(key, pos, info.Size-pos)
+	if err != nil {
+		return nil, pos, err
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, pos, err
+	}
+	entries, n, err := parseJournalLines(b)
+	if err != nil {
+		return nil, pos, err
+	}
+	return entries, pos + n, nil
+}
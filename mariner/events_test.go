@@ -0,0 +1,165 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+func TestJournal(t *testing.T) {
+	runLog := mainLog("")
+	runLog.Main.Event.info("run submitted")
+
+	task := logger()
+	runLog.ByProcess["#main/scatter_step"] = task
+	runLog.Journal.attach("#main/scatter_step", task)
+	task.Scatter = make(map[int]*Log)
+	task.attachScatter(1, logger())
+
+	runLog.Main.start()
+	task.start()
+	task.Scatter[1].Event.warn("retrying")
+	task.Scatter[1].finish()
+	runLog.Main.setStatus(failed)
+
+	expected := []JournalEntry{
+		{Process: mainProcessID, Type: eventEntry, Level: infoLogLevel, Message: "run submitted"},
+		{Process: mainProcessID, Type: statusEntry, Status: running},
+		{Process: "#main/scatter_step", Type: statusEntry, Status: running},
+		{Process: "#main/scatter_step[1]", Type: eventEntry, Level: warningLogLevel, Message: "retrying"},
+		{Process: "#main/scatter_step[1]", Type: statusEntry, Status: completed},
+		{Process: mainProcessID, Type: statusEntry, Status: failed},
+	}
+	check := func(journal *Journal) {
+		if len(journal.Entries) != len(expected) {
+			t.Fatalf("expected %v journal entries, got %v", len(expected), len(journal.Entries))
+		}
+		for i, entry := range journal.Entries {
+			e := expected[i]
+			e.Offset, e.Time = i, entry.Time
+			if *entry != e || entry.Time == "" {
+				t.Errorf("journal entry %v: expected %+v, got %+v", i, e, *entry)
+			}
+		}
+	}
+	check(runLog.Journal)
+
+	// the journal survives a round trip through s3, and the loaded log keeps writing to it
+	b, err := json.Marshal(&MainLogJSON{Main: runLog.Main, ByProcess: runLog.ByProcess, Journal: runLog.Journal})
+	if err != nil {
+		t.Fatalf("failed to marshal log: %v", err)
+	}
+	loaded := &MainLog{}
+	if err = json.Unmarshal(b, loaded); err != nil {
+		t.Fatalf("failed to unmarshal log: %v", err)
+	}
+	loaded.attachJournal()
+	check(loaded.Journal)
+
+	loaded.ByProcess["#main/scatter_step"].Scatter[1].setStatus(cancelled)
+	expected = append(expected, JournalEntry{Process: "#main/scatter_step[1]", Type: statusEntry, Status: cancelled})
+	check(loaded.Journal)
+
+	if entries := loaded.Journal.since(5); len(entries) != 2 || entries[0].Offset != 5 {
+		t.Errorf("wrong entries since offset 5: %v", entries)
+	}
+}
+
+func TestEventOffset(t *testing.T) {
+	r := httptest.NewRequest("GET", "/runs/x/events", nil)
+	r.Header.Set("Last-Event-ID", "7")
+	if offset, err := eventOffset(r); err != nil || offset != 8 {
+		t.Errorf("expected offset 8 from Last-Event-ID, got %v (%v)", offset, err)
+	}
+	r = httptest.NewRequest("GET", "/runs/x/events?offset=3", nil)
+	r.Header.Set("Last-Event-ID", "7")
+	if offset, err := eventOffset(r); err != nil || offset != 8 {
+		t.Errorf("expected offset 8 from Last-Event-ID over the query, got %v (%v)", offset, err)
+	}
+	if offset, err := eventOffset(httptest.NewRequest("GET", "/runs/x/events?offset=3", nil)); err != nil || offset != 3 {
+		t.Errorf("expected offset 3 from query, got %v (%v)", offset, err)
+	}
+	if _, err := eventOffset(httptest.NewRequest("GET", "/runs/x/events?offset=-1", nil)); err == nil {
+		t.Errorf("negative offset passed")
+	}
+}
+
+func TestJournalTail(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := server().withFileManager(&FileManager{Storage: local})
+	runLog := mainLog("")
+	runLog.Main.Event.info("run submitted")
+	runLog.Main.start()
+	if err = server.writeLog(runLog, "user", "run"); err != nil {
+		t.Fatal(err)
+	}
+	entries, pos, err := server.readJournalTail("user", "run", 0)
+	if err != nil || len(entries) != 2 || entries[1].Status != running {
+		t.Fatalf("expected the whole journal, got %v, %v", entries, err)
+	}
+	if entries, _, err = server.readJournalTail("user", "run", pos); err != nil || len(entries) != 0 {
+		t.Errorf("expected no new entries, got %v, %v", entries, err)
+	}
+
+	runLog.Main.setStatus(completed)
+	if err = server.writeLog(runLog, "user", "run"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, err = server.readJournalTail("user", "run", pos); err != nil || len(entries) != 1 || entries[0].Offset != 2 || entries[0].Status != completed {
+		t.Errorf("expected only the new entry, got %v, %v", entries, err)
+	}
+
+	// a partly written line is left for the next read
+	entries, n, err := parseJournalLines([]byte("{\"offset\":0}\n{\"offs"))
+	if err != nil || len(entries) != 1 || n != int64(len("{\"offset\":0}\n")) {
+		t.Errorf("expected one complete entry, got %v, %v bytes, %v", entries, n, err)
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := server().withFileManager(&FileManager{Storage: local})
+	runLog := mainLog("")
+	runLog.Main.Event.info("run submitted")
+	runLog.Main.start()
+	runLog.Main.finish()
+	if err = server.writeLog(runLog, "user", "run"); err != nil {
+		t.Fatal(err)
+	}
+	// a run from before the journal was stored on its own
+	b, _ := json.Marshal(&MainLogJSON{Main: runLog.Main, ByProcess: runLog.ByProcess, Journal: runLog.Journal})
+	if err = storage.PutBytes(local, fmt.Sprintf(pathToUserRunLogf, "user", "old"), b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, runID := range []string{"run", "old"} {
+		r := httptest.NewRequest("GET", "/runs/"+runID+"/events?owner=user&offset=1", nil)
+		r = mux.SetURLVars(r, map[string]string{"runID": runID})
+		w := httptest.NewRecorder()
+		server.handleRunEventsGET(w, r)
+		body := w.Body.String()
+		if w.Code != 200 || strings.Contains(body, "id: 0\n") || !strings.Contains(body, "id: 2\nevent: status") ||
+			!strings.HasSuffix(body, "event: end\ndata: {\"status\":\"completed\"}\n\n") {
+			t.Errorf("%v: unexpected event stream: %v %v", runID, w.Code, body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/runs/missing/events?owner=user", nil)
+	r = mux.SetURLVars(r, map[string]string{"runID": "missing"})
+	w := httptest.NewRecorder()
+	server.handleRunEventsGET(w, r)
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a missing run, got %v", w.Code)
+	}
+}
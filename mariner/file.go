@@ -2,13 +2,10 @@ package mariner
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // this file contains code for handling/processing file objects
@@ -61,6 +58,19 @@ func fileObject(path string) (fileObj *File) {
 	return fileObj
 }
 
+// instantiates a new directory object given a path
+// see: https://www.commonwl.org/v1.0/Workflow.html#Directory
+func directoryObject(path string) *File {
+	base, _, _, dirname := fileFields(path)
+	return &File{
+		Class:    CWLDirectoryType,
+		Location: path,
+		Path:     path,
+		Basename: base,
+		DirName:  dirname,
+	}
+}
+
 // pedantic splitting regarding leading periods in the basename
 // see: https://www.commonwl.org/v1.0/Workflow.html#File
 // the description of nameroot and nameext
@@ -146,22 +156,18 @@ func (engine *K8sEngine) loadSFilesFromPattern(tool *Tool, fileObj *File, suffix
 
 // check if this path exists in S3
 func (engine *K8sEngine) fileExists(path string) (bool, error) {
-	svc := s3.New(engine.S3FileManager.newS3Session())
-	objectList, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Prefix: aws.String(strings.TrimPrefix(engine.localPathToS3Key(path), "/")),
-	})
+	page, err := engine.FileManager.List(strings.TrimPrefix(engine.localPathToS3Key(path), "/"), "", "")
 	if err != nil {
 		return false, fmt.Errorf("failed to list s3 objects: %v", err)
 	}
-	if len(objectList.Contents) == 0 {
+	if len(page.Objects) == 0 {
 		return false, nil
 	}
 	return true, nil
 }
 
 func (engine *K8sEngine) localPathToS3Key(path string) string {
-	return engine.S3FileManager.s3Key(path, engine.UserID)
+	return engine.FileManager.s3Key(path, engine.UserID)
 }
 
 func (engine *K8sEngine) s3KeyToLocalPath(key string) string {
@@ -170,20 +176,18 @@ func (engine *K8sEngine) s3KeyToLocalPath(key string) string {
 
 // loadContents downloads contents for a file from the engine's S3 file manager to populate the file contents field.
 func (engine *K8sEngine) loadContents(file *File) (err error) {
-	sess := engine.S3FileManager.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
 	s3Key := engine.localPathToS3Key(file.Location)
-	buf := &aws.WriteAtBuffer{}
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(s3Key),
-		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", 0, 65536)),
+	// bytes 0-65536
+	body, _, err := engine.FileManager.GetRange(s3Key, 0, 65537)
+	if err != nil {
+		return fmt.Errorf("failed to download file, %v", err)
 	}
-	_, err = downloader.Download(buf, s3Obj)
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
 		return fmt.Errorf("failed to download file, %v", err)
 	}
-	file.Contents = string(buf.Bytes())
+	file.Contents = string(b)
 	return nil
 }
 
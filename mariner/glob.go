@@ -0,0 +1,209 @@
+package mariner
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	cwl "github.com/uc-cdis/cwl.go"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains the glob matching for CommandLineTool outputs
+//
+// a glob pattern is matched against whole paths, one segment at a time:
+// - "*" matches any run of characters within a segment, "?" any one character
+// - "[...]" matches a character class, e.g., "[a-c]" or "[^0-9]", and "\" escapes the next character
+// - a "**" segment matches any number of segments, including none, e.g., "**/*.bam" matches
+//   "a.bam" and "x/y/a.bam"
+//
+// files are matched against their keys, and directories against the prefixes of those keys,
+// so a directory matches if it holds at least one object - object storage has no empty directories
+// results are sorted by path, so that output arrays don't depend on the order of the listing
+
+// globMatch reports whether the path matches the pattern
+func globMatch(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// consecutive "**" segments are the same as one
+			for len(pattern) > 1 && pattern[1] == "**" {
+				pattern = pattern[1:]
+			}
+			for i := 0; i <= len(name); i++ {
+				match, err := matchSegments(pattern[1:], name[i:])
+				if err != nil || match {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		match, err := path.Match(pattern[0], name[0])
+		if err != nil || !match {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// literalPrefix returns the part of the pattern up to the last "/" before its first special character,
+// which every match starts with
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return pattern[:strings.LastIndex(pattern, "/")+1]
+}
+
+// listingPrefix returns the prefix under root to list to find every match of the patterns
+func listingPrefix(root string, patterns []string) string {
+	prefix := ""
+	for i, pattern := range patterns {
+		p := literalPrefix(pattern)
+		if i == 0 {
+			prefix = p
+			continue
+		}
+		for !strings.HasPrefix(p, prefix) {
+			prefix = prefix[:strings.LastIndex(strings.TrimSuffix(prefix, "/"), "/")+1]
+		}
+	}
+	if !strings.HasPrefix(prefix, root) {
+		return root
+	}
+	return prefix
+}
+
+// globKeys returns the keys which match any of the patterns, and if dirs is true,
+// the directories under root holding them which match, each sorted
+func globKeys(root string, keys, patterns []string, dirs bool) (files, directories []string, err error) {
+	matched := make(map[string]bool)
+	matchAny := func(name string) (bool, error) {
+		if done, ok := matched[name]; ok {
+			return done, nil
+		}
+		for _, pattern := range patterns {
+			match, err := globMatch(strings.TrimSuffix(pattern, "/"), name)
+			if err != nil {
+				return false, fmt.Errorf("glob pattern matching failed: %v", err)
+			}
+			if match {
+				matched[name] = true
+				return true, nil
+			}
+		}
+		matched[name] = false
+		return false, nil
+	}
+	for _, key := range keys {
+		match, err := matchAny(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if match {
+			files = append(files, key)
+		}
+		if !dirs {
+			continue
+		}
+		// the directories between root and the key, e.g., "root/a" and "root/a/b" for "root/a/b/c.txt"
+		for i := len(root) + 1; i < len(key); i++ {
+			if key[i] != '/' {
+				continue
+			}
+			dir := key[:i]
+			if _, seen := matched[dir]; seen {
+				continue
+			}
+			match, err = matchAny(dir)
+			if err != nil {
+				return nil, nil, err
+			}
+			if match {
+				directories = append(directories, dir)
+			}
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(directories)
+	return files, directories, nil
+}
+
+// globKinds reports whether the output's glob should collect files, directories, or both -
+// directories if its type is Directory, or an array of them, files if it's File, an array of them, or any other type
+func globKinds(output *cwl.Output) (files, dirs bool) {
+	check := func(t string) {
+		switch t {
+		case CWLDirectoryType:
+			dirs = true
+		case CWLFileType:
+			files = true
+		}
+	}
+	for _, t := range output.Types {
+		check(t.Type)
+		for _, item := range t.Items {
+			check(item.Type)
+		}
+	}
+	return files || !dirs, dirs
+}
+
+// globS3 returns the files if files is true, and the directories if dirs is true,
+// in the tool's working dir which match any of the patterns, sorted by path
+//
+// glob patterns should resolve to absolute paths, e.g., $(runtime.outdir + '/my_glob_pattern*'),
+// else they're taken to be relative to the working dir
+// see also: https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
+//
+// #no-fuse - must glob s3, not locally
+func (engine *K8sEngine) globS3(tool *Tool, patterns []string, files, dirs bool) ([]*File, error) {
+	root := strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/")
+	root = strings.TrimSuffix(root, "/") + "/"
+	s3Patterns := []string{}
+	for _, pattern := range patterns {
+		s3Pattern := strings.TrimPrefix(engine.localPathToS3Key(pattern), "/")
+		if !strings.HasPrefix(s3Pattern, engine.UserID) {
+			s3Pattern = root + strings.TrimPrefix(s3Pattern, "/")
+		}
+		s3Patterns = append(s3Patterns, s3Pattern)
+	}
+
+	// the working dir may hold more objects than one page of a listing
+	keys := []string{}
+	err := storage.Walk(engine.FileManager, listingPrefix(root, s3Patterns), func(obj *storage.ObjectInfo) bool {
+		keys = append(keys, obj.Key)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys from tool working dir in s3: %v", err)
+	}
+
+	fileKeys, directories, err := globKeys(root, keys, s3Patterns, dirs)
+	if err != nil {
+		return nil, err
+	}
+	// these need to be represented as filepaths, not "keys"
+	// i.e., with a slash at the beginning
+	results := []*File{}
+	if files {
+		for _, key := range fileKeys {
+			results = append(results, fileObject(engine.s3KeyToLocalPath("/"+key)))
+		}
+	}
+	for _, key := range directories {
+		results = append(results, directoryObject(engine.s3KeyToLocalPath("/"+key)))
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	return results, nil
+}
@@ -0,0 +1,166 @@
+package mariner
+
+import (
+	"fmt"
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"out/*.bam", "out/a.bam", true},
+		{"out/*.bam", "out/x/a.bam", false},
+		{"out/**/*.bam", "out/a.bam", true},
+		{"out/**/*.bam", "out/x/y/a.bam", true},
+		{"out/**/*.bam", "out/x/y/a.bai", false},
+		{"out/**", "out/x/y", true},
+		{"out/**/**/x", "out/x", true},
+		{"out/sample[0-9].txt", "out/sample3.txt", true},
+		{"out/sample[0-9].txt", "out/sampleA.txt", false},
+		{"out/sample[^0-9].txt", "out/sampleA.txt", true},
+		{"out/?.txt", "out/ab.txt", false},
+		{"out/\\*.txt", "out/*.txt", true},
+		{"out/\\*.txt", "out/a.txt", false},
+	}
+	for _, c := range cases {
+		match, err := globMatch(c.pattern, c.name)
+		if err != nil {
+			t.Errorf("'%v': unexpected error: %v", c.pattern, err)
+		} else if match != c.match {
+			t.Errorf("'%v' against '%v': expected %v, got %v", c.pattern, c.name, c.match, match)
+		}
+	}
+	if _, err := globMatch("out/[a-", "out/a"); err == nil {
+		t.Errorf("expected an error for a bad pattern")
+	}
+}
+
+func TestListingPrefix(t *testing.T) {
+	root := "user/workflowRuns/run/task/"
+	cases := []struct {
+		patterns []string
+		prefix   string
+	}{
+		{[]string{root + "out/*.bam"}, root + "out/"},
+		{[]string{root + "out/a/*.bam", root + "out/b/**"}, root + "out/"},
+		{[]string{root + "*.bam", root + "out/*.bai"}, root},
+		{[]string{"user/elsewhere/*.bam"}, root},
+	}
+	for _, c := range cases {
+		if prefix := listingPrefix(root, c.patterns); prefix != c.prefix {
+			t.Errorf("%v: expected '%v', got '%v'", c.patterns, c.prefix, prefix)
+		}
+	}
+}
+
+func TestGlobKeys(t *testing.T) {
+	root := "user/run/task/"
+	keys := []string{
+		root + "out/b.txt",
+		root + "out/a.txt",
+		root + "out/sub/c.txt",
+		root + "log.txt",
+	}
+	files, dirs, err := globKeys(root, keys, []string{root + "out/**", root + "*.txt"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(files, []string{root + "log.txt", root + "out/a.txt", root + "out/b.txt", root + "out/sub/c.txt"}) {
+		t.Errorf("wrong files: %v", files)
+	}
+	if !equalStrings(dirs, []string{root + "out", root + "out/sub"}) {
+		t.Errorf("wrong directories: %v", dirs)
+	}
+
+	_, dirs, err = globKeys(root, keys, []string{root + "out/**"}, false)
+	if err != nil || len(dirs) != 0 {
+		t.Errorf("expected no directories, got %v, %v", dirs, err)
+	}
+}
+
+func TestGlobS3(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than one page of a listing
+	n := 1200
+	for i := 0; i < n; i++ {
+		if err = storage.PutBytes(local, fmt.Sprintf("user/workflowRuns/run/task/out/part-%04d.txt", n-1-i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.PutBytes(local, "user/workflowRuns/run/task/other.log", nil); err != nil {
+		t.Fatal(err)
+	}
+	engine := &K8sEngine{UserID: "user", FileManager: &FileManager{Storage: local}}
+	tool := &Tool{WorkingDir: "/engine-workspace/workflowRuns/run/task/"}
+
+	results, err := engine.globS3(tool, []string{"/engine-workspace/workflowRuns/run/task/out/*.txt"}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != n {
+		t.Fatalf("expected %v files, got %v", n, len(results))
+	}
+	for i, f := range results {
+		if expected := fmt.Sprintf("/engine-workspace/workflowRuns/run/task/out/part-%04d.txt", i); f.Path != expected || f.Class != CWLFileType {
+			t.Fatalf("expected %v at %v, got %v %v", expected, i, f.Class, f.Path)
+		}
+	}
+
+	// relative to the working dir
+	results, err = engine.globS3(tool, []string{"out"}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Class != CWLDirectoryType || results[0].Path != "/engine-workspace/workflowRuns/run/task/out" {
+		t.Errorf("expected the out directory, got %+v", results)
+	}
+
+	// a glob matching both files and directories gives only the kind the output's type asks for
+	results, err = engine.globS3(tool, []string{"*"}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Class != CWLDirectoryType || results[0].Path != "/engine-workspace/workflowRuns/run/task/out" {
+		t.Errorf("expected only the out directory, got %+v", results)
+	}
+	results, err = engine.globS3(tool, []string{"*"}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Class != CWLFileType || results[0].Path != "/engine-workspace/workflowRuns/run/task/other.log" {
+		t.Errorf("expected only other.log, got %+v", results)
+	}
+	if results, err = engine.globS3(tool, []string{"*"}, true, true); err != nil || len(results) != 2 {
+		t.Errorf("expected other.log and the out directory, got %+v, %v", results, err)
+	}
+}
+
+func TestGlobKinds(t *testing.T) {
+	output := func(types ...cwl.Type) *cwl.Output {
+		return &cwl.Output{Types: types}
+	}
+	cases := []struct {
+		output      *cwl.Output
+		files, dirs bool
+	}{
+		{output(cwl.Type{Type: CWLFileType}), true, false},
+		{output(cwl.Type{Type: CWLDirectoryType}), false, true},
+		{output(cwl.Type{Type: "null"}, cwl.Type{Type: CWLDirectoryType}), false, true},
+		{output(cwl.Type{Type: "array", Items: []cwl.Type{{Type: CWLDirectoryType}}}), false, true},
+		{output(cwl.Type{Type: CWLFileType}, cwl.Type{Type: CWLDirectoryType}), true, true},
+		{output(cwl.Type{Type: "string"}), true, false},
+	}
+	for i, c := range cases {
+		if files, dirs := globKinds(c.output); files != c.files || dirs != c.dirs {
+			t.Errorf("case %v: expected files=%v, dirs=%v, got %v, %v", i, c.files, c.dirs, files, dirs)
+		}
+	}
+}
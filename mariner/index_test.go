@@ -0,0 +1,78 @@
+package mariner
+
+import (
+	"errors"
+	"testing"
+)
+
+func testRunIndex(t *testing.T, name string, index RunIndex) {
+	for _, s := range testSummaries() {
+		s.UserID = "alice"
+		if err := index.Put(s); err != nil {
+			t.Fatalf("%v: failed to put run %v: %v", name, s.RunID, err)
+		}
+	}
+	other := &RunSummary{UserID: "bob", RunID: "a", Status: running}
+	if err := index.Put(other); err != nil {
+		t.Fatalf("%v: failed to put run: %v", name, err)
+	}
+
+	// update
+	update := testSummaries()[2]
+	update.UserID, update.Status = "alice", completed
+	if err := index.Put(update); err != nil {
+		t.Fatalf("%v: failed to update run: %v", name, err)
+	}
+
+	run, err := index.Get("alice", "c")
+	if err != nil {
+		t.Fatalf("%v: failed to get run: %v", name, err)
+	}
+	if run.Status != completed || run.Tags["project"] != "x" || run.WorkflowName != "variant calling" || !run.createdObj.Equal(update.createdObj) {
+		t.Errorf("%v: wrong run returned: %+v", name, run)
+	}
+	if _, err := index.Get("bob", "c"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("%v: expected ErrRunNotFound, got: %v", name, err)
+	}
+
+	runs, err := index.List("alice")
+	if err != nil {
+		t.Fatalf("%v: failed to list runs: %v", name, err)
+	}
+	filter := &RunFilter{Sort: sortDesc, PageSize: defaultPageSize}
+	page, _ := listRunSummaries(runs, filter)
+	if got, expected := summaryRunIDs(page), []string{"e", "d", "c", "b", "a"}; !equalStrings(got, expected) {
+		t.Errorf("%v: expected runs %v, got %v", name, expected, got)
+	}
+	if runs, _ = index.List(""); len(runs) != 6 {
+		t.Errorf("%v: expected 6 runs across all users, got %v", name, len(runs))
+	}
+
+	if err = index.Delete("alice", "c"); err != nil {
+		t.Fatalf("%v: failed to delete run: %v", name, err)
+	}
+	if _, err := index.Get("alice", "c"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("%v: run still in index after delete", name)
+	}
+}
+
+func TestRunIndex(t *testing.T) {
+	testRunIndex(t, "memory", newMemoryRunIndex())
+
+	sqlite, err := newSQLRunIndex(runIndexSQLite, ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open sqlite run index: %v", err)
+	}
+	testRunIndex(t, "sqlite", sqlite)
+}
+
+func TestRebind(t *testing.T) {
+	postgres := &sqlRunIndex{driver: runIndexPostgres}
+	if q := postgres.rebind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		t.Errorf("wrong postgres query: %v", q)
+	}
+	sqlite := &sqlRunIndex{driver: runIndexSQLite}
+	if q := sqlite.rebind("a = ?"); q != "a = ?" {
+		t.Errorf("wrong sqlite query: %v", q)
+	}
+}
@@ -152,6 +152,7 @@ func processFile(f interface{}) (*File, error) {
 	//
 	// Mapping:
 	// ---- COMMONS/<guid> -> /commons-data/by-guid/<guid>
+	// ---- drs://<host>/<guid> -> /commons-data/by-guid/<guid>
 	// ---- USER/<path> -> /user-data/<path> // not implemented yet
 	// ---- <path> -> <path> // no path processing required, implies file lives in engine workspace
 	switch {
@@ -173,6 +174,14 @@ func processFile(f interface{}) (*File, error) {
 		*/
 		GUID := strings.TrimPrefix(path, commonsPrefix)
 		path = strings.Join([]string{pathToCommonsData, GUID}, "")
+	case strings.HasPrefix(path, drsScheme):
+		// "drs://<host>/<guid>" -> "/commons-data/data/by-guid/<guid>"
+		// the server has added the GUID to the manifest - see drs.go
+		GUID, err := parseDRSURI(path)
+		if err != nil {
+			return nil, err
+		}
+		path = strings.Join([]string{pathToCommonsData, GUID}, "")
 	case strings.HasPrefix(path, userPrefix):
 		/*
 			~ Path representations/handling for user-data ~
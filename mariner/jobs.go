@@ -117,12 +117,8 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 	// NOTE: resource usage is a TIME SERIES - for now, we collect the whole thing
 	// time points are every 30s (seems to be a k8s metrics monitoring default)
 
-	// Q. how to handle task retries for metrics monitoring?
-	// probably should keep the metrics for the failed attempt
-	// and then separately track the metrics for each retry
-	// this is to be handled when retry-logic is implemented
-	// question is, will the job name be the same?
-	// I believe so
+	// a retried task gets a new job, with a new name
+	// the samples of all attempts go into the same series
 
 	// keep sampling resource usage until task finishes
 	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
@@ -130,8 +126,6 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 		tool.Task.Log.Event.warnf("%v", err)
 		return err
 	}
-	label := fmt.Sprintf("job-name=%v", tool.Task.Log.JobName)
-
 	engine.Lock()
 	tool.Task.Log.Stats.ResourceUsage.init() // #race #ok
 	engine.Unlock()
@@ -139,6 +133,7 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 	done := false
 	for !done {
 		// collect (cpu, mem) sample point
+		label := fmt.Sprintf("job-name=%v", tool.Task.Log.JobName)
 		if err = tool.sampleResourceUsage(podsClient, label); err != nil {
 			engine.Log.Main.Event.warnf("failed to sample resource usage for task: %v; error: %v", tool.Task.Root.ID, err)
 		}
@@ -169,10 +164,32 @@ func (engine *K8sEngine) dispatchTaskJob(tool *Tool) error {
 	if err != nil {
 		return engine.errorf("%v", err)
 	}
+	// the job may have to wait for the user's quota - see quota.go
+	taskQuotaLock.Lock()
+	if err = engine.waitForTaskQuota(tool, batchJob); err != nil {
+		taskQuotaLock.Unlock()
+		return engine.errorf("failed to dispatch job for task: %v; error: %v", tool.Task.Root.ID, err)
+	}
+	// the pod can't start without its token secret - see tasktoken.go
+	if engine.wantsTaskToken() {
+		if err = engine.createTaskTokenSecret(tool); err != nil {
+			taskQuotaLock.Unlock()
+			return engine.errorf("failed to set up user token for task: %v; error: %v", tool.Task.Root.ID, err)
+		}
+	}
 	newJob, err := jobsClient.Create(context.TODO(), batchJob, metav1.CreateOptions{})
+	taskQuotaLock.Unlock()
 	if err != nil {
+		if err := engine.deleteTaskTokenSecret(tool); err != nil {
+			engine.warnf("failed to delete token secret for task: %v; error: %v", tool.Task.Root.ID, err)
+		}
 		return engine.errorf("failed to create job for task: %v; error: %v", tool.Task.Root.ID, err)
 	}
+	if engine.wantsTaskToken() {
+		if err = engine.ownTaskTokenSecret(newJob); err != nil {
+			engine.warnf("failed to make task job own its token secret: %v; error: %v", tool.Task.Root.ID, err)
+		}
+	}
 	engine.infof("created job with (name, id) (%v, %v) for task: %v", newJob.Name, newJob.GetUID(), tool.Task.Root.ID)
 
 	// probably can make this nicer to look at
@@ -301,7 +318,7 @@ func jobByID(jc batchtypev1.JobInterface, jobID string) (*batchv1.Job, error) {
 // trade engine jobName for engine jobID
 func engineJobID(jc batchtypev1.JobInterface, jobName string) string {
 	// FIXME: don't hardcode ListOptions here like this
-	engines, err := jc.List(context.TODO(), metav1.ListOptions{LabelSelector: "app=mariner-engine"})
+	engines, err := jc.List(context.TODO(), metav1.ListOptions{LabelSelector: engineJobSelector})
 	if err != nil {
 		// log
 		fmt.Println("error fetching engine job list: ", err)
@@ -402,11 +419,11 @@ func deleteJobs(jobs []batchv1.Job, condition string, jobsClient batchtypev1.Job
 
 func listMarinerJobs(jobsClient batchtypev1.JobInterface) ([]batchv1.Job, error) {
 	jobs := []batchv1.Job{}
-	tasks, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "app=mariner-task"})
+	tasks, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: taskJobSelector})
 	if err != nil {
 		return nil, err
 	}
-	engines, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "app=mariner-engine"})
+	engines, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: engineJobSelector})
 	if err != nil {
 		return nil, err
 	}
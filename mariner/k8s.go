@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	batchv1 "k8s.io/api/batch/v1"
@@ -125,10 +126,23 @@ func engineEnv(r *WorkflowRequest) (env []k8sv1.EnvVar) {
 			Name:  userIDEnvVar,
 			Value: r.UserID,
 		},
-		{
+	}
+	if Config.Storage.S3.staticCredentials() {
+		env = append(env, k8sv1.EnvVar{
 			Name:      "AWSCREDS",
 			ValueFrom: envVarAWSUserCreds,
-		},
+		})
+	}
+	if key := Config.Secrets.WebhookSigningKey; key != nil {
+		env = append(env, k8sv1.EnvVar{
+			Name: webhookSigningKeyEnvVar,
+			ValueFrom: &k8sv1.EnvVarSource{
+				SecretKeyRef: &k8sv1.SecretKeySelector{
+					LocalObjectReference: k8sv1.LocalObjectReference{Name: key.Name},
+					Key:                  key.Key,
+				},
+			},
+		})
 	}
 	return env
 }
@@ -163,6 +177,9 @@ func (engine *K8sEngine) taskJob(tool *Tool) (job *batchv1.Job, err error) {
 	if err != nil {
 		return nil, engine.errorf("failed to load container spec for task: %v; error: %v", tool.Task.Root.ID, err)
 	}
+	if engine.wantsTaskToken() {
+		addTaskToken(job, Config.Containers.Task.Name)
+	}
 	engine.infof("end load job spec for task: %v", tool.Task.Root.ID)
 	return job, nil
 }
@@ -217,21 +234,38 @@ func (tool *Tool) taskContainer() (container *k8sv1.Container, err error) {
 }
 
 // containerArgs creates the necessary command arguments in a tool container for sidecar.
+//
+// the console output and exit status of the command are copied to the task log dir (see taskLogDir)
+// while still going to the container's stdout/stderr, so that it outlives the pod
+// the script is POSIX sh, and copies the output with fifos and tee, since sh has no process substitution
+// tool images without mkfifo or tee get plain redirection instead - the output is then only in the task log dir
 func (tool *Tool) containerArgs() []string {
 	tool.Task.infof("begin load container args")
 	args := []string{
 		"-c",
 		fmt.Sprintf(`
-			while [[ ! -f %vrun.sh ]]; do
+			while [ ! -f %[1]vrun.sh ]; do
 				echo "Waiting for sidecar to finish setting up..";
 				sleep 5
 			done
 			echo "Sidecar setup complete! Running command script now.."
-			cd %v
-			echo "running command $(cat %vrun.sh)"
-			%v %vrun.sh
-			touch %vdone
-			`, tool.WorkingDir, tool.WorkingDir, tool.WorkingDir, tool.cltBash(), tool.WorkingDir, tool.WorkingDir),
+			cd %[1]v
+			mkdir -p %[2]v
+			echo "running command $(cat %[1]vrun.sh)"
+			if command -v mkfifo > /dev/null && command -v tee > /dev/null; then
+				mkfifo /tmp/_mariner_stdout /tmp/_mariner_stderr
+				tee %[2]v%[4]v < /tmp/_mariner_stdout &
+				tee %[2]v%[5]v < /tmp/_mariner_stderr >&2 &
+				%[3]v %[1]vrun.sh > /tmp/_mariner_stdout 2> /tmp/_mariner_stderr
+				echo $? > %[2]v%[6]v
+				wait
+			else
+				echo "no mkfifo or tee in the image - the command's output only goes to %[2]v"
+				%[3]v %[1]vrun.sh > %[2]v%[4]v 2> %[2]v%[5]v
+				echo $? > %[2]v%[6]v
+			fi
+			touch %[1]vdone
+			`, tool.WorkingDir, taskLogDir(tool.WorkingDir), tool.cltBash(), taskStdoutFile, taskStderrFile, taskExitCodeFile),
 	}
 	tool.Task.infof("end load container args")
 	return args
@@ -273,10 +307,6 @@ func (tool *Tool) env() (env []k8sv1.EnvVar, err error) {
 func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 	engine.infof("load s3 sidecar env for task: %v", tool.Task.Root.ID)
 	env = []k8sv1.EnvVar{
-		{
-			Name:      "AWSCREDS",
-			ValueFrom: envVarAWSUserCreds,
-		},
 		{
 			Name:  userIDEnvVar,
 			Value: engine.UserID,
@@ -309,6 +339,30 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 			Name:  "S3_REGION",
 			Value: Config.Storage.S3.Region,
 		},
+		{
+			Name:  "S3_ENDPOINT",
+			Value: Config.Storage.S3.Endpoint,
+		},
+		{
+			Name:  "S3_FORCE_PATH_STYLE",
+			Value: strconv.FormatBool(Config.Storage.S3.ForcePathStyle),
+		},
+		{
+			Name:  "S3_CREDENTIALS",
+			Value: Config.Storage.S3.Credentials,
+		},
+		{
+			Name:  "S3_ROLE_ARN",
+			Value: Config.Storage.S3.RoleARN,
+		},
+		{
+			Name:  "STORAGE_DRIVER",
+			Value: Config.Storage.driver(),
+		},
+		{
+			Name:  "STORAGE_ROOT",
+			Value: Config.Storage.Local.Root,
+		},
 		{
 			Name:  "CONFORMANCE_INPUT_S3_PREFIX",
 			Value: conformanceInputS3Prefix,
@@ -319,6 +373,23 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 		},
 	}
 
+	if Config.Storage.S3.staticCredentials() {
+		env = append(env, k8sv1.EnvVar{
+			Name:      "AWSCREDS",
+			ValueFrom: envVarAWSUserCreds,
+		})
+	}
+	// the sidecar assumes the role as the user
+	if Config.Storage.S3.PerUserRole {
+		env = append(env, k8sv1.EnvVar{
+			Name:  "S3_ROLE_SESSION_NAME",
+			Value: roleSessionName(engine.UserID),
+		}, k8sv1.EnvVar{
+			Name:  "S3_SESSION_POLICY",
+			Value: userPolicy(Config.Storage.S3.Name, engine.UserID),
+		})
+	}
+
 	conformanceTestFlag := k8sv1.EnvVar{
 		Name: "CONFORMANCE_TEST",
 	}
@@ -510,7 +581,7 @@ func (engine *K8sEngine) taskVolumes(tool *Tool) []k8sv1.Volume {
 func (engine *K8sEngine) createPVC(claimName string) error {
 
 	// todo - add to config or at least don't hardcode here
-	storageClassName := "mariner-storage"
+	storageClassName := marinerStorageClassName
 
 	pvc := &k8sv1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
@@ -568,7 +639,7 @@ func jobSpec(component string, userID string, jobName string) (job *batchv1.Job)
 
 	// wts depends on this particular annotation
 	job.Spec.Template.Annotations = make(map[string]string)
-	job.Spec.Template.Annotations["gen3username"] = userID
+	job.Spec.Template.Annotations[userAnnotation] = userID
 
 	return job
 }
@@ -1,16 +1,13 @@
 package mariner
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // TODO - write json encodings for all this AFTER implementing it
@@ -21,36 +18,34 @@ type MainLog struct {
 	sync.RWMutex `json:"-"`
 	Path         string           `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
 	Request      *WorkflowRequest `json:"request"`
+	ParentRunID  string           `json:"parentRunID,omitempty"` // the run this one is a rerun of - see rerun.go
 	Main         *Log             `json:"main"`
 	ByProcess    map[string]*Log  `json:"byProcess"`
+	Journal      *Journal         `json:"journal,omitempty"` // see events.go
 }
 
 // MainLogJSON gets written to workflowHistorydb
 type MainLogJSON struct {
-	Path      string           `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
-	Request   *WorkflowRequest `json:"request"`
-	Main      *Log             `json:"main"`
-	ByProcess map[string]*Log  `json:"byProcess"`
+	Path        string           `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
+	Request     *WorkflowRequest `json:"request"`
+	ParentRunID string           `json:"parentRunID,omitempty"`
+	Main        *Log             `json:"main"`
+	ByProcess   map[string]*Log  `json:"byProcess"`
+	Journal     *Journal         `json:"journal,omitempty"`
 }
 
-// TODO - sort list - latest to oldest request
+// listRuns returns the IDs of all the runs in the user's history
+// ordering and filtering happen in listRunSummaries
 func (server *Server) listRuns(userID string) ([]string, error) {
-	sess := server.S3FileManager.newS3Session()
-	svc := s3.New(sess)
 	prefix := fmt.Sprintf(pathToUserRunsf, userID)
-	query := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(Config.Storage.S3.Name),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
-	}
-	result, err := svc.ListObjectsV2(query)
+	// each page holds at most 1000 keys - Prefixes follows the pages to get them all
+	prefixes, err := storage.Prefixes(server.FileManager, prefix, "/")
 	if err != nil {
 		return nil, err
 	}
 	runIDs := []string{}
-	for _, v := range result.CommonPrefixes {
-		runID := strings.Split(v.String(), "/")[2]
-		runIDs = append(runIDs, runID)
+	for _, p := range prefixes {
+		runIDs = append(runIDs, strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
 	}
 	return runIDs, nil
 }
@@ -58,34 +53,21 @@ func (server *Server) listRuns(userID string) ([]string, error) {
 // split this out into smaller, more atomic functions as soon as it's working - refactor
 // most API endpoint handlers will call this function
 func (server *Server) fetchMainLog(userID, runID string) (*MainLog, error) {
-	var err error
-
-	sess := server.S3FileManager.newS3Session()
-
-	// Create a downloader with the session and default options
-	downloader := s3manager.NewDownloader(sess)
-
-	// Create a buffer to write the S3 Object contents to.
-	// see: https://stackoverflow.com/questions/41645377/golang-s3-download-to-buffer-using-s3manager-downloader
-	buf := &aws.WriteAtBuffer{}
+	return fetchMainLog(server.FileManager, userID, runID)
+}
 
+func fetchMainLog(fm *FileManager, userID, runID string) (*MainLog, error) {
 	objKey := fmt.Sprintf(pathToUserRunLogf, userID, runID)
-
-	// Write the contents of S3 Object to the buffer
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-	}
-	_, err = downloader.Download(buf, s3Obj)
+	b, err := storage.ReadAll(fm, objKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file, %v", err)
+		return nil, fmt.Errorf("failed to download file, %w", err)
 	}
-	b := buf.Bytes()
 	log := &MainLog{}
 	err = json.Unmarshal(b, log)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarhsalling log: %v", err)
 	}
+	log.attachJournal()
 	return log, nil
 }
 
@@ -94,7 +76,9 @@ func mainLog(path string) *MainLog {
 		Path:      path,
 		Main:      logger(),
 		ByProcess: make(map[string]*Log),
+		Journal:   &Journal{},
 	}
+	log.Journal.attach(mainProcessID, log.Main)
 	return log
 }
 
@@ -121,14 +105,13 @@ func (engine *K8sEngine) writeLogToS3() error {
 	engine.Log.RLock()
 	defer engine.Log.RUnlock()
 
-	sess := engine.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
-
 	mainLogJSON := MainLogJSON{
-		Path:      engine.Log.Path,
-		Request:   engine.Log.Request,
-		Main:      engine.Log.Main,
-		ByProcess: engine.Log.ByProcess,
+		Path:        engine.Log.Path,
+		Request:     engine.Log.Request,
+		ParentRunID: engine.Log.ParentRunID,
+		Main:        engine.Log.Main,
+		ByProcess:   engine.Log.ByProcess,
+		Journal:     engine.Log.Journal,
 	}
 	j, err := json.Marshal(mainLogJSON)
 	if err != nil {
@@ -137,28 +120,29 @@ func (engine *K8sEngine) writeLogToS3() error {
 
 	objKey := fmt.Sprintf(pathToUserRunLogf, engine.UserID, engine.RunID)
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-		Body:   bytes.NewReader(j),
-	})
-	if err != nil {
+	if err = storage.PutBytes(engine.FileManager, objKey, j); err != nil {
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
+	if err = writeJournal(engine.FileManager, engine.UserID, engine.RunID, engine.Log.Journal); err != nil {
+		return fmt.Errorf("failed to upload journal, %v", err)
+	}
 
+	// the index only needs updating when the status of the run changes
+	if engine.Log.Main.Status != engine.indexedStatus {
+		indexRun(engine.runIndex, engine.UserID, engine.RunID, engine.Log)
+		engine.indexedStatus = engine.Log.Main.Status
+	}
 	return nil
 }
 
 func (server *Server) writeLog(mainLog *MainLog, userID string, runID string) error {
-	sess := server.S3FileManager.newS3Session()
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploader(sess)
-
 	mainLogJSON := MainLogJSON{
-		Path:      mainLog.Path,
-		Request:   mainLog.Request,
-		Main:      mainLog.Main,
-		ByProcess: mainLog.ByProcess,
+		Path:        mainLog.Path,
+		Request:     mainLog.Request,
+		ParentRunID: mainLog.ParentRunID,
+		Main:        mainLog.Main,
+		ByProcess:   mainLog.ByProcess,
+		Journal:     mainLog.Journal,
 	}
 	j, err := json.Marshal(mainLogJSON)
 	if err != nil {
@@ -168,16 +152,14 @@ func (server *Server) writeLog(mainLog *MainLog, userID string, runID string) er
 	objKey := fmt.Sprintf(pathToUserRunLogf, userID, runID)
 
 	// Upload the file to S3.
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-		Body:   bytes.NewReader(j),
-	})
-
-	if err != nil {
+	if err = storage.PutBytes(server.FileManager, objKey, j); err != nil {
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
+	if err = writeJournal(server.FileManager, userID, runID, mainLog.Journal); err != nil {
+		return fmt.Errorf("failed to upload journal, %v", err)
+	}
 
+	indexRun(server.runIndex, userID, runID, mainLog)
 	return nil
 }
 
@@ -196,6 +178,7 @@ type Log struct {
 	LastUpdatedObj time.Time              `json:"-"`
 	JobID          string                 `json:"jobID,omitempty"`
 	JobName        string                 `json:"jobName,omitempty"`
+	WorkingDir     string                 `json:"workingDir,omitempty"`
 	ContainerImage string                 `json:"containerImage,omitempty"`
 	Status         string                 `json:"status"`
 	Stats          *Stats                 `json:"stats"`
@@ -203,6 +186,7 @@ type Log struct {
 	Input          map[string]interface{} `json:"input"`
 	Output         map[string]interface{} `json:"output"`
 	Scatter        map[int]*Log           `json:"scatter,omitempty"`
+	ExitCode       *int                   `json:"exitCode,omitempty"` // of the task's command - see recordExitCode
 }
 
 func (r *ResourceUsage) init() {
@@ -233,7 +217,10 @@ func (log *Log) finish() {
 	log.LastUpdated = timef(log.LastUpdatedObj)
 	log.Stats.DurationObj = t.Sub(log.CreatedObj)
 	log.Stats.Duration = log.Stats.DurationObj.Seconds()
-	log.Status = completed
+	// a cancelled or failed task keeps its status
+	if log.Status == running || log.Status == notStarted {
+		log.setStatus(completed)
+	}
 }
 
 // called when a task is run
@@ -243,7 +230,22 @@ func (log *Log) start() {
 	log.Created = timef(t)
 	log.LastUpdatedObj = t
 	log.LastUpdated = timef(t)
-	log.Status = running
+	log.setStatus(running)
+}
+
+// setStatus updates the status of the process and records the transition in the run's journal
+func (log *Log) setStatus(status string) {
+	if log.Status == status {
+		return
+	}
+	log.Status = status
+	if log.Event != nil && log.Event.journal != nil {
+		log.Event.journal.add(&JournalEntry{
+			Process: log.Event.process,
+			Type:    statusEntry,
+			Status:  status,
+		})
+	}
 }
 
 func logger() *Log {
@@ -295,6 +297,10 @@ type ResourceUsageSamplePoint struct {
 type EventLog struct {
 	sync.RWMutex
 	Events []string `json:"events,omitempty"`
+
+	// every event is also written to the run's journal, if the log is attached to one
+	journal *Journal
+	process string
 }
 
 // update log (i.e., write to log file) each time there's an error, to capture point of failure
@@ -334,6 +340,15 @@ func (log *EventLog) write(level, message string) {
 	// timezone???
 	record := fmt.Sprintf("%v - %v - %v", timestamp, level, message)
 	log.Events = append(log.Events, record)
+	if log.journal != nil {
+		log.journal.add(&JournalEntry{
+			Time:    timestamp,
+			Process: log.process,
+			Type:    eventEntry,
+			Level:   level,
+			Message: message,
+		})
+	}
 }
 
 func (log *EventLog) infof(f string, v ...interface{}) {
@@ -382,3 +397,8 @@ func timef(t time.Time) string {
 	s := fmt.Sprintf("%v/%v/%v %v:%v:%v", t.Year(), int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second())
 	return s
 }
+
+// parseTimef is the inverse of timef
+func parseTimef(s string) (time.Time, error) {
+	return time.ParseInLocation("2006/1/2 15:4:5", s, time.Local)
+}
@@ -0,0 +1,356 @@
+package mariner
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// this file contains the webhook notifications of a run
+//
+// a workflow request may list callback URLs and the events to be notified of:
+//
+// "notifications": {
+//     "urls": ["https://orchestrator.example.org/mariner/callback"],
+//     "events": ["completed", "failed"]
+// }
+//
+// events: "started", "task_failed", "completed", "failed", "cancelled" - all of them if none are listed
+//
+// the notifications are driven by the run's journal - each status transition of the run, or a task failure,
+// is POSTed as a WebhookPayload to every URL
+// the engine sends all of them except "cancelled", which the server sends since it kills the engine
+//
+// if a signing key is configured (see Secrets.WebhookSigningKey), the body is signed with HMAC-SHA256:
+// X-Mariner-Signature: sha256=<hex>
+//
+// deliveries which fail with a network error, a 5xx or a 429 are retried with exponential backoff
+//
+// callback URLs may not point into the cluster - a host which resolves to a loopback, private or link-local address
+// is rejected on submission, and again when connecting, in case its address changed or a redirect leads there
+// hosts listed in the config's 'webhooks.allowed_hosts' are exempt, e.g., an orchestrator inside the cluster
+
+const (
+	eventStarted    = "started"
+	eventTaskFailed = "task_failed"
+	eventCompleted  = "completed"
+	eventFailed     = "failed"
+	eventCancelled  = "cancelled"
+
+	webhookSigningKeyEnvVar = "WEBHOOK_SIGNING_KEY"
+
+	webhookEventHeader     = "X-Mariner-Event"
+	webhookDeliveryHeader  = "X-Mariner-Delivery"
+	webhookSignatureHeader = "X-Mariner-Signature"
+
+	webhookMaxAttempts = 6
+	webhookBackoff     = 2 * time.Second // doubled after each attempt
+	webhookTimeout     = 10 * time.Second
+
+	// how long the engine waits for pending deliveries before exiting
+	webhookDrainTimeout = 2 * time.Minute
+)
+
+var webhookEvents = []string{eventStarted, eventTaskFailed, eventCompleted, eventFailed, eventCancelled}
+
+// addresses which callbacks may not reach, besides loopback, link-local and unspecified ones
+var internalNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10", // carrier-grade NAT
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7", // unique local
+)
+
+// lookupIP resolves the host of a callback URL
+var lookupIP = net.LookupIP
+
+// WebhookConfig ..
+type WebhookConfig struct {
+	AllowedHosts []string `json:"allowed_hosts"` // callback hosts which may resolve to internal addresses
+}
+
+func (c *WebhookConfig) allowed(host string) bool {
+	for _, allowed := range c.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// internalIP is true for the addresses which callbacks may not reach
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCallbackHost returns an error if the host doesn't resolve, or resolves to an internal address
+func checkCallbackHost(host string) error {
+	if Config.Webhooks.allowed(host) {
+		return nil
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve host: %v", host)
+	}
+	for _, ip := range ips {
+		if internalIP(ip) {
+			return fmt.Errorf("host resolves to an internal address: %v", host)
+		}
+	}
+	return nil
+}
+
+// webhookClient connects only to external addresses, unless the callback's host is allowed
+func webhookClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: webhookTimeout}
+		if !Config.Webhooks.allowed(host) {
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				ip, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if internalIP(net.ParseIP(ip)) {
+					return fmt.Errorf("callback host %v resolves to an internal address: %v", host, ip)
+				}
+				return nil
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// Notifications is the optional 'notifications' block of a WorkflowRequest
+type Notifications struct {
+	URLs   []string `json:"urls"`
+	Events []string `json:"events,omitempty"` // all events if empty
+}
+
+// WebhookPayload ..
+type WebhookPayload struct {
+	Event   string `json:"event"`
+	RunID   string `json:"runID"`
+	Process string `json:"process"` // "#main" for the run, the task ID for a task
+	Status  string `json:"status"`
+	Time    string `json:"time"`
+	Offset  int    `json:"offset"` // of the status transition in the run's journal, see events.go
+}
+
+// validate checks the URLs and events of the notifications block, if any
+func (n *Notifications) validate() error {
+	if n == nil {
+		return nil
+	}
+	if len(n.URLs) == 0 {
+		return fmt.Errorf("notifications: no urls given")
+	}
+	for _, u := range n.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+			return fmt.Errorf("notifications: invalid url: %v", u)
+		}
+		if err = checkCallbackHost(parsed.Hostname()); err != nil {
+			return fmt.Errorf("notifications: %v", err)
+		}
+	}
+	for _, event := range n.Events {
+		if !contains(webhookEvents, event) {
+			return fmt.Errorf("notifications: unknown event: %v - must be one of %v", event, webhookEvents)
+		}
+	}
+	return nil
+}
+
+func (n *Notifications) wants(event string) bool {
+	return len(n.Events) == 0 || contains(n.Events, event)
+}
+
+// webhookEvent returns the event of a journal entry, or "" if it's not one
+func webhookEvent(entry *JournalEntry) string {
+	if entry.Type != statusEntry {
+		return ""
+	}
+	if entry.Process != mainProcessID {
+		if entry.Status == failed {
+			return eventTaskFailed
+		}
+		return ""
+	}
+	switch entry.Status {
+	case running:
+		return eventStarted
+	case completed:
+		return eventCompleted
+	case failed:
+		return eventFailed
+	case cancelled:
+		return eventCancelled
+	}
+	return ""
+}
+
+// signPayload returns the value of the signature header for the body
+func signPayload(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type notifier struct {
+	runID         string
+	notifications *Notifications
+	key           []byte
+	client        *http.Client
+	backoff       time.Duration
+	wg            sync.WaitGroup
+}
+
+// newNotifier returns nil if the request has no notifications
+func newNotifier(runID string, request *WorkflowRequest) *notifier {
+	if request == nil || request.Notifications == nil || len(request.Notifications.URLs) == 0 {
+		return nil
+	}
+	return &notifier{
+		runID:         runID,
+		notifications: request.Notifications,
+		key:           []byte(os.Getenv(webhookSigningKeyEnvVar)),
+		client:        webhookClient(),
+		backoff:       webhookBackoff,
+	}
+}
+
+// watch makes the notifier send the events of the journal's status transitions
+func (n *notifier) watch(journal *Journal) {
+	if n == nil || journal == nil {
+		return
+	}
+	journal.onStatus = n.notify
+}
+
+func (n *notifier) notify(entry *JournalEntry) {
+	event := webhookEvent(entry)
+	if event == "" || !n.notifications.wants(event) {
+		return
+	}
+	body, err := json.Marshal(&WebhookPayload{
+		Event:   event,
+		RunID:   n.runID,
+		Process: entry.Process,
+		Status:  entry.Status,
+		Time:    entry.Time,
+		Offset:  entry.Offset,
+	})
+	if err != nil {
+		fmt.Printf("failed to marshal webhook payload: %v\n", err)
+		return
+	}
+	delivery := fmt.Sprintf("%v-%v", n.runID, entry.Offset)
+	for _, u := range n.notifications.URLs {
+		n.wg.Add(1)
+		go func(u string) {
+			defer n.wg.Done()
+			if err := n.deliver(u, event, delivery, body); err != nil {
+				fmt.Printf("failed to deliver %v webhook for run %v to %v: %v\n", event, n.runID, u, err)
+			}
+		}(u)
+	}
+}
+
+func (n *notifier) deliver(u, event, delivery string, body []byte) (err error) {
+	backoff := n.backoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		retry := false
+		if retry, err = n.post(u, event, delivery, body); err == nil || !retry {
+			return err
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return fmt.Errorf("giving up after %v attempts: %v", webhookMaxAttempts, err)
+}
+
+// post makes one delivery attempt - retry is true if the delivery may succeed later
+func (n *notifier) post(u, event, delivery string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mariner/"+Version)
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookDeliveryHeader, delivery)
+	if len(n.key) > 0 {
+		req.Header.Set(webhookSignatureHeader, signPayload(n.key, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("callback returned %v", resp.Status)
+	default:
+		return false, fmt.Errorf("callback returned %v", resp.Status)
+	}
+}
+
+// wait waits for pending deliveries, for at most the given time
+func (n *notifier) wait(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Printf("timed out waiting for webhook deliveries of run %v\n", n.runID)
+	}
+}
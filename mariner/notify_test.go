@@ -0,0 +1,151 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationsValidate(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error), webhooks WebhookConfig) {
+		lookupIP, Config.Webhooks = lookup, webhooks
+	}(lookupIP, Config.Webhooks)
+	hosts := map[string]string{
+		"example.org":          "93.184.216.34",
+		"localhost":            "127.0.0.1",
+		"orchestrator.local":   "10.0.3.7",
+		"metadata.internal":    "169.254.169.254",
+		"rebind.example.org":   "192.168.1.1",
+		"v6.example.org":       "fd00::1",
+		"orchestrator.allowed": "10.0.3.8",
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IP{ip}, nil
+		}
+		if ip, ok := hosts[host]; ok {
+			return []net.IP{net.ParseIP(ip)}, nil
+		}
+		return nil, fmt.Errorf("no such host: %v", host)
+	}
+	Config.Webhooks = WebhookConfig{AllowedHosts: []string{"orchestrator.allowed"}}
+
+	var none *Notifications
+	cases := []struct {
+		n  *Notifications
+		ok bool
+	}{
+		{none, true},
+		{&Notifications{URLs: []string{"https://example.org/hook"}}, true},
+		{&Notifications{URLs: []string{"http://example.org/hook"}, Events: []string{eventCompleted, eventTaskFailed}}, true},
+		{&Notifications{}, false},
+		{&Notifications{URLs: []string{"example.org/hook"}}, false},
+		{&Notifications{URLs: []string{"ftp://example.org/hook"}}, false},
+		{&Notifications{URLs: []string{"https://example.org/hook"}, Events: []string{"finished"}}, false},
+		// callbacks into the cluster
+		{&Notifications{URLs: []string{"http://localhost:8080/hook"}}, false},
+		{&Notifications{URLs: []string{"http://127.0.0.1/hook"}}, false},
+		{&Notifications{URLs: []string{"http://[::1]/hook"}}, false},
+		{&Notifications{URLs: []string{"http://orchestrator.local/hook"}}, false},
+		{&Notifications{URLs: []string{"http://metadata.internal/latest/meta-data"}}, false},
+		{&Notifications{URLs: []string{"https://example.org/hook", "http://rebind.example.org/hook"}}, false},
+		{&Notifications{URLs: []string{"http://v6.example.org/hook"}}, false},
+		{&Notifications{URLs: []string{"http://unknown.example.org/hook"}}, false},
+		{&Notifications{URLs: []string{"http://orchestrator.allowed/hook"}}, true},
+	}
+	for i, c := range cases {
+		if err := c.n.validate(); (err == nil) != c.ok {
+			t.Errorf("case %v: expected ok=%v, got %v", i, c.ok, err)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var lock sync.Mutex
+	received := []*WebhookPayload{}
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		// the first delivery attempt fails, and must be retried
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(webhookSignatureHeader); sig != signPayload([]byte("secret"), body) {
+			t.Errorf("wrong signature: %v", sig)
+		}
+		payload := &WebhookPayload{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			t.Errorf("failed to unmarshal payload: %v", err)
+		}
+		if r.Header.Get(webhookEventHeader) != payload.Event {
+			t.Errorf("event header %v doesn't match payload event %v", r.Header.Get(webhookEventHeader), payload.Event)
+		}
+		received = append(received, payload)
+	}))
+	defer hook.Close()
+	defer func(webhooks WebhookConfig) { Config.Webhooks = webhooks }(Config.Webhooks)
+	Config.Webhooks = WebhookConfig{AllowedHosts: []string{"127.0.0.1"}}
+
+	request := &WorkflowRequest{Notifications: &Notifications{
+		URLs:   []string{hook.URL},
+		Events: []string{eventTaskFailed, eventFailed},
+	}}
+	n := newNotifier("run-1", request)
+	n.key, n.backoff = []byte("secret"), time.Millisecond
+
+	runLog := mainLog("")
+	n.watch(runLog.Journal)
+	task := logger()
+	runLog.ByProcess["#main/align"] = task
+	runLog.Journal.attach("#main/align", task)
+
+	runLog.Main.start()    // started - not wanted
+	task.start()           // task running - not an event
+	task.setStatus(failed) // task_failed
+	runLog.Main.Event.info("x")
+	runLog.Main.setStatus(failed) // failed
+	n.wait(5 * time.Second)
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", len(received))
+	}
+	byEvent := map[string]*WebhookPayload{}
+	for _, p := range received {
+		byEvent[p.Event] = p
+	}
+	if p := byEvent[eventTaskFailed]; p == nil || p.Process != "#main/align" || p.RunID != "run-1" {
+		t.Errorf("wrong task_failed notification: %+v", p)
+	}
+	if p := byEvent[eventFailed]; p == nil || p.Process != mainProcessID || p.Offset != 4 {
+		t.Errorf("wrong failed notification: %+v", p)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+	defer func(webhooks WebhookConfig) { Config.Webhooks = webhooks }(Config.Webhooks)
+
+	// the address is checked on connecting too, e.g., after a redirect
+	Config.Webhooks = WebhookConfig{}
+	if resp, err := webhookClient().Post(hook.URL, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Errorf("connected to an internal address")
+	}
+	Config.Webhooks = WebhookConfig{AllowedHosts: []string{"127.0.0.1"}}
+	resp, err := webhookClient().Post(hook.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to an allowed host: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -1,12 +1,8 @@
 package mariner
 
 import (
-	"fmt"
-	"path/filepath"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	cwl "github.com/uc-cdis/cwl.go"
 )
 
@@ -53,6 +49,9 @@ func (engine *K8sEngine) handleCLTOutput(tool *Tool) (err error) {
 		if output.Binding.LoadContents {
 			tool.Task.infof("begin load file contents")
 			for _, fileObj := range results {
+				if fileObj.Class != CWLFileType {
+					continue
+				}
 				tool.Task.infof("begin load contents for file :%v", fileObj.Path)
 				err = engine.loadContents(fileObj)
 				if err != nil {
@@ -141,7 +140,7 @@ func (engine *K8sEngine) handleCLTOutput(tool *Tool) (err error) {
 		// at this point we have file results captured in `results`
 		// output should be a CWLFileType or "array of Files"
 		// fixme - make this case handling more specific in the else condition - don't just catch anything
-		if output.Types[0].Type == CWLFileType {
+		if t := output.Types[0].Type; t == CWLFileType || t == CWLDirectoryType {
 
 			// fixme - add error handling for cases len(results) != 1
 			if len(results) > 0 {
@@ -161,9 +160,7 @@ func (engine *K8sEngine) handleCLTOutput(tool *Tool) (err error) {
 }
 
 // Glob collects output file(s) for a CLT output parameter after that CLT has run
-// returns an array of files
-//
-// #no-fuse - must glob s3, not locally
+// returns an array of the files, or directories, or both, which the output's type allows, sorted by path
 func (engine *K8sEngine) glob(tool *Tool, output *cwl.Output) (results []*File, err error) {
 	tool.Task.infof("begin glob")
 	var pattern string
@@ -175,87 +172,16 @@ func (engine *K8sEngine) glob(tool *Tool, output *cwl.Output) (results []*File,
 		}
 		patterns = append(patterns, pattern)
 	}
-	paths, err := engine.globS3(tool, patterns)
+	// these are full paths, so no need to add working dir to path
+	files, dirs := globKinds(output)
+	results, err = engine.globS3(tool, patterns, files, dirs)
 	if err != nil {
 		return results, tool.Task.errorf("%v", err)
 	}
-	for _, path := range paths {
-		fileObj := fileObject(path) // these are full paths, so no need to add working dir to path
-		results = append(results, fileObj)
-	}
 	tool.Task.infof("end glob")
 	return results, nil
 }
 
-/*
-	(get list of all files in the tool's working dir)
-	s3 ls --recursive <tool_working_dir>
-
-	then filter that list by the glob pattern
-	your resulting path list
-	consists of all the paths in the working dir which match the pattern
-
-	use this:
-	https://golang.org/pkg/path/filepath/#Match
-*/
-func (engine *K8sEngine) globS3(tool *Tool, patterns []string) ([]string, error) {
-	svc := s3.New(engine.S3FileManager.newS3Session())
-	objectList, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Prefix: aws.String(strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/")),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list keys from tool working dir in s3: %v", err)
-	}
-
-	/*
-		note:
-		glob patterns in the CWL should (?) be specified relative
-		to that task's runtime environment
-		that is, all glob patterns should (?) resolve to absolute paths
-		the way to do this in the CWL is, for example:
-		glob: $(runtime.outdir + 'my_glob_pattern*')
-
-		see also: https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
-	*/
-
-	var key string
-	var match bool
-	var collectFile bool
-	var path string
-	globResults := []string{}
-	for _, obj := range objectList.Contents {
-		// match key against pattern
-		key = *obj.Key
-
-		collectFile = false
-		for _, pattern := range patterns {
-			s3Pattern := strings.TrimPrefix(engine.localPathToS3Key(pattern), "/")
-
-			// handle case of glob pattern not resolving to absolute path
-			// fixme: this is not pretty
-			if !strings.HasPrefix(s3Pattern, engine.UserID) {
-				s3wkdir := strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/")
-				s3Pattern = fmt.Sprintf("%s/%s", strings.TrimSuffix(s3wkdir, "/"), strings.TrimPrefix(s3Pattern, "/"))
-			}
-
-			match, err = filepath.Match(s3Pattern, key)
-			if err != nil {
-				return nil, fmt.Errorf("glob pattern matching failed: %v", err)
-			} else if match {
-				collectFile = true
-			}
-		}
-		if collectFile {
-			// this needs to be represented as a filepath, not a "key"
-			// i.e., it needs a slash at the beginning
-			path = engine.s3KeyToLocalPath(fmt.Sprintf("/%s", key))
-			globResults = append(globResults, path)
-		}
-	}
-	return globResults, nil
-}
-
 func (tool *Tool) pattern(glob string) (pattern string, err error) {
 	tool.Task.infof("begin resolve glob pattern: %v", glob)
 	if strings.HasPrefix(glob, "$") {
@@ -0,0 +1,455 @@
+package mariner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains the output retrieval endpoints
+//
+// GET /runs/{runID}/outputs returns the output of the run (Log.Main.Output)
+// with each File which is in the run's working directory annotated with
+// - url:      a presigned download URL, valid for 'expires_in' seconds (default 1 hour, at most 7 days)
+// - size:     in bytes
+// - checksum: "sha1$<hex>", for files uploaded by a sidecar which records it
+// each Directory in the run's working directory gets a listing of the objects stored under it, annotated the same way
+//
+// GET /runs/{runID}/outputs/archive?format=zip|tar returns all the output files, and the files in the output directories, in one archive
+// the archive is streamed from s3 into s3, next to the run's log, and then served by a presigned URL -
+// so the download isn't bound by the server's write timeout
+// - the first request starts building the archive and returns 202 Accepted with a Retry-After header
+// - once it's built, requests are redirected (303) to its presigned URL
+
+const (
+	defaultOutputURLExpiry = time.Hour
+	maxOutputURLExpiry     = 7 * 24 * time.Hour // the limit for s3 presigned URLs
+
+	archiveZip = "zip"
+	archiveTar = "tar"
+
+	archiveBuilding = "building"
+	archiveReady    = "ready"
+
+	archiveRetryAfter = 5 // seconds
+
+	// the sidecar stores the sha1 of each file it uploads in this object metadata key
+	checksumMetadataKey = "sha1"
+)
+
+// OutputsJSON ..
+type OutputsJSON struct {
+	RunID   string      `json:"runID"`
+	Status  string      `json:"status"`
+	Expires string      `json:"expires"` // RFC 3339 - when the download URLs expire
+	Output  interface{} `json:"output"`
+}
+
+// ArchiveJSON ..
+type ArchiveJSON struct {
+	RunID   string `json:"runID"`
+	Format  string `json:"format"`
+	Status  string `json:"status"` // "building" or "ready"
+	URL     string `json:"url,omitempty"`
+	Expires string `json:"expires,omitempty"`
+}
+
+// outputFile is a File of the run's output which is stored in the run's working directory
+type outputFile struct {
+	obj  map[string]interface{} // the File object in the output tree
+	path string
+	name string // path relative to the run's working directory
+}
+
+// archiveBuild tracks an archive being built in the background
+type archiveBuild struct {
+	done bool
+	err  error
+}
+
+// outputFiles returns the Files in the output tree which are in the run's working directory
+// secondaryFiles and the listings of Directories are included
+func outputFiles(output interface{}, runDir string) []*outputFile {
+	return outputObjects(output, runDir, CWLFileType)
+}
+
+// outputDirectories returns the Directories in the output tree which are in the run's working directory
+func outputDirectories(output interface{}, runDir string) []*outputFile {
+	return outputObjects(output, runDir, CWLDirectoryType)
+}
+
+// outputObjects returns the objects of the class in the output tree which are in the run's working directory
+func outputObjects(output interface{}, runDir string, class string) []*outputFile {
+	files := []*outputFile{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if x["class"] == class {
+				if p, err := filePath(x); err == nil && strings.HasPrefix(p, runDir) {
+					files = append(files, &outputFile{obj: x, path: p, name: strings.TrimPrefix(p, runDir)})
+				}
+			}
+			for _, val := range x {
+				walk(val)
+			}
+		case []interface{}:
+			for _, val := range x {
+				walk(val)
+			}
+		}
+	}
+	walk(output)
+	sort.Slice(files, func(i, k int) bool {
+		return files[i].name < files[k].name
+	})
+	return files
+}
+
+// uniqueOutputFiles drops repeated files, e.g., a file which is output by two parameters
+func uniqueOutputFiles(files []*outputFile) []*outputFile {
+	unique := []*outputFile{}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if !seen[f.name] {
+			seen[f.name] = true
+			unique = append(unique, f)
+		}
+	}
+	return unique
+}
+
+// the expiry of the download URLs, from the 'expires_in' query parameter
+func outputURLExpiry(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("expires_in")
+	if s == "" {
+		return defaultOutputURLExpiry, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxOutputURLExpiry {
+		return 0, fmt.Errorf("invalid expires_in: %v - must be a number of seconds, at most %v", s, int(maxOutputURLExpiry.Seconds()))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func archiveFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", archiveZip:
+		return archiveZip, nil
+	case archiveTar:
+		return archiveTar, nil
+	default:
+		return "", fmt.Errorf("invalid format: %v - must be %v or %v", format, archiveZip, archiveTar)
+	}
+}
+
+// objectChecksum returns the checksum the sidecar recorded for an object, if any
+func objectChecksum(metadata map[string]string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, checksumMetadataKey) && v != "" {
+			return "sha1$" + v
+		}
+	}
+	return ""
+}
+
+//// handlers ////
+
+// '/runs/{runID}/outputs' - GET
+func (server *Server) handleRunOutputsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	expiry, err := outputURLExpiry(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	output := runLog.Main.Output
+	files, err := server.runOutputFiles(userID, runID, output)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to list output directories: %v", err), nil)
+		return
+	}
+	if err = server.annotateOutputFiles(userID, files, expiry); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to presign output files: %v", err), nil)
+		return
+	}
+	writeJSON(w, &OutputsJSON{
+		RunID:   runID,
+		Status:  runLog.Main.Status,
+		Expires: time.Now().Add(expiry).UTC().Format(time.RFC3339),
+		Output:  output,
+	})
+}
+
+// '/runs/{runID}/outputs/archive' - GET
+func (server *Server) handleRunOutputArchiveGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	format, err := archiveFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	expiry, err := outputURLExpiry(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	if runLog.Main.Status != completed {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("run is %v - outputs can be archived once it's completed", runLog.Main.Status), nil)
+		return
+	}
+
+	j := &ArchiveJSON{RunID: runID, Format: format, Status: archiveBuilding}
+	key := fmt.Sprintf(pathToUserOutputArchivef, userID, runID, format)
+	_, err = server.FileManager.Stat(key)
+	switch {
+	case err == nil:
+		j.Status = archiveReady
+		j.URL, err = server.presign(key, expiry)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to presign archive: %v", err), nil)
+			return
+		}
+		j.Expires = time.Now().Add(expiry).UTC().Format(time.RFC3339)
+		w.Header().Set("Location", j.URL)
+		w.WriteHeader(http.StatusSeeOther)
+	case isNotFound(err):
+		files, err := server.runOutputFiles(userID, runID, runLog.Main.Output)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to list output directories: %v", err), nil)
+			return
+		}
+		if err = server.startOutputArchive(userID, key, format, uniqueOutputFiles(files)); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to build output archive: %v", err), nil)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(archiveRetryAfter))
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeStorageError(w, fmt.Errorf("failed to check for output archive: %w", err))
+		return
+	}
+	writeJSON(w, j)
+}
+
+//// s3 ////
+
+// runOutputFiles returns the Files of the run's output, along with the objects stored under its Directories
+func (server *Server) runOutputFiles(userID, runID string, output interface{}) ([]*outputFile, error) {
+	runDir := fmt.Sprintf(pathToRunf, runID)
+	files := outputFiles(output, runDir)
+	for _, dir := range outputDirectories(output, runDir) {
+		dirFiles, err := server.listOutputDirectory(userID, runDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+	sort.SliceStable(files, func(i, k int) bool {
+		return files[i].name < files[k].name
+	})
+	return files, nil
+}
+
+// listOutputDirectory fills in the listing of the Directory object from the objects stored under its prefix,
+// unless it already has one, and returns the Files in it - those in its subdirectories too
+func (server *Server) listOutputDirectory(userID, runDir string, dir *outputFile) ([]*outputFile, error) {
+	if _, ok := dir.obj["listing"]; ok {
+		return nil, nil
+	}
+	prefix := strings.TrimSuffix(server.outputKey(userID, dir), "/") + "/"
+	files := []*outputFile{}
+	root := map[string]interface{}{"listing": []interface{}{}}
+	// the subdirectories by their path relative to dir, with a trailing "/"
+	subdirs := map[string]map[string]interface{}{"./": root}
+	var parent func(rel string) map[string]interface{}
+	parent = func(rel string) map[string]interface{} {
+		if d, ok := subdirs[rel]; ok {
+			return d
+		}
+		p := path.Join(dir.path, rel)
+		d := map[string]interface{}{"class": CWLDirectoryType, "location": p, "path": p, "basename": path.Base(p), "listing": []interface{}{}}
+		up := parent(path.Dir(strings.TrimSuffix(rel, "/")) + "/")
+		up["listing"] = append(up["listing"].([]interface{}), d)
+		subdirs[rel] = d
+		return d
+	}
+	err := storage.Walk(server.FileManager, prefix, func(info *storage.ObjectInfo) bool {
+		rel := strings.TrimPrefix(info.Key, prefix)
+		p := path.Join(dir.path, rel)
+		obj := map[string]interface{}{"class": CWLFileType, "location": p, "path": p, "basename": path.Base(p)}
+		d := parent(path.Dir(rel) + "/")
+		d["listing"] = append(d["listing"].([]interface{}), obj)
+		files = append(files, &outputFile{obj: obj, path: p, name: strings.TrimPrefix(p, runDir)})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	dir.obj["listing"] = root["listing"]
+	return files, nil
+}
+
+// annotateOutputFiles adds the download url, size and checksum to each File object
+// files which aren't in s3 are left as they are
+func (server *Server) annotateOutputFiles(userID string, files []*outputFile, expiry time.Duration) error {
+	sem := make(chan struct{}, maxConcurrentLogFetches)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	for _, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(f *outputFile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			key := server.outputKey(userID, f)
+			info, err := server.FileManager.Stat(key)
+			if err != nil {
+				if !isNotFound(err) {
+					lock.Lock()
+					firstErr = err
+					lock.Unlock()
+				}
+				return
+			}
+			url, err := server.presign(key, expiry)
+			if err != nil {
+				lock.Lock()
+				firstErr = err
+				lock.Unlock()
+				return
+			}
+			// the File objects are all part of one output tree
+			lock.Lock()
+			defer lock.Unlock()
+			f.obj["url"] = url
+			f.obj["size"] = info.Size
+			if checksum := objectChecksum(info.Metadata); checksum != "" {
+				f.obj["checksum"] = checksum
+			}
+		}(f)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (server *Server) outputKey(userID string, f *outputFile) string {
+	return strings.TrimPrefix(server.FileManager.s3Key(f.path, userID), "/")
+}
+
+// presign returns a download URL for the object, which downloads it under its own file name
+func (server *Server) presign(key string, expiry time.Duration) (string, error) {
+	return server.FileManager.Presign(key, expiry, path.Base(key))
+}
+
+// startOutputArchive starts building the archive in the background, unless it's already being built
+// returns the error of the previous attempt if it failed - the next request tries again
+func (server *Server) startOutputArchive(userID, key, format string, files []*outputFile) error {
+	server.archiveLock.Lock()
+	defer server.archiveLock.Unlock()
+	if server.archives == nil {
+		server.archives = make(map[string]*archiveBuild)
+	}
+	if build, ok := server.archives[key]; ok {
+		if !build.done {
+			return nil
+		}
+		delete(server.archives, key)
+		if build.err != nil {
+			return build.err
+		}
+		// built and since deleted from s3 - build it again
+	}
+	build := &archiveBuild{}
+	server.archives[key] = build
+	go func() {
+		err := server.buildOutputArchive(userID, key, format, files)
+		if err != nil {
+			fmt.Printf("failed to build output archive %v: %v\n", key, err)
+		}
+		server.archiveLock.Lock()
+		defer server.archiveLock.Unlock()
+		build.done, build.err = true, err
+	}()
+	return nil
+}
+
+// buildOutputArchive streams the output files from s3 into an archive which is streamed into s3
+func (server *Server) buildOutputArchive(userID, key, format string, files []*outputFile) error {
+	fetch := func(f *outputFile) (io.ReadCloser, int64, time.Time, error) {
+		body, info, err := server.FileManager.Get(server.outputKey(userID, f))
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return body, info.Size, info.LastModified, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, format, files, fetch))
+	}()
+	err := server.FileManager.Put(key, pr, nil)
+	// unblocks the archive writer if the upload failed
+	pr.CloseWithError(err)
+	return err
+}
+
+// writeArchive writes the files to w as a zip or tar archive
+// fetch returns the contents, size and modification time of a file
+func writeArchive(w io.Writer, format string, files []*outputFile, fetch func(*outputFile) (io.ReadCloser, int64, time.Time, error)) error {
+	var zw *zip.Writer
+	var tw *tar.Writer
+	switch format {
+	case archiveZip:
+		zw = zip.NewWriter(w)
+	case archiveTar:
+		tw = tar.NewWriter(w)
+	default:
+		return fmt.Errorf("unsupported archive format: %v", format)
+	}
+	for _, f := range files {
+		body, size, modified, err := fetch(f)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %v: %v", f.name, err)
+		}
+		var entry io.Writer
+		if zw != nil {
+			entry, err = zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: modified})
+		} else {
+			err = tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+			entry = tw
+		}
+		if err == nil {
+			_, err = io.Copy(entry, body)
+		}
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive %v: %v", f.name, err)
+		}
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return tw.Close()
+}
@@ -0,0 +1,163 @@
+package mariner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+const testOutput = `{
+	"bam": {"class": "File", "path": "/engine-workspace/workflowRuns/r1/align-ab12/out.bam",
+		"secondaryFiles": [{"class": "File", "location": "/engine-workspace/workflowRuns/r1/align-ab12/out.bai"}]},
+	"reports": [
+		{"class": "File", "path": "/engine-workspace/workflowRuns/r1/qc-cd34-scatter-0/report.txt"},
+		{"class": "File", "path": "/commons-data/data/by-guid/some-guid"}
+	],
+	"again": {"class": "File", "path": "/engine-workspace/workflowRuns/r1/align-ab12/out.bam"},
+	"count": 3
+}`
+
+func TestOutputFiles(t *testing.T) {
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(testOutput), &output); err != nil {
+		t.Fatalf("failed to unmarshal test output: %v", err)
+	}
+	files := uniqueOutputFiles(outputFiles(output, "/engine-workspace/workflowRuns/r1/"))
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	expected := []string{"align-ab12/out.bai", "align-ab12/out.bam", "qc-cd34-scatter-0/report.txt"}
+	if !equalStrings(names, expected) {
+		t.Errorf("expected output files %v, got %v", expected, names)
+	}
+}
+
+func TestRunOutputFiles(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"alice/workflowRuns/r1/task/out/a.txt", "alice/workflowRuns/r1/task/out/sub/b.txt", "alice/workflowRuns/r1/task/other.txt"} {
+		if err = storage.PutBytes(local, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var output map[string]interface{}
+	if err = json.Unmarshal([]byte(`{
+		"dir": {"class": "Directory", "location": "/engine-workspace/workflowRuns/r1/task/out"},
+		"file": {"class": "File", "location": "/engine-workspace/workflowRuns/r1/task/other.txt"}
+	}`), &output); err != nil {
+		t.Fatalf("failed to unmarshal test output: %v", err)
+	}
+	server := server().withFileManager(&FileManager{Storage: local})
+	files, err := server.runOutputFiles("alice", "r1", output)
+	if err != nil {
+		t.Fatalf("failed to list output files: %v", err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	expected := []string{"task/other.txt", "task/out/a.txt", "task/out/sub/b.txt"}
+	if !equalStrings(names, expected) {
+		t.Errorf("expected output files %v, got %v", expected, names)
+	}
+
+	listing, _ := output["dir"].(map[string]interface{})["listing"].([]interface{})
+	if len(listing) != 2 {
+		t.Fatalf("expected the directory to list a file and a subdirectory, got %v", listing)
+	}
+	sub := listing[1].(map[string]interface{})
+	if listing[0].(map[string]interface{})["basename"] != "a.txt" || sub["class"] != CWLDirectoryType || sub["basename"] != "sub" {
+		t.Errorf("unexpected directory listing: %v", listing)
+	}
+	if subListing := sub["listing"].([]interface{}); len(subListing) != 1 || subListing[0].(map[string]interface{})["path"] != "/engine-workspace/workflowRuns/r1/task/out/sub/b.txt" {
+		t.Errorf("unexpected subdirectory listing: %v", sub["listing"])
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	files := []*outputFile{{name: "a/one.txt"}, {name: "b/two.txt"}}
+	contents := map[string]string{"a/one.txt": "one", "b/two.txt": "second file"}
+	modified := time.Date(2021, 3, 4, 10, 2, 33, 0, time.UTC)
+	fetch := func(f *outputFile) (io.ReadCloser, int64, time.Time, error) {
+		c := contents[f.name]
+		return ioutil.NopCloser(strings.NewReader(c)), int64(len(c)), modified, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeArchive(buf, archiveZip, files, fetch); err != nil {
+		t.Fatalf("failed to write zip: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("expected %v files in zip, got %v", len(files), len(zr.File))
+	}
+	for _, zf := range zr.File {
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatalf("failed to open %v in zip: %v", zf.Name, err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != contents[zf.Name] {
+			t.Errorf("zip: wrong contents of %v: %q", zf.Name, b)
+		}
+	}
+
+	buf.Reset()
+	if err = writeArchive(buf, archiveTar, files, fetch); err != nil {
+		t.Fatalf("failed to write tar: %v", err)
+	}
+	tr := tar.NewReader(buf)
+	n := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		if string(b) != contents[h.Name] || !h.ModTime.Equal(modified) {
+			t.Errorf("tar: wrong entry %v: %q", h.Name, b)
+		}
+		n++
+	}
+	if n != len(files) {
+		t.Errorf("expected %v files in tar, got %v", len(files), n)
+	}
+}
+
+func TestOutputURLExpiry(t *testing.T) {
+	cases := map[string]bool{
+		"":        true,
+		"60":      true,
+		"604800":  true,
+		"604801":  false,
+		"0":       false,
+		"an hour": false,
+	}
+	for expiresIn, ok := range cases {
+		r := httptest.NewRequest("GET", "/runs/x/outputs", nil)
+		q := r.URL.Query()
+		q.Set("expires_in", expiresIn)
+		r.URL.RawQuery = q.Encode()
+		if _, err := outputURLExpiry(r); (err == nil) != ok {
+			t.Errorf("expires_in=%q: expected ok=%v, got %v", expiresIn, ok, err)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package mariner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// this file contains per-user quotas and the admission of runs
+//
+// a user's usage is:
+// - runs: the user's active engine jobs
+// - tasks: the user's active task jobs
+// - cpu and memory: the resources requested by the containers of all the user's active jobs
+// - storage: the total size of the user's objects in s3
+//
+// a run is admitted if it keeps the user within their quota, counting the resources of its engine job -
+// otherwise, per 'over_quota' in the config, it's rejected with 429, or it's queued:
+// the run gets the status 'queued' (WES QUEUED), and the server dispatches it once the user's usage allows,
+// each user's queued runs in the order they were submitted
+//
+// the engine holds back a task job while it would take the user over their task, cpu or memory limit,
+// so those limits also hold while runs are going
+// a task is held back for at most 'max_task_wait' - then it fails, and so does its run,
+// since the user's runs could otherwise wait on each other's tasks forever, each engine job holding on to its share of the quota
+
+const (
+	overQuotaReject = "reject"
+	overQuotaQueue  = "queue"
+
+	// how often the server tries to dispatch queued runs
+	queueInterval = 30 * time.Second
+
+	// how often the engine checks whether a held back task job fits in the user's quota
+	taskQuotaInterval = 30 * time.Second
+	// how long a task job is held back, unless the config says otherwise
+	defaultMaxTaskWait = time.Hour
+
+	queuedRunsPrefix  = "queuedRuns/"
+	pathToQueuedRunf  = queuedRunsPrefix + "%v/%v" // fill with userID, runID - one marker per queued run
+	pathToUserObjectf = "%v/"                      // fill with userID
+)
+
+// QuotaConfig ..
+type QuotaConfig struct {
+	Default   Quota             `json:"default"`
+	Users     map[string]*Quota `json:"users"`      // replaces the default quota for these users
+	OverQuota string            `json:"over_quota"` // "reject" (default) or "queue"
+	// how long a task waits for the user's quota before it fails, e.g., "2h" - 1 hour by default
+	MaxTaskWait string `json:"max_task_wait"`
+}
+
+// Quota - a limit of 0 or "" is no limit
+type Quota struct {
+	MaxRuns    int    `json:"max_runs"`
+	MaxTasks   int    `json:"max_tasks"`
+	MaxCPU     string `json:"max_cpu"`     // k8s quantity, e.g., "16" or "16000m"
+	MaxMemory  string `json:"max_memory"`  // e.g., "64Gi"
+	MaxStorage string `json:"max_storage"` // e.g., "1Ti"
+}
+
+// QuotaUsage is what a user's active runs use, or what a run or task asks for
+type QuotaUsage struct {
+	Runs    int   `json:"runs"`
+	Tasks   int   `json:"tasks"`
+	CPU     int64 `json:"cpu"`     // millicores
+	Memory  int64 `json:"memory"`  // bytes
+	Storage int64 `json:"storage"` // bytes
+}
+
+// queuedRun is the marker of a queued run
+type queuedRun struct {
+	userID string
+	runID  string
+	queued time.Time
+}
+
+// quota returns the user's quota
+func (conf *QuotaConfig) quota(userID string) *Quota {
+	if quota, ok := conf.Users[userID]; ok && quota != nil {
+		return quota
+	}
+	return &conf.Default
+}
+
+// queues is true if runs over quota are queued, rather than rejected
+func (conf *QuotaConfig) queues() bool {
+	return conf.OverQuota == overQuotaQueue
+}
+
+// maxTaskWait returns how long a task waits for the user's quota - validated on startup
+func (conf *QuotaConfig) maxTaskWait() time.Duration {
+	wait, err := time.ParseDuration(conf.MaxTaskWait)
+	if err != nil {
+		return defaultMaxTaskWait
+	}
+	return wait
+}
+
+func (conf *QuotaConfig) validate() error {
+	switch conf.OverQuota {
+	case "", overQuotaReject, overQuotaQueue:
+	default:
+		return fmt.Errorf("invalid over_quota, expected %q or %q: %v", overQuotaReject, overQuotaQueue, conf.OverQuota)
+	}
+	if conf.MaxTaskWait != "" {
+		if wait, err := time.ParseDuration(conf.MaxTaskWait); err != nil || wait <= 0 {
+			return fmt.Errorf("invalid max_task_wait, expected a positive duration like \"2h\": %v", conf.MaxTaskWait)
+		}
+	}
+	if _, err := conf.Default.limits(); err != nil {
+		return fmt.Errorf("invalid default quota: %v", err)
+	}
+	for userID, quota := range conf.Users {
+		if quota == nil {
+			continue
+		}
+		if _, err := quota.limits(); err != nil {
+			return fmt.Errorf("invalid quota of user %v: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+func (quota *Quota) unlimited() bool {
+	return *quota == Quota{}
+}
+
+// limits returns the limits of the quota in the units of QuotaUsage
+func (quota *Quota) limits() (*QuotaUsage, error) {
+	if quota.MaxRuns < 0 || quota.MaxTasks < 0 {
+		return nil, fmt.Errorf("max_runs and max_tasks can't be negative")
+	}
+	limits := &QuotaUsage{Runs: quota.MaxRuns, Tasks: quota.MaxTasks}
+	quantities := []struct {
+		name  string
+		value string
+		limit *int64
+		milli bool
+	}{
+		{"max_cpu", quota.MaxCPU, &limits.CPU, true},
+		{"max_memory", quota.MaxMemory, &limits.Memory, false},
+		{"max_storage", quota.MaxStorage, &limits.Storage, false},
+	}
+	for _, q := range quantities {
+		if q.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil || quantity.Sign() < 0 {
+			return nil, fmt.Errorf("invalid %v: %v", q.name, q.value)
+		}
+		if q.milli {
+			*q.limit = quantity.MilliValue()
+		} else {
+			*q.limit = quantity.Value()
+		}
+	}
+	return limits, nil
+}
+
+// exceeded returns a description of each limit of the quota which the usage plus the request would go over
+func (quota *Quota) exceeded(usage, request *QuotaUsage) ([]string, error) {
+	limits, err := quota.limits()
+	if err != nil {
+		return nil, err
+	}
+	over := []string{}
+	check := func(name string, used, requested, limit int64, format func(int64) string) {
+		if limit > 0 && used+requested > limit {
+			over = append(over, fmt.Sprintf("%v: %v in use, %v requested, limit %v", name, format(used), format(requested), format(limit)))
+		}
+	}
+	count := func(v int64) string { return fmt.Sprint(v) }
+	cpu := func(v int64) string { return resource.NewMilliQuantity(v, resource.DecimalSI).String() }
+	size := func(v int64) string { return resource.NewQuantity(v, resource.BinarySI).String() }
+	check("runs", int64(usage.Runs), int64(request.Runs), int64(limits.Runs), count)
+	check("tasks", int64(usage.Tasks), int64(request.Tasks), int64(limits.Tasks), count)
+	check("cpu", usage.CPU, request.CPU, limits.CPU, cpu)
+	check("memory", usage.Memory, request.Memory, limits.Memory, size)
+	check("storage", usage.Storage, request.Storage, limits.Storage, size)
+	return over, nil
+}
+
+func (usage *QuotaUsage) add(other *QuotaUsage) {
+	usage.Runs += other.Runs
+	usage.Tasks += other.Tasks
+	usage.CPU += other.CPU
+	usage.Memory += other.Memory
+	usage.Storage += other.Storage
+}
+
+// jobRequests returns the cpu (millicores) and memory (bytes) requested by the containers of the job
+func jobRequests(job *batchv1.Job) (cpu, memory int64) {
+	for _, container := range job.Spec.Template.Spec.Containers {
+		cpu += container.Resources.Requests.Cpu().MilliValue()
+		memory += container.Resources.Requests.Memory().Value()
+	}
+	return cpu, memory
+}
+
+// jobsUsage returns the runs, tasks, cpu and memory of the user's active jobs
+func jobsUsage(engines, tasks []batchv1.Job, userID string) *QuotaUsage {
+	usage := &QuotaUsage{}
+	add := func(jobs []batchv1.Job, count *int) {
+		for i := range jobs {
+			if jobFinished(&jobs[i]) || jobOwner(&jobs[i]) != userID {
+				continue
+			}
+			*count++
+			cpu, memory := jobRequests(&jobs[i])
+			usage.CPU += cpu
+			usage.Memory += memory
+		}
+	}
+	add(engines, &usage.Runs)
+	add(tasks, &usage.Tasks)
+	return usage
+}
+
+// engineUsage returns the usage of the run's own engine job, which holds while the run waits for quota -
+// the user's usage can't drop below it
+func engineUsage(engines []batchv1.Job, engineJobName, userID string) *QuotaUsage {
+	for i := range engines {
+		if engines[i].Name == engineJobName {
+			return jobsUsage(engines[i:i+1], nil, userID)
+		}
+	}
+	return &QuotaUsage{}
+}
+
+// runRequest returns what the run asks for when it's dispatched - one run, and the resources of its engine job
+func runRequest(workflowRequest *WorkflowRequest) (*QuotaUsage, error) {
+	job, err := workflowJob(workflowRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workflow job spec: %v", err)
+	}
+	cpu, memory := jobRequests(job)
+	return &QuotaUsage{Runs: 1, CPU: cpu, Memory: memory}, nil
+}
+
+//// admission ////
+
+// admit returns the reasons the run can't be dispatched now - none if it can
+// with queueing, a run also waits behind the user's runs which are already queued
+func (server *Server) admit(workflowRequest *WorkflowRequest) ([]string, error) {
+	quota := Config.Quotas.quota(workflowRequest.UserID)
+	if quota.unlimited() {
+		return nil, nil
+	}
+	if Config.Quotas.queues() {
+		queued, err := server.queuedRuns(workflowRequest.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list queued runs: %v", err)
+		}
+		if len(queued) > 0 {
+			return []string{fmt.Sprintf("%v of the user's runs queued ahead", len(queued))}, nil
+		}
+	}
+	usage, err := server.quotaUsage(workflowRequest.UserID, quota)
+	if err != nil {
+		return nil, err
+	}
+	request, err := runRequest(workflowRequest)
+	if err != nil {
+		return nil, err
+	}
+	return quota.exceeded(usage, request)
+}
+
+// quotaUsage returns the user's usage
+// storage is only counted if the quota limits it, since that means listing the user's objects
+func (server *Server) quotaUsage(userID string, quota *Quota) (*QuotaUsage, error) {
+	engines, tasks, err := marinerJobs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	usage := jobsUsage(engines, tasks, userID)
+	if quota.MaxStorage != "" {
+		if usage.Storage, err = server.storageUsage(userID); err != nil {
+			return nil, fmt.Errorf("failed to measure storage: %v", err)
+		}
+	}
+	return usage, nil
+}
+
+// cancelQueuedRun takes the run off the queue and marks it cancelled - it has no jobs to kill
+func (server *Server) cancelQueuedRun(runLog *MainLog, userID, runID string) error {
+	if err := server.dequeueRun(userID, runID); err != nil {
+		return fmt.Errorf("failed to take run off the queue: %v", err)
+	}
+	notifier := newNotifier(runID, runLog.Request)
+	notifier.watch(runLog.Journal)
+	runLog.Main.Event.info("cancelled while queued")
+	runLog.Main.setStatus(cancelled)
+	return server.writeLog(runLog, userID, runID)
+}
+
+// dispatchQueuedRuns runs in the background of the server, and dispatches queued runs as their users' quotas allow
+func (server *Server) dispatchQueuedRuns() {
+	for {
+		time.Sleep(queueInterval)
+		if err := server.dispatchQueue(); err != nil {
+			fmt.Println("failed to dispatch queued runs: ", err)
+		}
+	}
+}
+
+// dispatchQueue dispatches each user's queued runs, oldest first, until the next one doesn't fit in the user's quota
+func (server *Server) dispatchQueue() error {
+	runs, err := server.queuedRuns("")
+	if err != nil {
+		return err
+	}
+	users := []string{}
+	byUser := make(map[string][]*queuedRun)
+	for _, run := range runs {
+		if _, ok := byUser[run.userID]; !ok {
+			users = append(users, run.userID)
+		}
+		byUser[run.userID] = append(byUser[run.userID], run)
+	}
+	for _, userID := range users {
+		quota := Config.Quotas.quota(userID)
+		usage, err := server.quotaUsage(userID, quota)
+		if err != nil {
+			fmt.Printf("failed to check the quota of user %v: %v\n", userID, err)
+			continue
+		}
+		for _, run := range byUser[userID] {
+			request, err := server.fetchRequest(userID, run.runID)
+			if err != nil {
+				fmt.Printf("failed to fetch request of queued run %v: %v\n", run.runID, err)
+				if isNotFound(err) {
+					// the run has been deleted
+					server.dequeueRun(userID, run.runID)
+					continue
+				}
+				break
+			}
+			runUsage, err := runRequest(request)
+			if err != nil {
+				fmt.Printf("failed to check queued run %v: %v\n", run.runID, err)
+				break
+			}
+			over, err := quota.exceeded(usage, runUsage)
+			if err != nil || len(over) > 0 {
+				break
+			}
+			if err = server.dispatchQueuedRun(request); err != nil {
+				fmt.Printf("failed to dispatch queued run %v: %v\n", run.runID, err)
+				continue
+			}
+			usage.add(runUsage)
+		}
+	}
+	return nil
+}
+
+// dispatchQueuedRun takes the run off the queue and dispatches its engine job
+// the marker is removed first, so that a run which fails to dispatch isn't retried forever
+func (server *Server) dispatchQueuedRun(request *WorkflowRequest) error {
+	userID, runID := request.UserID, request.JobName
+	if err := server.dequeueRun(userID, runID); err != nil {
+		return err
+	}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		return err
+	}
+	if runLog.Main.Status != queued {
+		// cancelled in the meantime
+		return nil
+	}
+	notifier := newNotifier(runID, runLog.Request)
+	notifier.watch(runLog.Journal)
+
+	// the log is written before the engine job is created, since from then on the engine writes it
+	runLog.Main.Event.info("run dequeued")
+	runLog.Main.setStatus(notStarted)
+	if err = server.writeLog(runLog, userID, runID); err != nil {
+		return err
+	}
+	if err = dispatchWorkflowJob(request); err != nil {
+		runLog.Main.Event.errorf("failed to dispatch queued run: %v", err)
+		runLog.Main.setStatus(failed)
+		server.writeLog(runLog, userID, runID)
+		return err
+	}
+	return nil
+}
+
+//// s3 ////
+
+// storageUsage returns the total size of the user's objects
+func (server *Server) storageUsage(userID string) (int64, error) {
+	var size int64
+	err := storage.Walk(server.FileManager, fmt.Sprintf(pathToUserObjectf, userID), func(obj *storage.ObjectInfo) bool {
+		size += obj.Size
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// queueRun writes the marker of a queued run
+func (server *Server) queueRun(userID, runID string) error {
+	return storage.PutBytes(server.FileManager, fmt.Sprintf(pathToQueuedRunf, userID, runID), []byte{})
+}
+
+func (server *Server) dequeueRun(userID, runID string) error {
+	return server.FileManager.Delete(fmt.Sprintf(pathToQueuedRunf, userID, runID))
+}
+
+// queuedRuns returns the user's queued runs - or everyone's, if userID is "" - oldest first
+func (server *Server) queuedRuns(userID string) ([]*queuedRun, error) {
+	prefix := queuedRunsPrefix
+	if userID != "" {
+		prefix += userID + "/"
+	}
+	runs := []*queuedRun{}
+	err := storage.Walk(server.FileManager, prefix, func(obj *storage.ObjectInfo) bool {
+		if owner, runID, ok := sharedRunKey(obj.Key, queuedRunsPrefix); ok {
+			runs = append(runs, &queuedRun{userID: owner, runID: runID, queued: obj.LastModified})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortQueuedRuns(runs)
+	return runs, nil
+}
+
+func sortQueuedRuns(runs []*queuedRun) {
+	sort.SliceStable(runs, func(i, k int) bool {
+		if !runs[i].queued.Equal(runs[k].queued) {
+			return runs[i].queued.Before(runs[k].queued)
+		}
+		return runs[i].runID < runs[k].runID
+	})
+}
+
+//// k8s ////
+
+// taskQuotaLock is held from the engine's quota check of a task job until the job is created,
+// so that the engine's concurrent tasks don't slip past the quota together
+var taskQuotaLock sync.Mutex
+
+// waitForTaskQuota holds back the task's job until it fits in the user's task, cpu and memory limits,
+// for at most the config's max_task_wait
+// the caller holds taskQuotaLock - it's released while the task waits, see waitForQuota
+func (engine *K8sEngine) waitForTaskQuota(tool *Tool, job *batchv1.Job) error {
+	quota := Config.Quotas.quota(engine.UserID)
+	// runs and storage are checked when the run is admitted
+	taskQuota := &Quota{MaxTasks: quota.MaxTasks, MaxCPU: quota.MaxCPU, MaxMemory: quota.MaxMemory}
+	if taskQuota.unlimited() {
+		return nil
+	}
+	cpu, memory := jobRequests(job)
+	request := &QuotaUsage{Tasks: 1, CPU: cpu, Memory: memory}
+	check := func() ([]string, error) {
+		engines, tasks, err := marinerJobs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list jobs: %v", err)
+		}
+		// waiting is no use if the task doesn't fit alongside the run's own engine job
+		over, err := taskQuota.exceeded(engineUsage(engines, engine.Log.Request.JobName, engine.UserID), request)
+		if err != nil {
+			return nil, err
+		}
+		if len(over) > 0 {
+			return nil, fmt.Errorf("task asks for more than the user's quota - %v", strings.Join(over, "; "))
+		}
+		return taskQuota.exceeded(jobsUsage(engines, tasks, engine.UserID), request)
+	}
+	onWait := func(over []string) {
+		tool.Task.infof("waiting for the user's quota - %v", strings.Join(over, "; "))
+	}
+	waited, err := waitForQuota(&taskQuotaLock, taskQuotaInterval, Config.Quotas.maxTaskWait(), check, onWait)
+	if err == nil && waited {
+		tool.Task.infof("task fits in the user's quota")
+	}
+	return err
+}
+
+// waitForQuota calls check every interval until nothing is over quota, for at most maxWait
+// onWait is called with what's over quota when the wait starts
+// the caller holds lock, which is released while sleeping so that the user's other tasks can be checked meanwhile -
+// it's held again when waitForQuota returns
+func waitForQuota(lock sync.Locker, interval, maxWait time.Duration, check func() ([]string, error), onWait func(over []string)) (waited bool, err error) {
+	start := time.Now()
+	for {
+		over, err := check()
+		if err != nil {
+			return waited, err
+		}
+		if len(over) == 0 {
+			return waited, nil
+		}
+		if time.Since(start) >= maxWait {
+			return waited, fmt.Errorf("task waited %v for the user's quota - %v", maxWait, strings.Join(over, "; "))
+		}
+		if !waited {
+			onWait(over)
+			waited = true
+		}
+		lock.Unlock()
+		time.Sleep(interval)
+		lock.Lock()
+	}
+}
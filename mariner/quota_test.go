@@ -0,0 +1,226 @@
+package mariner
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uc-cdis/mariner/storage"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func withRequests(job batchv1.Job, cpu, memory string) batchv1.Job {
+	job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, k8sv1.Container{
+		Resources: k8sv1.ResourceRequirements{
+			Requests: k8sv1.ResourceList{
+				k8sv1.ResourceCPU:    resource.MustParse(cpu),
+				k8sv1.ResourceMemory: resource.MustParse(memory),
+			},
+		},
+	})
+	return job
+}
+
+func TestQuotaConfig(t *testing.T) {
+	conf := &QuotaConfig{
+		Default: Quota{MaxRuns: 2},
+		Users:   map[string]*Quota{"alice": {MaxRuns: 10}},
+	}
+	if conf.quota("alice").MaxRuns != 10 || conf.quota("bob").MaxRuns != 2 {
+		t.Errorf("wrong quotas: %+v %+v", conf.quota("alice"), conf.quota("bob"))
+	}
+	if err := conf.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	invalid := []*QuotaConfig{
+		{OverQuota: "wait"},
+		{Default: Quota{MaxCPU: "lots"}},
+		{Default: Quota{MaxTasks: -1}},
+		{Users: map[string]*Quota{"alice": {MaxMemory: "-1Gi"}}},
+		{MaxTaskWait: "an hour"},
+		{MaxTaskWait: "-1h"},
+	}
+	for _, conf := range invalid {
+		if err := conf.validate(); err == nil {
+			t.Errorf("expected an error for %+v", conf)
+		}
+	}
+}
+
+func TestMaxTaskWait(t *testing.T) {
+	if wait := (&QuotaConfig{}).maxTaskWait(); wait != defaultMaxTaskWait {
+		t.Errorf("expected the default wait, got %v", wait)
+	}
+	if wait := (&QuotaConfig{MaxTaskWait: "2h"}).maxTaskWait(); wait != 2*time.Hour {
+		t.Errorf("expected a 2h wait, got %v", wait)
+	}
+}
+
+func TestWaitForQuota(t *testing.T) {
+	var lock sync.Mutex
+	overQuota := []string{"tasks: 2 in use, 1 requested, limit 2"}
+
+	// the lock is released while waiting, so another task can take it
+	lock.Lock()
+	calls, acquired := 0, make(chan struct{})
+	check := func() ([]string, error) {
+		calls++
+		switch calls {
+		case 1:
+			go func() {
+				lock.Lock()
+				lock.Unlock()
+				close(acquired)
+			}()
+			return overQuota, nil
+		case 2:
+			select {
+			case <-acquired:
+			case <-time.After(time.Second):
+				t.Error("the lock wasn't released while waiting")
+			}
+		}
+		return nil, nil
+	}
+	waits := 0
+	waited, err := waitForQuota(&lock, 10*time.Millisecond, time.Minute, check, func([]string) { waits++ })
+	lock.Unlock()
+	if err != nil || !waited || waits != 1 || calls != 2 {
+		t.Errorf("expected one wait, got %v, %v, %v waits, %v checks", waited, err, waits, calls)
+	}
+
+	// the wait is given up after maxWait
+	lock.Lock()
+	start := time.Now()
+	_, err = waitForQuota(&lock, 10*time.Millisecond, 50*time.Millisecond, func() ([]string, error) { return overQuota, nil }, func([]string) {})
+	lock.Unlock()
+	if err == nil || !strings.Contains(err.Error(), "tasks: 2 in use") || time.Since(start) > time.Second {
+		t.Errorf("expected the wait to fail after 50ms, got %v after %v", err, time.Since(start))
+	}
+
+	// errors are returned as they are, without waiting
+	lock.Lock()
+	waited, err = waitForQuota(&lock, time.Hour, time.Hour, func() ([]string, error) { return nil, fmt.Errorf("no jobs") }, func([]string) {})
+	lock.Unlock()
+	if err == nil || waited {
+		t.Errorf("expected the error of the check without waiting, got %v, %v", waited, err)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	quota := &Quota{MaxRuns: 2, MaxTasks: 4, MaxCPU: "4", MaxMemory: "8Gi", MaxStorage: "1Gi"}
+	usage := &QuotaUsage{Runs: 1, Tasks: 4, CPU: 3500, Memory: 4 << 30, Storage: 1 << 30}
+
+	over, err := quota.exceeded(usage, &QuotaUsage{Runs: 1, CPU: 500, Memory: 1 << 30})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(over) != 0 {
+		t.Errorf("expected the run to fit, got %v", over)
+	}
+
+	over, _ = quota.exceeded(usage, &QuotaUsage{Runs: 1, Tasks: 1, CPU: 1000, Memory: 1 << 30, Storage: 1})
+	if len(over) != 3 {
+		t.Fatalf("expected tasks, cpu and storage to be exceeded, got %v", over)
+	}
+	for i, prefix := range []string{"tasks:", "cpu:", "storage:"} {
+		if !strings.HasPrefix(over[i], prefix) {
+			t.Errorf("expected %v, got %v", prefix, over[i])
+		}
+	}
+	if over[1] != "cpu: 3500m in use, 1 requested, limit 4" {
+		t.Errorf("wrong description: %v", over[1])
+	}
+
+	unlimited := &Quota{}
+	if !unlimited.unlimited() || quota.unlimited() {
+		t.Errorf("wrong unlimited")
+	}
+	if over, _ = unlimited.exceeded(usage, usage); len(over) != 0 {
+		t.Errorf("expected no limits, got %v", over)
+	}
+}
+
+func TestJobsUsage(t *testing.T) {
+	now := time.Now()
+	engines := []batchv1.Job{
+		withRequests(testJob("run-a", "alice", "", now, 0, 0), "500m", "1Gi"),
+		withRequests(testJob("run-b", "alice", "", now, 1, 0), "500m", "1Gi"),
+		withRequests(testJob("run-c", "bob", "", now, 0, 0), "500m", "1Gi"),
+	}
+	tasks := []batchv1.Job{
+		withRequests(withRequests(testJob("task-1", "alice", "run-a", now, 0, 0), "2", "4Gi"), "100m", "128Mi"),
+		withRequests(testJob("task-2", "alice", "run-a", now, 0, 1), "2", "4Gi"),
+	}
+	usage := jobsUsage(engines, tasks, "alice")
+	expected := QuotaUsage{Runs: 1, Tasks: 1, CPU: 2600, Memory: (5 << 30) + (128 << 20)}
+	if *usage != expected {
+		t.Errorf("expected %+v, got %+v", expected, *usage)
+	}
+}
+
+func TestEngineUsage(t *testing.T) {
+	now := time.Now()
+	engines := []batchv1.Job{
+		withRequests(testJob("run-a", "alice", "", now, 0, 0), "500m", "1Gi"),
+		withRequests(testJob("run-b", "alice", "", now, 0, 0), "1", "2Gi"),
+	}
+	expected := QuotaUsage{Runs: 1, CPU: 500, Memory: 1 << 30}
+	if usage := engineUsage(engines, "run-a", "alice"); *usage != expected {
+		t.Errorf("expected %+v, got %+v", expected, *usage)
+	}
+	if usage := engineUsage(engines, "run-gone", "alice"); *usage != (QuotaUsage{}) {
+		t.Errorf("expected no usage, got %+v", *usage)
+	}
+
+	// a task which fits in the quota by itself, but not alongside its engine, can never be dispatched
+	quota := &Quota{MaxCPU: "2"}
+	request := &QuotaUsage{Tasks: 1, CPU: 1800}
+	if over, _ := quota.exceeded(&QuotaUsage{}, request); len(over) > 0 {
+		t.Errorf("expected the task to fit by itself, got %v", over)
+	}
+	if over, _ := quota.exceeded(engineUsage(engines, "run-a", "alice"), request); len(over) == 0 {
+		t.Error("expected the task not to fit alongside its engine")
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := map[string]string{
+		// request.json is written with a leading "/" - it's the same prefix
+		fmt.Sprintf("/%s/workflowRuns/%s/%s", "alice", "run-1", requestFile): "1234",
+		fmt.Sprintf(pathToUserRunLogf, "alice", "run-1"):                     "123456",
+		fmt.Sprintf(pathToUserRunLogf, "bob", "run-2"):                       "123456789",
+	}
+	for key, content := range objects {
+		if err = storage.PutBytes(local, key, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := server().withFileManager(&FileManager{Storage: local})
+	if size, err := server.storageUsage("alice"); err != nil || size != 10 {
+		t.Errorf("expected 10 bytes, got %v (%v)", size, err)
+	}
+}
+
+func TestSortQueuedRuns(t *testing.T) {
+	now := time.Now()
+	runs := []*queuedRun{
+		{userID: "alice", runID: "c", queued: now.Add(time.Minute)},
+		{userID: "alice", runID: "b", queued: now},
+		{userID: "bob", runID: "a", queued: now},
+	}
+	sortQueuedRuns(runs)
+	if runs[0].runID != "a" || runs[1].runID != "b" || runs[2].runID != "c" {
+		t.Errorf("wrong order: %v %v %v", runs[0].runID, runs[1].runID, runs[2].runID)
+	}
+}
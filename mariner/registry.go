@@ -0,0 +1,313 @@
+package mariner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+	"github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the workflow registry
+//
+// the registry stores named, versioned, packed workflows, shared by all users:
+// - POST /workflows                           registers a version of a workflow
+// - GET  /workflows                           lists the workflows and their versions
+// - GET  /workflows/{name}/versions/{version} returns one version, with the packed workflow
+//
+// a version can't be changed once it's registered
+// each version is identified by the hash of its packed workflow - "sha256:<hex>" of its canonical JSON
+//
+// a WorkflowRequest may reference a registered workflow instead of embedding it:
+// "workflowRef": {"name": "align", "version": "1.2.0"}  or  "workflowRef": {"hash": "sha256:..."}
+// the server fills in the workflow, and the name, version and hash are recorded in the run's request
+//
+// s3 layout, in the server's bucket:
+// workflowRegistry/workflows/{name}/{version}.json - the RegisteredWorkflow, without the workflow
+// workflowRegistry/objects/{hex}.json              - the packed workflow, by hash
+
+const (
+	pathToRegistryWorkflowsf = "workflowRegistry/workflows/"
+	pathToRegistryVersionf   = pathToRegistryWorkflowsf + "%v/%v.json" // fill with name, version
+	pathToRegistryObjectf    = "workflowRegistry/objects/%v.json"      // fill with hex hash
+
+	workflowHashPrefix = "sha256:"
+)
+
+var (
+	registryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	workflowHashPattern = regexp.MustCompile(`^` + workflowHashPrefix + `[0-9a-f]{64}$`)
+)
+
+var errWorkflowNotFound = errors.New("no such workflow")
+
+// errInvalidWorkflowRef marks the errors of resolveWorkflowRef which are the client's fault
+var errInvalidWorkflowRef = errors.New("invalid workflowRef")
+
+// RegisteredWorkflow ..
+type RegisteredWorkflow struct {
+	Name        string          `json:"name"`
+	Version     string          `json:"version"`
+	Description string          `json:"description,omitempty"`
+	Hash        string          `json:"hash"`
+	Created     string          `json:"created"`
+	CreatedBy   string          `json:"createdBy"`
+	Workflow    json.RawMessage `json:"workflow,omitempty"` // the packed workflow - not stored with the version, see above
+}
+
+// WorkflowRef references a registered workflow, by name and version, or by hash
+type WorkflowRef struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+}
+
+// WorkflowVersionsJSON ..
+type WorkflowVersionsJSON struct {
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`
+}
+
+// WorkflowListJSON ..
+type WorkflowListJSON struct {
+	Workflows []*WorkflowVersionsJSON `json:"workflows"`
+}
+
+// workflowHash returns the hash of the packed workflow's canonical JSON -
+// the same for any formatting or key order of the same workflow
+func workflowHash(workflow json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(workflow, &v); err != nil {
+		return "", err
+	}
+	// encoding/json writes map keys in sorted order
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return workflowHashPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+func (ref *WorkflowRef) validate() error {
+	switch {
+	case ref.Hash != "" && (ref.Name != "" || ref.Version != ""):
+		return fmt.Errorf("give either a name and version, or a hash")
+	case ref.Hash != "":
+		if !workflowHashPattern.MatchString(ref.Hash) {
+			return fmt.Errorf("hash must be %v followed by 64 lowercase hex digits", workflowHashPrefix)
+		}
+	case ref.Name == "" || ref.Version == "":
+		return fmt.Errorf("name and version are required")
+	}
+	return nil
+}
+
+// versionKeys returns the workflows listed by the keys of their versions, sorted by name and version
+func versionKeys(keys []string) []*WorkflowVersionsJSON {
+	byName := make(map[string][]string)
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, pathToRegistryWorkflowsf), "/")
+		if len(parts) != 2 || !strings.HasSuffix(parts[1], ".json") {
+			continue
+		}
+		byName[parts[0]] = append(byName[parts[0]], strings.TrimSuffix(parts[1], ".json"))
+	}
+	workflows := []*WorkflowVersionsJSON{}
+	for name, versions := range byName {
+		sort.Strings(versions)
+		workflows = append(workflows, &WorkflowVersionsJSON{Name: name, Versions: versions})
+	}
+	sort.Slice(workflows, func(i, k int) bool {
+		return workflows[i].Name < workflows[k].Name
+	})
+	return workflows
+}
+
+//// handlers ////
+
+// '/workflows' - POST
+func (server *Server) handleWorkflowsPOST(w http.ResponseWriter, r *http.Request) {
+	wf := &RegisteredWorkflow{}
+	if err := unmarshalBody(r, wf); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return
+	}
+	if !registryNamePattern.MatchString(wf.Name) || !registryNamePattern.MatchString(wf.Version) {
+		err := fmt.Errorf("name and version are required, and may only contain letters, digits, '.', '_' and '-'")
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return
+	}
+	if valid, grievances := wflib.ValidateJSON([]byte(wf.Workflow), nil); !valid {
+		writeError(w, http.StatusBadRequest, errCodeInvalidWorkflow, "invalid workflow", &RequestGrievances{
+			Workflow: grievances,
+		})
+		return
+	}
+	hash, err := workflowHash(wf.Workflow)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidWorkflow, fmt.Sprintf("failed to hash workflow: %v", err), nil)
+		return
+	}
+
+	existing, err := server.fetchRegisteredWorkflow(wf.Name, wf.Version)
+	switch {
+	case err == nil && existing.Hash == hash:
+		// registering the same version again is a no-op
+		writeJSON(w, existing)
+		return
+	case err == nil:
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("version %v of workflow %v is already registered, with hash %v", wf.Version, wf.Name, existing.Hash), nil)
+		return
+	case !errors.Is(err, errWorkflowNotFound):
+		writeStorageError(w, fmt.Errorf("failed to check registry: %w", err))
+		return
+	}
+
+	wf.Hash, wf.Created, wf.CreatedBy = hash, time.Now().UTC().Format(time.RFC3339), server.userID(r)
+	if err = server.storeRegisteredWorkflow(wf); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to store workflow: %v", err), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	wf.Workflow = nil
+	writeJSON(w, wf)
+}
+
+// '/workflows' - GET
+func (server *Server) handleWorkflowsGET(w http.ResponseWriter, r *http.Request) {
+	keys := []string{}
+	err := storage.Walk(server.FileManager, pathToRegistryWorkflowsf, func(obj *storage.ObjectInfo) bool {
+		keys = append(keys, obj.Key)
+		return true
+	})
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to list workflows: %w", err))
+		return
+	}
+	writeJSON(w, &WorkflowListJSON{Workflows: versionKeys(keys)})
+}
+
+// '/workflows/{name}/versions/{version}' - GET
+func (server *Server) handleWorkflowVersionGET(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	wf, err := server.fetchRegisteredWorkflow(vars["name"], vars["version"])
+	if err != nil {
+		if errors.Is(err, errWorkflowNotFound) {
+			writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no such workflow version: %v %v", vars["name"], vars["version"]), nil)
+			return
+		}
+		writeStorageError(w, err)
+		return
+	}
+	if wf.Workflow, err = server.fetchWorkflowObject(wf.Hash); err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch workflow: %w", err))
+		return
+	}
+	writeJSON(w, wf)
+}
+
+//// runs ////
+
+// resolveWorkflowRef fills in the workflow of a request which references a registered workflow
+// the reference is completed with the hash of what's going to run
+// errors caused by the reference itself wrap errInvalidWorkflowRef
+func (server *Server) resolveWorkflowRef(request *WorkflowRequest) error {
+	ref := request.WorkflowRef
+	if ref == nil {
+		return nil
+	}
+	if err := ref.validate(); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidWorkflowRef, err)
+	}
+	if len(request.Workflow) > 0 {
+		// a stored request, e.g., one being rerun, carries the workflow it resolved to
+		if hash, err := workflowHash(request.Workflow); err == nil && hash == ref.Hash {
+			return nil
+		}
+		return fmt.Errorf("%w: give either a workflow or a workflowRef, not both", errInvalidWorkflowRef)
+	}
+	if ref.Hash == "" {
+		wf, err := server.fetchRegisteredWorkflow(ref.Name, ref.Version)
+		if err != nil {
+			return workflowRefError(fmt.Sprintf("%v %v", ref.Name, ref.Version), err)
+		}
+		ref.Hash = wf.Hash
+	}
+	workflow, err := server.fetchWorkflowObject(ref.Hash)
+	if err != nil {
+		return workflowRefError(ref.Hash, err)
+	}
+	request.Workflow = workflow
+	return nil
+}
+
+func workflowRefError(ref string, err error) error {
+	if errors.Is(err, errWorkflowNotFound) {
+		return fmt.Errorf("%w: no such workflow: %v", errInvalidWorkflowRef, ref)
+	}
+	return fmt.Errorf("failed to fetch workflow %v from the registry: %v", ref, err)
+}
+
+//// s3 ////
+
+func (server *Server) fetchRegisteredWorkflow(name, version string) (*RegisteredWorkflow, error) {
+	wf := &RegisteredWorkflow{}
+	if err := server.fetchRegistryObject(fmt.Sprintf(pathToRegistryVersionf, name, version), wf); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (server *Server) fetchWorkflowObject(hash string) (json.RawMessage, error) {
+	var workflow json.RawMessage
+	key := fmt.Sprintf(pathToRegistryObjectf, strings.TrimPrefix(hash, workflowHashPrefix))
+	if err := server.fetchRegistryObject(key, &workflow); err != nil {
+		return nil, err
+	}
+	return workflow, nil
+}
+
+// fetchRegistryObject returns errWorkflowNotFound if there's no such object
+func (server *Server) fetchRegistryObject(key string, v interface{}) error {
+	body, _, err := server.FileManager.Get(key)
+	if err != nil {
+		if isNotFound(err) {
+			return errWorkflowNotFound
+		}
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// storeRegisteredWorkflow writes the workflow object first, so that a version never references a missing workflow
+func (server *Server) storeRegisteredWorkflow(wf *RegisteredWorkflow) error {
+	put := func(key string, b []byte) error {
+		return storage.PutBytes(server.FileManager, key, b)
+	}
+	if err := put(fmt.Sprintf(pathToRegistryObjectf, strings.TrimPrefix(wf.Hash, workflowHashPrefix)), wf.Workflow); err != nil {
+		return err
+	}
+	version := *wf
+	version.Workflow = nil
+	b, err := json.Marshal(&version)
+	if err != nil {
+		return err
+	}
+	return put(fmt.Sprintf(pathToRegistryVersionf, wf.Name, wf.Version), b)
+}
@@ -0,0 +1,80 @@
+package mariner
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWorkflowHash(t *testing.T) {
+	a, err := workflowHash(json.RawMessage(`{"cwlVersion": "v1.0", "$graph": [{"id": "#main", "class": "Workflow"}]}`))
+	if err != nil {
+		t.Fatalf("failed to hash workflow: %v", err)
+	}
+	// same workflow, different key order and formatting
+	b, err := workflowHash(json.RawMessage("{\n  \"$graph\": [{\"class\": \"Workflow\", \"id\": \"#main\"}],\n  \"cwlVersion\": \"v1.0\"\n}"))
+	if err != nil {
+		t.Fatalf("failed to hash workflow: %v", err)
+	}
+	if a != b {
+		t.Errorf("hashes of the same workflow differ: %v, %v", a, b)
+	}
+	if !workflowHashPattern.MatchString(a) {
+		t.Errorf("malformed hash: %v", a)
+	}
+	c, err := workflowHash(json.RawMessage(`{"cwlVersion": "v1.1", "$graph": [{"id": "#main", "class": "Workflow"}]}`))
+	if err != nil {
+		t.Fatalf("failed to hash workflow: %v", err)
+	}
+	if a == c {
+		t.Errorf("different workflows have the same hash: %v", a)
+	}
+	if _, err = workflowHash(json.RawMessage(`{"cwlVersion"`)); err == nil {
+		t.Error("expected an error hashing invalid JSON")
+	}
+}
+
+func TestVersionKeys(t *testing.T) {
+	keys := []string{
+		pathToRegistryWorkflowsf + "variant-calling/2.0.0.json",
+		pathToRegistryWorkflowsf + "align/1.1.0.json",
+		pathToRegistryWorkflowsf + "align/1.0.0.json",
+		pathToRegistryWorkflowsf + "align/nested/1.0.0.json",
+		pathToRegistryWorkflowsf + "align/notes.txt",
+	}
+	workflows := versionKeys(keys)
+	if len(workflows) != 2 {
+		t.Fatalf("expected 2 workflows, got %v", len(workflows))
+	}
+	if workflows[0].Name != "align" || !equalStrings(workflows[0].Versions, []string{"1.0.0", "1.1.0"}) {
+		t.Errorf("wrong workflow: %+v", workflows[0])
+	}
+	if workflows[1].Name != "variant-calling" || !equalStrings(workflows[1].Versions, []string{"2.0.0"}) {
+		t.Errorf("wrong workflow: %+v", workflows[1])
+	}
+	if len(versionKeys(nil)) != 0 {
+		t.Error("expected no workflows")
+	}
+}
+
+func TestWorkflowRefValidate(t *testing.T) {
+	hash := workflowHashPrefix + strings.Repeat("ab", 32)
+	cases := []struct {
+		ref   WorkflowRef
+		valid bool
+	}{
+		{WorkflowRef{Name: "align", Version: "1.0.0"}, true},
+		{WorkflowRef{Hash: hash}, true},
+		{WorkflowRef{Name: "align"}, false},
+		{WorkflowRef{Version: "1.0.0"}, false},
+		{WorkflowRef{}, false},
+		{WorkflowRef{Name: "align", Version: "1.0.0", Hash: hash}, false},
+		{WorkflowRef{Hash: "md5:abc"}, false},
+		{WorkflowRef{Hash: workflowHashPrefix + "../../secrets"}, false},
+	}
+	for _, c := range cases {
+		if err := c.ref.validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got error %v", c.ref, c.valid, err)
+		}
+	}
+}
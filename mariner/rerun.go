@@ -0,0 +1,130 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the rerun endpoint
+//
+// POST /runs/{runID}/rerun submits the stored request of a run (request.json) as a new run
+// the body is optional, and may override parts of the request:
+//
+// {
+//     "input": {"reads": {"class": "File", "location": "USER/fixed.fastq"}},
+//     "tags": {"attempt": "2"},
+//     "serviceAccountName": "other-account"
+// }
+//
+// - input: replaces the given input parameters, the others keep their original values
+// - tags: replaces the given tags, the others are kept
+// - serviceAccountName: replaces the service account
+//
+// the new run's log links it to the original through its 'parentRunID'
+
+// RerunRequest ..
+type RerunRequest struct {
+	Input              map[string]json.RawMessage `json:"input,omitempty"`
+	Tags               map[string]string          `json:"tags,omitempty"`
+	ServiceAccountName *string                    `json:"serviceAccountName,omitempty"`
+}
+
+// RerunJSON ..
+type RerunJSON struct {
+	RunID       string `json:"runID"`
+	ParentRunID string `json:"parentRunID"`
+}
+
+// rerunRequest returns a copy of the original request, with the overrides applied
+func rerunRequest(original *WorkflowRequest, overrides *RerunRequest) (*WorkflowRequest, error) {
+	request := *original
+	request.JobName = ""
+
+	if len(overrides.Input) > 0 {
+		input := make(map[string]json.RawMessage)
+		if len(original.Input) > 0 {
+			if err := json.Unmarshal(original.Input, &input); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal input of the original run: %v", err)
+			}
+		}
+		for id, val := range overrides.Input {
+			input[id] = val
+		}
+		b, err := json.Marshal(input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal input: %v", err)
+		}
+		request.Input = b
+	}
+
+	if len(overrides.Tags) > 0 {
+		request.Tags = make(map[string]string)
+		for k, v := range original.Tags {
+			request.Tags[k] = v
+		}
+		for k, v := range overrides.Tags {
+			request.Tags[k] = v
+		}
+	}
+
+	if overrides.ServiceAccountName != nil {
+		request.ServiceAccountName = *overrides.ServiceAccountName
+	}
+	return &request, nil
+}
+
+// fetchRequest returns the stored workflow request of a run
+func (server *Server) fetchRequest(userID, runID string) (*WorkflowRequest, error) {
+	body, _, err := server.FileManager.Get(fmt.Sprintf("/%s/workflowRuns/%s/%s", userID, runID, requestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	request := &WorkflowRequest{}
+	if err = json.NewDecoder(body).Decode(request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal workflow request: %v", err)
+	}
+	return request, nil
+}
+
+//// handlers ////
+
+// '/runs/{runID}/rerun' - POST
+func (server *Server) handleRerunPOST(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	overrides := &RerunRequest{}
+	b, err := body(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), nil)
+		return
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, overrides); err != nil {
+			err = fmt.Errorf("failed to unmarshal request body: %v", err)
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+				Request: wflib.Grievances{err.Error()},
+			})
+			return
+		}
+	}
+
+	original, err := server.fetchRequest(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch request of run %v: %w", runID, err))
+		return
+	}
+	request, err := rerunRequest(original, overrides)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
+		return
+	}
+
+	newRunID, ok := server.submitRun(w, r, request, runID)
+	if !ok {
+		return
+	}
+	writeJSON(w, &RerunJSON{RunID: newRunID, ParentRunID: runID})
+}
@@ -0,0 +1,54 @@
+package mariner
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRerunRequest(t *testing.T) {
+	original := &WorkflowRequest{
+		Input:              json.RawMessage(`{"reads": "a.fastq", "threads": 4}`),
+		Tags:               map[string]string{"project": "x", "attempt": "1"},
+		ServiceAccountName: "default",
+		JobName:            "old-run",
+		UserID:             "alice",
+	}
+	account := "other"
+	overrides := &RerunRequest{
+		Input:              map[string]json.RawMessage{"reads": json.RawMessage(`"fixed.fastq"`)},
+		Tags:               map[string]string{"attempt": "2"},
+		ServiceAccountName: &account,
+	}
+	request, err := rerunRequest(original, overrides)
+	if err != nil {
+		t.Fatalf("failed to make rerun request: %v", err)
+	}
+
+	input := map[string]interface{}{}
+	if err = json.Unmarshal(request.Input, &input); err != nil {
+		t.Fatalf("failed to unmarshal input: %v", err)
+	}
+	if input["reads"] != "fixed.fastq" || input["threads"] != float64(4) {
+		t.Errorf("wrong input: %v", input)
+	}
+	if request.Tags["project"] != "x" || request.Tags["attempt"] != "2" {
+		t.Errorf("wrong tags: %v", request.Tags)
+	}
+	if request.ServiceAccountName != "other" || request.JobName != "" {
+		t.Errorf("wrong request: %+v", request)
+	}
+
+	// the original is left as it was
+	if original.Tags["attempt"] != "1" || string(original.Input) != `{"reads": "a.fastq", "threads": 4}` {
+		t.Errorf("original request modified: %+v", original)
+	}
+
+	// no overrides - same request
+	request, err = rerunRequest(original, &RerunRequest{})
+	if err != nil {
+		t.Fatalf("failed to make rerun request: %v", err)
+	}
+	if string(request.Input) != string(original.Input) || request.ServiceAccountName != "default" || len(request.Tags) != 2 {
+		t.Errorf("wrong request without overrides: %+v", request)
+	}
+}
@@ -0,0 +1,321 @@
+package mariner
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the run history listing behind the '/runs' GET endpoints
+//
+// query parameters, all optional:
+// - state:         comma-separated list of mariner statuses or WES states, e.g., "running,failed" or "COMPLETE"
+// - tag:           "key:value", may be repeated - a run must have every listed tag
+// - since, until:  creation time bounds, RFC 3339 or YYYY-MM-DD
+// - workflow_name: case-insensitive substring of the '#main' label of the workflow
+// - sort:          "desc" (newest first, the default) or "asc"
+// - page_size:     number of runs per page, default 50, max 1000
+// - page_token:    the 'nextPageToken' of the previous page
+//
+// the page token is a cursor (creation time + run ID of the last run on the page),
+// so paging is stable while new runs are being submitted
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+
+	// max number of run logs fetched from s3 at once
+	maxConcurrentLogFetches = 16
+
+	sortAsc  = "asc"
+	sortDesc = "desc"
+)
+
+// RunSummary is the listing entry for one run
+type RunSummary struct {
+	UserID       string            `json:"userID,omitempty"`
+	RunID        string            `json:"runID"`
+	Status       string            `json:"status"`
+	Created      string            `json:"created,omitempty"`
+	LastUpdated  string            `json:"lastUpdated,omitempty"`
+	WorkflowName string            `json:"workflowName,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	createdObj   time.Time
+}
+
+// RunFilter holds the listing parameters of a '/runs' GET request
+type RunFilter struct {
+	States       map[string]bool
+	Tags         map[string]string
+	Since        time.Time
+	Until        time.Time
+	WorkflowName string
+	Sort         string
+	PageSize     int
+	PageToken    string
+	Scope        string // the caller's own runs, or the runs shared with the caller - see share.go
+}
+
+// maps WES states back to mariner statuses
+var marinerStatus = map[string][]string{
+	wesQueued:        {notStarted, queued},
+	wesRunning:       {running},
+	wesComplete:      {completed},
+	wesExecutorError: {failed},
+	wesCanceled:      {cancelled},
+	wesUnknown:       {unknown},
+}
+
+// runFilter reads the listing parameters from the request query
+func runFilter(r *http.Request) (*RunFilter, error) {
+	q := r.URL.Query()
+	f := &RunFilter{
+		States:       make(map[string]bool),
+		Tags:         make(map[string]string),
+		WorkflowName: strings.ToLower(q.Get("workflow_name")),
+		Sort:         sortDesc,
+		PageSize:     defaultPageSize,
+		PageToken:    q.Get("page_token"),
+		Scope:        runScopeOwn,
+	}
+	for _, states := range q["state"] {
+		for _, state := range strings.Split(states, ",") {
+			if state = strings.TrimSpace(state); state == "" {
+				continue
+			}
+			if statuses, ok := marinerStatus[strings.ToUpper(state)]; ok {
+				for _, status := range statuses {
+					f.States[status] = true
+				}
+				continue
+			}
+			f.States[strings.ToLower(state)] = true
+		}
+	}
+	for _, tag := range q["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag filter, expected 'key:value': %v", tag)
+		}
+		f.Tags[kv[0]] = kv[1]
+	}
+	var err error
+	if f.Since, err = filterTime(q.Get("since"), false); err != nil {
+		return nil, fmt.Errorf("invalid since: %v", err)
+	}
+	if f.Until, err = filterTime(q.Get("until"), true); err != nil {
+		return nil, fmt.Errorf("invalid until: %v", err)
+	}
+	if s := q.Get("sort"); s != "" {
+		if s != sortAsc && s != sortDesc {
+			return nil, fmt.Errorf("invalid sort, expected 'asc' or 'desc': %v", s)
+		}
+		f.Sort = s
+	}
+	if s := q.Get("page_size"); s != "" {
+		if f.PageSize, err = strconv.Atoi(s); err != nil || f.PageSize < 1 {
+			return nil, fmt.Errorf("invalid page_size: %v", s)
+		}
+		if f.PageSize > maxPageSize {
+			f.PageSize = maxPageSize
+		}
+	}
+	if s := q.Get("scope"); s != "" {
+		if s != runScopeOwn && s != runScopeShared {
+			return nil, fmt.Errorf("invalid scope, expected '%v' or '%v': %v", runScopeOwn, runScopeShared, s)
+		}
+		f.Scope = s
+	}
+	if f.PageToken != "" {
+		if _, _, err = decodePageToken(f.PageToken); err != nil {
+			return nil, fmt.Errorf("invalid page_token: %v", f.PageToken)
+		}
+	}
+	return f, nil
+}
+
+// a bare date for 'until' means the end of that day
+func filterTime(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 or YYYY-MM-DD: %v", s)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// runSummaries returns a summary of every run in the user's history
+// from the run index if there is one, otherwise from the run logs in s3
+func (server *Server) runSummaries(userID string) ([]*RunSummary, error) {
+	if server.runIndex != nil {
+		return server.indexedRuns(userID)
+	}
+	return server.scanRunSummaries(userID)
+}
+
+// scanRunSummaries reads the log of every run in the user's history from s3
+// runs whose log can't be read are listed with status 'unknown'
+func (server *Server) scanRunSummaries(userID string) ([]*RunSummary, error) {
+	runIDs, err := server.listRuns(userID)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*RunSummary, len(runIDs))
+	sem := make(chan struct{}, maxConcurrentLogFetches)
+	var wg sync.WaitGroup
+	for i, runID := range runIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, runID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			runLog, err := server.fetchMainLog(userID, runID)
+			if err != nil {
+				summaries[i] = &RunSummary{UserID: userID, RunID: runID, Status: unknown}
+				return
+			}
+			summaries[i] = runSummary(runID, runLog)
+			summaries[i].UserID = userID
+		}(i, runID)
+	}
+	wg.Wait()
+	return summaries, nil
+}
+
+func runSummary(runID string, runLog *MainLog) *RunSummary {
+	s := &RunSummary{RunID: runID, Status: unknown}
+	if runLog.Main != nil {
+		s.Status = runLog.Main.Status
+		s.Created = runLog.Main.Created
+		s.LastUpdated = runLog.Main.LastUpdated
+		s.createdObj, _ = parseTimef(runLog.Main.Created)
+	}
+	if runLog.Request != nil {
+		s.Tags = runLog.Request.Tags
+		s.WorkflowName = workflowName(runLog.Request.Workflow)
+	}
+	return s
+}
+
+// workflowName returns the label of the '#main' routine of a packed workflow, if it has one
+func workflowName(workflow json.RawMessage) string {
+	wf := &wflib.WorkflowJSON{}
+	if err := json.Unmarshal(workflow, wf); err != nil || wf.Graph == nil {
+		return ""
+	}
+	for _, obj := range *wf.Graph {
+		if obj["id"] == "#main" {
+			label, _ := obj["label"].(string)
+			return label
+		}
+	}
+	return ""
+}
+
+// listRunSummaries applies the filter to the summaries, sorts them by creation time
+// and returns the requested page along with the token for the next page
+func listRunSummaries(summaries []*RunSummary, f *RunFilter) (page []*RunSummary, nextPageToken string) {
+	matches := []*RunSummary{}
+	for _, s := range summaries {
+		if f.match(s) {
+			matches = append(matches, s)
+		}
+	}
+	sort.Slice(matches, func(i, k int) bool {
+		return f.before(matches[i].createdObj, matches[i].RunID, matches[k].createdObj, matches[k].RunID)
+	})
+
+	start := 0
+	if f.PageToken != "" {
+		created, runID, _ := decodePageToken(f.PageToken)
+		start = sort.Search(len(matches), func(i int) bool {
+			return f.before(created, runID, matches[i].createdObj, matches[i].RunID)
+		})
+	}
+	end := start + f.PageSize
+	if end >= len(matches) {
+		return matches[start:], ""
+	}
+	last := matches[end-1]
+	return matches[start:end], encodePageToken(last.createdObj, last.RunID)
+}
+
+func (f *RunFilter) match(s *RunSummary) bool {
+	if len(f.States) > 0 && !f.States[s.Status] {
+		return false
+	}
+	for k, v := range f.Tags {
+		if val, ok := s.Tags[k]; !ok || val != v {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && s.createdObj.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && s.createdObj.After(f.Until) {
+		return false
+	}
+	if f.WorkflowName != "" && !strings.Contains(strings.ToLower(s.WorkflowName), f.WorkflowName) {
+		return false
+	}
+	return true
+}
+
+// before returns true if run a is listed before run b
+// ties on creation time are broken by run ID, so the order is total
+func (f *RunFilter) before(aCreated time.Time, aRunID string, bCreated time.Time, bRunID string) bool {
+	if !aCreated.Equal(bCreated) {
+		if f.Sort == sortAsc {
+			return aCreated.Before(bCreated)
+		}
+		return aCreated.After(bCreated)
+	}
+	if f.Sort == sortAsc {
+		return aRunID < bRunID
+	}
+	return aRunID > bRunID
+}
+
+// runs without a creation time have a zero time, which is encoded as an empty timestamp
+func encodePageToken(created time.Time, runID string) string {
+	nanos := ""
+	if !created.IsZero() {
+		nanos = strconv.FormatInt(created.UnixNano(), 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(nanos + "|" + runID))
+}
+
+func decodePageToken(token string) (created time.Time, runID string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return created, "", err
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		return created, "", fmt.Errorf("malformed page token")
+	}
+	if parts[0] == "" {
+		return created, parts[1], nil
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return created, "", err
+	}
+	return time.Unix(0, nanos), parts[1], nil
+}
@@ -0,0 +1,101 @@
+package mariner
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func testSummaries() []*RunSummary {
+	runs := []struct {
+		runID, status, created, name string
+		tags                         map[string]string
+	}{
+		{"a", completed, "2021/1/2 10:0:0", "alignment", map[string]string{"project": "x"}},
+		{"b", failed, "2021/1/3 10:0:0", "Alignment QC", map[string]string{"project": "y"}},
+		{"c", running, "2021/1/4 10:0:0", "variant calling", map[string]string{"project": "x"}},
+		{"d", completed, "2021/1/5 10:0:0", "", nil},
+		{"e", completed, "2021/1/5 10:0:0", "", nil},
+	}
+	summaries := []*RunSummary{}
+	for _, run := range runs {
+		s := &RunSummary{
+			RunID:        run.runID,
+			Status:       run.status,
+			Created:      run.created,
+			WorkflowName: run.name,
+			Tags:         run.tags,
+		}
+		s.createdObj, _ = parseTimef(run.created)
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+func summaryRunIDs(page []*RunSummary) (ids []string) {
+	for _, s := range page {
+		ids = append(ids, s.RunID)
+	}
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListRunSummaries(t *testing.T) {
+	cases := map[string][]string{
+		"":                                  {"e", "d", "c", "b", "a"},
+		"sort=asc":                          {"a", "b", "c", "d", "e"},
+		"state=COMPLETE":                    {"e", "d", "a"},
+		"state=running,failed":              {"c", "b"},
+		"tag=project:x":                     {"c", "a"},
+		"since=2021-01-03&until=2021-01-04": {"c", "b"},
+		"workflow_name=alignment":           {"b", "a"},
+	}
+	for query, expected := range cases {
+		filter, err := runFilter(httptest.NewRequest("GET", "/runs?"+query, nil))
+		if err != nil {
+			t.Fatalf("failed to parse query '%v': %v", query, err)
+		}
+		page, next := listRunSummaries(testSummaries(), filter)
+		if got := summaryRunIDs(page); !equalStrings(got, expected) || next != "" {
+			t.Errorf("query '%v': expected %v, got %v (next page token '%v')", query, expected, got, next)
+		}
+	}
+
+	// walk all the pages
+	all := []string{}
+	query := "/runs?page_size=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("pagination did not terminate")
+		}
+		filter, err := runFilter(httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("failed to parse query '%v': %v", query, err)
+		}
+		page, next := listRunSummaries(testSummaries(), filter)
+		all = append(all, summaryRunIDs(page)...)
+		if next == "" {
+			break
+		}
+		query = "/runs?page_size=2&page_token=" + next
+	}
+	if expected := []string{"e", "d", "c", "b", "a"}; !equalStrings(all, expected) {
+		t.Errorf("paginated listing: expected %v, got %v", expected, all)
+	}
+
+	for _, query := range []string{"page_size=0", "sort=up", "since=yesterday", "tag=project", "page_token=!!"} {
+		if _, err := runFilter(httptest.NewRequest("GET", "/runs?"+query, nil)); err == nil {
+			t.Errorf("invalid query '%v' passed", query)
+		}
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 const (
@@ -17,36 +17,93 @@ const (
 	userIDEnvVar           = "USER_ID"
 	sharedVolumeNameEnvVar = "ENGINE_WORKSPACE"
 
-	// setting a max so as to prevent the error of having too many files being open at once
-	// need to investigate how high we can set this bound without running into problems
-	// for now, conservatively setting the bound to 32
-	maxConcurrent = 32
-
 	// resides in the task's working dir in s3
 	// contains list of files that need to be downloaded from s3 in order for this task to run
 	inputFileListName = "_mariner_s3_input.json"
+
+	// storage drivers - see Storage in config.go
+	storageDriverS3    = "s3"
+	storageDriverLocal = "local"
 )
 
-// S3FileManager ..
-type S3FileManager struct {
-	AWSConfig     *aws.Config
-	S3BucketName  string
-	MaxConcurrent int
+// FileManager reads and writes the objects of runs in the configured storage - see storage/
+type FileManager struct {
+	storage.Storage
 }
 
-func loadAWSConfig() (*aws.Config, error) {
-	secret := []byte(os.Getenv(awsCredsEnvVar))
-	creds := &awsCredentials{}
-	err := json.Unmarshal(secret, creds)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling aws secret: %v", err)
+// loadAWSConfig returns the aws config for the bucket - as the user, if the config has a per-user role and userID isn't ""
+func loadAWSConfig(userID string) (*aws.Config, error) {
+	conf := Config.Storage.S3
+	if conf.PerUserRole && conf.RoleARN == "" {
+		return nil, fmt.Errorf("per-user role without a role_arn")
+	}
+	s3Config := &storage.S3Config{
+		Region:         conf.Region,
+		Endpoint:       conf.Endpoint, // S3-compatible storage, e.g., MinIO
+		ForcePathStyle: conf.ForcePathStyle,
+		Credentials:    conf.Credentials,
+		RoleARN:        conf.RoleARN,
 	}
-	credsConfig := credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
-	awsConfig := &aws.Config{
-		Region:      aws.String(Config.Storage.S3.Region),
-		Credentials: credsConfig,
+	if conf.staticCredentials() {
+		secret := []byte(os.Getenv(awsCredsEnvVar))
+		creds := &awsCredentials{}
+		err := json.Unmarshal(secret, creds)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling aws secret: %v", err)
+		}
+		s3Config.AccessKeyID, s3Config.SecretAccessKey = creds.ID, creds.Secret
 	}
-	return awsConfig, nil
+	if conf.PerUserRole && userID != "" {
+		s3Config.RoleSessionName = roleSessionName(userID)
+		s3Config.Policy = userPolicy(conf.Name, userID)
+	}
+	return s3Config.AWSConfig()
+}
+
+// staticCredentials reports whether the credentials are the awsusercreds secret, in the AWSCREDS env var
+func (conf S3Config) staticCredentials() bool {
+	return conf.Credentials == "" || conf.Credentials == storage.CredentialsStatic
+}
+
+// roleSessionName returns the name of the user's sessions of the assumed role, which shows up in CloudTrail
+// it may only have letters, digits and "_+=,.@-", and at most 64 characters
+func roleSessionName(userID string) string {
+	name := []rune("mariner-" + userID)
+	for i, r := range name {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_+=,.@-", r) {
+			name[i] = '-'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return string(name)
+}
+
+// userPolicy returns the session policy which limits the assumed role to the user's objects
+// keys never have a leading "/" in the bucket - see storage.go
+func userPolicy(bucket, userID string) string {
+	arn := "arn:aws:s3:::" + bucket
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":   "Allow",
+				"Action":   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject"},
+				"Resource": []string{arn + "/" + userID + "/*"},
+			},
+			{
+				"Effect":   "Allow",
+				"Action":   "s3:ListBucket",
+				"Resource": arn,
+				"Condition": map[string]interface{}{
+					"StringLike": map[string]interface{}{"s3:prefix": []string{userID + "/*"}},
+				},
+			},
+		},
+	}
+	b, _ := json.Marshal(policy)
+	return string(b)
 }
 
 type awsCredentials struct {
@@ -54,18 +111,29 @@ type awsCredentials struct {
 	Secret string `json:"secret"`
 }
 
-func (fm *S3FileManager) setup() (err error) {
-	fm.AWSConfig, err = loadAWSConfig()
-	if err != nil {
-		return err
+// driver returns the storage driver - "s3" by default
+func (conf Storage) driver() string {
+	if conf.Driver == "" {
+		return storageDriverS3
 	}
-	fm.S3BucketName = Config.Storage.S3.Name
-	fm.MaxConcurrent = maxConcurrent
-	return nil
+	return conf.Driver
 }
 
-func (fm *S3FileManager) newS3Session() *session.Session {
-	return session.Must(session.NewSession(fm.AWSConfig))
+// setup connects to the storage - as the user, if userID isn't "" and the config says so, see loadAWSConfig
+func (fm *FileManager) setup(userID string) (err error) {
+	switch Config.Storage.driver() {
+	case storageDriverS3:
+		awsConfig, err := loadAWSConfig(userID)
+		if err != nil {
+			return err
+		}
+		fm.Storage, err = storage.NewS3(awsConfig, Config.Storage.S3.Name)
+		return err
+	case storageDriverLocal:
+		fm.Storage, err = storage.NewLocal(Config.Storage.Local.Root)
+		return err
+	}
+	return fmt.Errorf("unknown storage driver: %v", Config.Storage.Driver)
 }
 
 /*
@@ -81,7 +149,7 @@ func (fm *S3FileManager) newS3Session() *session.Session {
 
 	so, replace "engine-workspace" with "userID"
 */
-func (fm *S3FileManager) s3Key(path string, userID string) string {
+func (fm *FileManager) s3Key(path string, userID string) string {
 	key := strings.Replace(path, engineWorkspaceVolumeName, userID, 1)
 	return key
 }
@@ -0,0 +1,43 @@
+package mariner
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRoleSessionName(t *testing.T) {
+	cases := map[string]string{
+		"user@example.org": "mariner-user@example.org",
+		"first last/dept":  "mariner-first-last-dept",
+		"josé":             "mariner-jos-",
+		"a-very-long-user-name-which-does-not-fit-in-a-role-session-name": "mariner-a-very-long-user-name-which-does-not-fit-in-a-role-sessi",
+	}
+	for userID, expected := range cases {
+		if name := roleSessionName(userID); name != expected {
+			t.Errorf("'%v': expected '%v', got '%v'", userID, expected, name)
+		}
+	}
+}
+
+func TestUserPolicy(t *testing.T) {
+	policy := struct {
+		Statement []struct {
+			Action    interface{}
+			Resource  interface{}
+			Condition map[string]map[string][]string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(userPolicy("bucket", "user")), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Statement) != 2 {
+		t.Fatalf("expected 2 statements, got %v", len(policy.Statement))
+	}
+	resources, _ := policy.Statement[0].Resource.([]interface{})
+	if len(resources) != 1 || resources[0] != "arn:aws:s3:::bucket/user/*" {
+		t.Errorf("wrong object resources: %v", policy.Statement[0].Resource)
+	}
+	if !equalStrings(policy.Statement[1].Condition["StringLike"]["s3:prefix"], []string{"user/*"}) {
+		t.Errorf("wrong listing condition: %v", policy.Statement[1].Condition)
+	}
+}
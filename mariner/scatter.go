@@ -218,7 +218,7 @@ func (task *Task) dotproduct(scatterParams map[string][]interface{}) (err error)
 
 		// currently logging scattered tasks this way
 		// the subtask logs are beneath/within the scatter task log object
-		task.Log.Scatter[i] = subtask.Log
+		task.Log.attachScatter(i, subtask.Log)
 		task.infof("end build subtask %v", i)
 	}
 	task.infof("end build scatter subtasks by dotproduct method")
@@ -258,7 +258,7 @@ func (task *Task) flatCrossproduct(scatterParams map[string][]interface{}) (err
 
 		// currently logging scattered tasks this way
 		// the subtask logs are beneath/within the scatter task log object
-		task.Log.Scatter[scatterIndex] = subtask.Log
+		task.Log.attachScatter(scatterIndex, subtask.Log)
 
 		task.infof("end build subtask %v", scatterIndex)
 		scatterIndex++
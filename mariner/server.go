@@ -2,21 +2,24 @@ package mariner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
 	batchv1 "k8s.io/api/batch/v1"
 	batchtypev1 "k8s.io/client-go/kubernetes/typed/batch/v1"
 
@@ -39,6 +42,25 @@ type WorkflowRequest struct {
 
 	// new: specify a service account for the workflow job
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// optional webhooks to call on status changes of the run - see notify.go
+	Notifications *Notifications `json:"notifications,omitempty"`
+
+	// a registered workflow to run, instead of the embedded Workflow - see registry.go
+	WorkflowRef *WorkflowRef `json:"workflowRef,omitempty"`
+
+	// optional, how long a failed task waits for a retry or cancel request before failing the run, e.g., "30m" - see tasks.go
+	RetryWait string `json:"retryWait,omitempty"`
+
+	// optional, puts the user's access token in every task pod - see tasktoken.go
+	TaskToken *TaskTokenRequest `json:"taskToken,omitempty"`
+
+	// the commons objects named in the input, as resolved by the server - see drs.go
+	ResolvedObjects []*ResolvedObject `json:"resolvedObjects,omitempty"`
+
+	// the uploaded cwl files the Workflow was packed from, if any - see bundle.go
+	WorkflowSources *WorkflowSources `json:"workflowSources,omitempty"`
+	bundle          *WorkflowBundle
 }
 
 type Manifest []ManifestEntry
@@ -53,8 +75,17 @@ type JWTDecoder interface {
 
 type Server struct {
 	jwtApp        JWTDecoder
+	tokenExpected *authutils.Expected // what the claims of a token must satisfy - see token.go
+	wtsURL        string              // wts endpoint which tells whether the user is connected - "" to skip the check
 	logger        *LogHandler
-	S3FileManager *S3FileManager
+	FileManager   *FileManager
+	runIndex      RunIndex
+	authorizer    Authorizer
+	drs           *DRSClient // resolves the commons objects in the input - see drs.go
+	backfillLock  sync.Mutex
+	backfilled    map[string]bool // users whose runs have been backfilled into the run index
+	archiveLock   sync.Mutex
+	archives      map[string]*archiveBuild // output archives being built, by s3 key
 }
 
 // see Arborist's logging.go
@@ -63,12 +94,6 @@ type LogHandler struct {
 	logger *log.Logger
 }
 
-type AuthHTTPRequest struct {
-	URL         string
-	ContentType string
-	Body        io.Reader
-}
-
 type RequestJSON struct {
 	User    *UserJSON    `json:"user"`
 	Request *AuthRequest `json:"request"`
@@ -101,8 +126,12 @@ type CancelRunJSON struct {
 	Result string `json:"result"` // success or failed
 }
 
+// ListRunsJSON is one page of the user's run history
+// 'runIDs' lists the same runs as 'runs', in the same order
 type ListRunsJSON struct {
-	RunIDs []string `json:"runIDs"`
+	RunIDs        []string      `json:"runIDs"`
+	Runs          []*RunSummary `json:"runs"`
+	NextPageToken string        `json:"nextPageToken,omitempty"`
 }
 
 type RunIDJSON struct {
@@ -113,6 +142,34 @@ type ArboristResponse struct {
 	Auth bool `json:"auth"`
 }
 
+// ArboristUser is the part of arborist's user endpoint mariner reads
+type ArboristUser struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups"`
+}
+
+// the write deadline of a request - handlers which stream, like the run's events, set a later one
+// see writeDeadlines
+const serverWriteTimeout = 10 * time.Second
+
+type connContextKey struct{}
+
+// writeDeadlines gives each request serverWriteTimeout to write its response
+// instead of the server's WriteTimeout, which a handler can't extend
+func writeDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setWriteDeadline(r, time.Now().Add(serverWriteTimeout))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setWriteDeadline sets the write deadline of the request's connection, if the server recorded it - see runServer
+func setWriteDeadline(r *http.Request, deadline time.Time) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+}
+
 // RunServer inits the mariner server
 func RunServer() {
 	go deleteCompletedJobs()
@@ -131,30 +188,74 @@ func runServer() {
 	logFlags := log.Ldate | log.Ltime
 	logger := log.New(os.Stdout, "", logFlags)
 	jwtApp := authutils.NewJWTApplication(*jwkEndpoint)
-	fm := &S3FileManager{}
-	fm.setup()
-	server := server().withLogger(logger).withJWTApp(jwtApp).withS3FileManager(fm)
+	tokenExpected, err := tokenExpectations(Config.Auth, *jwkEndpoint)
+	if err != nil {
+		logger.Fatalf("failed to set up authentication: %v", err)
+	}
+	fm := &FileManager{}
+	if err = fm.setup(""); err != nil {
+		logger.Fatalf("failed to set up storage: %v", err)
+	}
+	runIndex, err := openRunIndex(Config.RunIndex)
+	if err != nil {
+		logger.Fatalf("failed to open run index: %v", err)
+	}
+	authorizer, err := newAuthorizer(Config.Authz)
+	if err != nil {
+		logger.Fatalf("failed to set up authorization: %v", err)
+	}
+	if err = Config.Quotas.validate(); err != nil {
+		logger.Fatalf("invalid quotas: %v", err)
+	}
+	server := server().withLogger(logger).withJWTApp(jwtApp, tokenExpected).withWTS(wtsConnectedURL).withFileManager(fm).withRunIndex(runIndex).withAuthorizer(authorizer).withDRS(newDRSClient(Config.DRS.URL))
+	if Config.Quotas.queues() {
+		go server.dispatchQueuedRuns()
+	}
 	router := server.makeRouter(os.Stdout)
 	addr := fmt.Sprintf(":%d", *port)
 	httpLogger := log.New(os.Stdout, "", log.LstdFlags)
+	// no WriteTimeout - the write deadline is set per request, so that event streams can outlast it
 	httpServer := &http.Server{
-		Addr:         addr,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		ErrorLog:     httpLogger,
-		Handler:      router,
+		Addr:        addr,
+		ReadTimeout: 10 * time.Second,
+		ErrorLog:    httpLogger,
+		Handler:     writeDeadlines(router),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
 	}
 	httpLogger.Println(fmt.Sprintf("mariner serving at %s", httpServer.Addr))
 	httpLogger.Fatal(httpServer.ListenAndServe())
 }
 
-func (server *Server) withS3FileManager(fm *S3FileManager) *Server {
-	server.S3FileManager = fm
+func (server *Server) withFileManager(fm *FileManager) *Server {
+	server.FileManager = fm
+	return server
+}
+
+func (server *Server) withRunIndex(index RunIndex) *Server {
+	server.runIndex = index
+	return server
+}
+
+func (server *Server) withAuthorizer(authorizer Authorizer) *Server {
+	server.authorizer = authorizer
 	return server
 }
 
-func (server *Server) withJWTApp(jwtApp JWTDecoder) *Server {
+func (server *Server) withDRS(client *DRSClient) *Server {
+	server.drs = client
+	return server
+}
+
+func (server *Server) withJWTApp(jwtApp JWTDecoder, expected *authutils.Expected) *Server {
 	server.jwtApp = jwtApp
+	server.tokenExpected = expected
+	return server
+}
+
+func (server *Server) withWTS(url string) *Server {
+	server.wtsURL = url
 	return server
 }
 
@@ -168,19 +269,47 @@ func server() (server *Server) {
 	return &Server{}
 }
 
-// first just getting the endpoints to work, then will make nice and WES-ish
+// the original bespoke endpoints are kept at the root for existing clients
+// the WES-compliant endpoints are served under wesBasePath
 func (server *Server) makeRouter(out io.Writer) http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/runs", server.handleRunsPOST).Methods("POST")
-	router.HandleFunc("/runs", server.handleRunsGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}", server.handleRunLogGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}/status", server.handleRunStatusGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}/cancel", server.handleCancelRunPOST).Methods("POST")
-	router.HandleFunc("/_status", server.handleHealthCheck).Methods("GET") // TO CHECK
-
-	// router.NotFoundHandler = http.HandlerFunc(handleNotFound) // TODO
-
-	router.Use(server.handleAuth)        // use auth middleware function - right now access to mariner API is all-or-nothing
+	// each endpoint checks the user may perform an action on its resource - see authz.go
+	userRuns, run := server.userRunsResource, server.runResource
+	router.HandleFunc("/runs", server.authorize(authzSubmit, userRuns, server.handleRunsPOST)).Methods("POST")
+	router.HandleFunc("/runs", server.authorize(authzRead, userRuns, server.handleRunsGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}", server.authorize(authzRead, run, server.handleRunLogGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}", server.authorize(authzDelete, run, server.handleRunDELETE)).Methods("DELETE")
+	router.HandleFunc("/runs/{runID}/status", server.authorize(authzRead, run, server.handleRunStatusGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/cancel", server.authorize(authzCancel, run, server.handleCancelRunPOST)).Methods("POST")
+	router.HandleFunc("/runs/{runID}/rerun", server.authorize(authzSubmit, run, server.handleRerunPOST)).Methods("POST")
+	router.HandleFunc("/runs/{runID}/shares", server.authorize(authzShare, run, server.handleRunSharesGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/shares", server.authorize(authzShare, run, server.handleRunSharesPUT)).Methods("PUT")
+	router.HandleFunc("/runs/{runID}/events", server.authorize(authzRead, run, server.handleRunEventsGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/outputs", server.authorize(authzRead, run, server.handleRunOutputsGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/outputs/archive", server.authorize(authzRead, run, server.handleRunOutputArchiveGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/tasks", server.authorize(authzRead, run, server.handleTasksGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/tasks/{taskID:.+}/logs", server.authorize(authzRead, run, server.handleTaskLogsGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/tasks/{taskID:.+}/cancel", server.authorize(authzCancel, run, server.handleTaskCancelPOST)).Methods("POST")
+	router.HandleFunc("/runs/{runID}/tasks/{taskID:.+}/retry", server.authorize(authzSubmit, run, server.handleTaskRetryPOST)).Methods("POST")
+	// after the other task routes, since a taskID contains '/'
+	router.HandleFunc("/runs/{runID}/tasks/{taskID:.+}", server.authorize(authzRead, run, server.handleTaskGET)).Methods("GET")
+	router.HandleFunc("/workflows", server.authorize(authzSubmit, workflowsResource, server.handleWorkflowsPOST)).Methods("POST")
+	router.HandleFunc("/workflows", server.authorize(authzRead, workflowsResource, server.handleWorkflowsGET)).Methods("GET")
+	router.HandleFunc("/workflows/{name}/versions/{version}", server.authorize(authzRead, workflowsResource, server.handleWorkflowVersionGET)).Methods("GET")
+	router.HandleFunc("/admin/runs", server.authorize(authzAdmin, adminResource, server.handleAdminRunsGET)).Methods("GET")
+	router.HandleFunc("/admin/users", server.authorize(authzAdmin, adminResource, server.handleAdminUsersGET)).Methods("GET")
+	router.HandleFunc("/admin/runs/{userID}/{runID}/cancel", server.authorize(authzAdmin, adminResource, server.handleAdminCancelRunPOST)).Methods("POST")
+	router.HandleFunc("/admin/cleanup", server.authorize(authzAdmin, adminResource, server.handleAdminCleanupPOST)).Methods("POST")
+	router.HandleFunc("/service-info", server.handleServiceInfo).Methods("GET")
+	router.HandleFunc("/_status", server.handleHealthCheck).Methods("GET")
+
+	// GA4GH WES 1.x - see wes.go
+	server.addWESRoutes(router.PathPrefix(wesBasePath).Subrouter())
+
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+
+	router.Use(server.handleAuth)        // authenticate the user - see token.go
 	router.Use(server.setResponseHeader) // set "Content-Type: application/json" header - every endpoint returns JSON
 
 	// remove trailing slashes sent in URLs
@@ -203,8 +332,8 @@ func (server *Server) handleRunLogGET(w http.ResponseWriter, r *http.Request) {
 	userID, runID := server.uniqueKey(r)
 	j, err := server.fetchLog(userID, runID)
 	if err != nil {
-		fmt.Println("error fetching log: ", err)
-		// handle
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
 	}
 	writeJSON(w, j)
 }
@@ -224,19 +353,19 @@ func (server *Server) handleRunStatusGET(w http.ResponseWriter, r *http.Request)
 	userID, runID := server.uniqueKey(r)
 	j, err := server.fetchStatus(userID, runID)
 	if err != nil {
-		fmt.Println("error fetching status: ", err)
-		// handle
+		writeStorageError(w, fmt.Errorf("failed to fetch status: %w", err))
+		return
 	}
 	writeJSON(w, j)
 }
 
 func (server *Server) fetchStatus(userID, runID string) (*StatusJSON, error) {
 	j := &StatusJSON{}
-	runLog, err := server.fetchMainLog(userID, runID)
+	status, err := server.runStatus(userID, runID)
 	if err != nil {
 		return nil, err
 	}
-	j.Status = runLog.Main.Status
+	j.Status = status
 	return j, nil
 }
 
@@ -245,7 +374,12 @@ func (server *Server) handleCancelRunPOST(w http.ResponseWriter, r *http.Request
 	userID, runID := server.uniqueKey(r)
 	j, err := server.cancelRun(userID, runID)
 	if err != nil {
-		fmt.Println("error cancelling run: ", err)
+		if isNotFound(err) {
+			writeStorageError(w, fmt.Errorf("failed to cancel run: %w", err))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeCancel, fmt.Sprintf("failed to cancel run: %v", err), nil)
+		return
 	}
 	writeJSON(w, j)
 }
@@ -266,6 +400,15 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 	// log
 	runLog.Main.Event.info("cancelling run")
 
+	// a queued run has no jobs yet
+	if runLog.Main.Status == queued {
+		if err = server.cancelQueuedRun(runLog, userID, runID); err != nil {
+			return j, err
+		}
+		j.Result = success
+		return j, nil
+	}
+
 	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
 	if err != nil {
 		return nil, err
@@ -288,7 +431,10 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 	runLog.Main.Event.info("successfully killed engine job")
 
 	// update status of 'main' (i.e., the engine process, the top-level workflow process)
-	runLog.Main.Status = cancelled
+	// the engine is gone, so the server sends the 'cancelled' notification
+	notifier := newNotifier(runID, runLog.Request)
+	notifier.watch(runLog.Journal)
+	runLog.Main.setStatus(cancelled)
 
 	// write to logdb
 	server.writeLog(runLog, userID, runID)
@@ -315,13 +461,13 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 				task.Event.info("task process killed")
 
 				// update status of each task process to be killed
-				task.Status = cancelled
+				task.setStatus(cancelled)
 			} else if task.Status == running {
 				// some running tasks may finish in this grace period
 				// although those task processes finish, output is not collected from them
 				// because the engine process has already been killed
 				// so the most appropriate status for these tasks is 'cancelled'
-				task.Status = cancelled
+				task.setStatus(cancelled)
 			}
 		}
 		switch l := len(taskJobs); l {
@@ -344,63 +490,202 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 }
 
 // '/runs' - GET
+// see runs.go for the filter, sort and pagination query parameters
 func (server *Server) handleRunsGET(w http.ResponseWriter, r *http.Request) {
-	userID := server.userID(r)
-	j, err := server.fetchRuns(userID)
+	filter, err := runFilter(r)
 	if err != nil {
-		fmt.Println("error fetching runs: ", err)
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	j, err := server.fetchRuns(r, filter)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch runs: %w", err))
+		return
 	}
 	writeJSON(w, j)
 }
 
-func (server *Server) fetchRuns(userID string) (*ListRunsJSON, error) {
-	j := &ListRunsJSON{}
-	runIDs, err := server.listRuns(userID)
+func (server *Server) fetchRuns(r *http.Request, filter *RunFilter) (*ListRunsJSON, error) {
+	summaries, err := server.scopedRunSummaries(r, filter.Scope)
 	if err != nil {
 		return nil, err
 	}
-	j.RunIDs = runIDs
+	j := &ListRunsJSON{RunIDs: []string{}}
+	j.Runs, j.NextPageToken = listRunSummaries(summaries, filter)
+	for _, s := range j.Runs {
+		j.RunIDs = append(j.RunIDs, s.RunID)
+	}
 	return j, nil
 }
 
 // `/runs` - POST
 func (server *Server) handleRunsPOST(w http.ResponseWriter, r *http.Request) {
-	// fixme: return and handle err here
-	workflowRequest := unmarshalBody(r, &WorkflowRequest{}).(*WorkflowRequest)
+	workflowRequest := &WorkflowRequest{}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		workflowRequest, err = workflowRequestFromBundleForm(r)
+	} else {
+		err = unmarshalBody(r, workflowRequest)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return
+	}
+	runID, ok := server.submitRun(w, r, workflowRequest, "")
+	if !ok {
+		return
+	}
+	j := &RunIDJSON{RunID: runID}
+	writeJSON(w, j)
+}
 
+// submitRun validates the workflow request, stores it and dispatches the engine job
+// parentRunID is the run which this one reruns, if any
+// on failure the error document has already been written to w and ok is false
+func (server *Server) submitRun(w http.ResponseWriter, r *http.Request, workflowRequest *WorkflowRequest, parentRunID string) (runID string, ok bool) {
 	// really, all json needs to get validated some way or another by the server
 	// in particular for a workflow request
 	// validate against WorkflowRequest struct schema
 
-	// right now just validating the workflow itself, not the whole request
-	// fixme: validate whole request
-	valid, _ := wflib.ValidateJSON([]byte(workflowRequest.Workflow), nil)
+	// pack uploaded cwl files
+	if err := workflowRequest.packBundle(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidWorkflow, err.Error(), nil)
+		return "", false
+	}
+
+	// fill in a referenced workflow from the registry
+	if err := server.resolveWorkflowRef(workflowRequest); err != nil {
+		if errors.Is(err, errInvalidWorkflowRef) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidWorkflow, err.Error(), nil)
+		} else {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, err.Error(), nil)
+		}
+		return "", false
+	}
+
+	// first the workflow itself
+	valid, grievances := wflib.ValidateJSON([]byte(workflowRequest.Workflow), nil)
 	if !valid {
-		http.Error(w, "invalid workflow request", 400)
-		return
+		writeError(w, http.StatusBadRequest, errCodeInvalidWorkflow, "invalid workflow", &RequestGrievances{
+			Workflow: grievances,
+		})
+		return "", false
+	}
+
+	// then check the input object against the inputs of '#main'
+	// so that bad input gets reported now, rather than failing the run at runtime
+	if valid, grievances := wflib.ValidateInput(workflowRequest.Workflow, workflowRequest.Input); !valid {
+		writeError(w, http.StatusBadRequest, errCodeInvalidInput, "invalid workflow input", &RequestGrievances{
+			Input: grievances,
+		})
+		return "", false
+	}
+
+	if err := workflowRequest.TaskToken.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return "", false
+	}
+
+	if _, err := retryWait(workflowRequest); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return "", false
+	}
+
+	if err := workflowRequest.Notifications.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return "", false
+	}
+
+	// look up the commons objects named in the input, and add them to the manifest
+	inputGrievances, err := server.resolveCommonsInputs(workflowRequest, requestToken(r))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodeInternal, fmt.Sprintf("failed to resolve commons objects: %v", err), nil)
+		return "", false
+	}
+	if inputGrievances != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidInput, "invalid workflow input", &RequestGrievances{
+			Input: inputGrievances,
+		})
+		return "", false
 	}
 
 	workflowRequest.UserID = server.userID(r)
 	workflowRequest.JobName = createJobName()
 
-	err := server.writeWorkflowRequestToS3(workflowRequest)
+	// a run over the user's quota is rejected or queued - see quota.go
+	over, err := server.admit(workflowRequest)
 	if err != nil {
-		http.Error(w, "failed to write workflow request to s3", 500)
-		return
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("failed to check quota: %v", err), nil)
+		return "", false
+	}
+	queue := len(over) > 0
+	if queue && !Config.Quotas.queues() {
+		writeError(w, http.StatusTooManyRequests, errCodeQuotaExceeded, "run would exceed the user's quota", &RequestGrievances{
+			Request: wflib.Grievances(over),
+		})
+		return "", false
+	}
+
+	err = server.writeWorkflowRequestToS3(workflowRequest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to write workflow request to s3: %v", err), nil)
+		return "", false
+	}
+	if workflowRequest.bundle != nil {
+		if err = server.storeWorkflowSources(workflowRequest); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to write workflow sources to s3: %v", err), nil)
+			return "", false
+		}
+	}
+
+	// write an initial log so that the run shows up (as 'not-started')
+	// in the time between now and when the engine job comes up and takes over the log
+	runLog := mainLog(fmt.Sprintf(pathToLogf, workflowRequest.JobName))
+	runLog.Request = workflowRequest
+	runLog.ParentRunID = parentRunID
+	runLog.Main.CreatedObj = time.Now()
+	runLog.Main.Created = timef(runLog.Main.CreatedObj)
+	runLog.Main.Event.info("run submitted")
+	if parentRunID != "" {
+		runLog.Main.Event.infof("rerun of run %v", parentRunID)
+	}
+	for _, obj := range workflowRequest.ResolvedObjects {
+		runLog.Main.Event.infof("resolved %v to %v - access urls: %v", obj.Location, obj.GUID, strings.Join(obj.AccessURLs, ", "))
+	}
+	if queue {
+		runLog.Main.Event.infof("run queued - %v", strings.Join(over, "; "))
+		runLog.Main.setStatus(queued)
+	}
+	if err = server.writeLog(runLog, workflowRequest.UserID, workflowRequest.JobName); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to write initial run log to s3: %v", err), nil)
+		return "", false
+	}
+	if queue {
+		if err = server.queueRun(workflowRequest.UserID, workflowRequest.JobName); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to queue run: %v", err), nil)
+			return "", false
+		}
+		return workflowRequest.JobName, true
 	}
 
 	err = dispatchWorkflowJob(workflowRequest)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+		writeError(w, http.StatusInternalServerError, errCodeDispatch, err.Error(), nil)
+		return "", false
 	}
-	j := &RunIDJSON{RunID: workflowRequest.JobName}
-	writeJSON(w, j)
+	return workflowRequest.JobName, true
 }
 
 func (server *Server) writeWorkflowRequestToS3(r *WorkflowRequest) error {
-	sess := server.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
 	b, err := json.Marshal(r)
 	if err != nil {
 		return fmt.Errorf("failed to marshal workflow request to json: %v", err)
@@ -413,15 +698,10 @@ func (server *Server) writeWorkflowRequestToS3(r *WorkflowRequest) error {
 
 	key := fmt.Sprintf("/%s/workflowRuns/%s/%s", r.UserID, r.JobName, requestFile)
 
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(server.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(b),
-	})
-	if err != nil {
+	if err = storage.PutBytes(server.FileManager, key, b); err != nil {
 		return fmt.Errorf("upload workflow request to s3 failed: %v", err)
 	}
-	fmt.Println("wrote workflow request to s3 location:", result.Location)
+	fmt.Println("wrote workflow request to s3 location:", key)
 	return nil
 }
 
@@ -435,117 +715,6 @@ func (server *Server) setResponseHeader(next http.Handler) http.Handler {
 	})
 }
 
-// handleAuth is invoked by the server to use arborist and wts to authorize user access.
-func (server *Server) handleAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if server.authZ(r) && server.fetchRefreshToken() {
-			next.ServeHTTP(w, r)
-			return
-		}
-		http.Error(w, "user not authorized to access this resource", 403)
-	})
-}
-
-// polish this
-func authHTTPRequest(r *http.Request) (*AuthHTTPRequest, error) {
-	authHeader := r.Header.Get(authHeader)
-	if authHeader == "" {
-		return nil, fmt.Errorf("no token in Authorization header")
-	}
-	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-	userJWT = strings.TrimPrefix(userJWT, "bearer ")
-	user := &UserJSON{
-		Token: userJWT,
-	}
-	authRequest := &AuthRequest{
-		Resource: "/mariner",
-	}
-	authAction := &AuthAction{
-		Service: "mariner",
-		Method:  "access",
-	}
-	authRequest.Action = authAction
-	requestJSON := &RequestJSON{
-		User:    user,
-		Request: authRequest,
-	}
-	b, err := json.Marshal(requestJSON)
-	if err != nil {
-		fmt.Println("error marhsaling authRequest to json: ", err)
-	}
-	authHTTPRequest := &AuthHTTPRequest{
-		URL:         "http://arborist-service/auth/request",
-		ContentType: "application/json",
-		Body:        bytes.NewBuffer(b),
-	}
-	return authHTTPRequest, nil
-}
-
-func (server *Server) authZ(r *http.Request) bool {
-	authHTTPRequest, err := authHTTPRequest(r)
-	if err != nil {
-		fmt.Println("error building auth request: ", err)
-		return false
-	}
-	resp, err := http.Post(
-		authHTTPRequest.URL,
-		authHTTPRequest.ContentType,
-		authHTTPRequest.Body,
-	)
-	if err != nil {
-		// insert better error and logging handling here
-		fmt.Println("error asking arborist: ", err)
-		return false
-	}
-	authResponse := &ArboristResponse{}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("error reading arborist response body: ", err)
-		return false
-	}
-	resp.Body.Close()
-	err = json.Unmarshal(b, authResponse)
-	if err != nil {
-		fmt.Println("error unmarshalling arborist response to struct: ", err)
-		return false
-	}
-	return authResponse.Auth
-}
-
-// fetchRefreshToken is invoked from the server to check if a refresh token is expired and fetches a new one if it is.
-func (server *Server) fetchRefreshToken() bool {
-	wtsPath := "http://workspace-token-service/oauth2/"
-	connectedUrl := wtsPath + "connected"
-	res, err := http.Get(connectedUrl)
-	if err != nil {
-		fmt.Println("error checking if user is connected or has a valid token via wts")
-		return false
-	}
-	if res.StatusCode != 200 {
-		fmt.Println("refresh token expired or user not logged in, fetching new refresh token")
-		authUrl := wtsPath + "authorization_url?redirect=/"
-		res, err := http.Get(authUrl)
-		if err != nil {
-			fmt.Println("error fetching refresh token from wts")
-			return false
-		}
-		if res.StatusCode == 400 {
-			fmt.Println("wts refresh token bad request, user error")
-			return false
-		}
-		res.Body.Close()
-	}
-	res.Body.Close()
-	return true
-}
-
-// HandleHealthcheck registers root endpoint
-// fixme
-func (server *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.URL)
-	return
-}
-
 //// Server utility functions ////
 
 func writeJSON(w http.ResponseWriter, j interface{}) {
@@ -555,30 +724,33 @@ func writeJSON(w http.ResponseWriter, j interface{}) {
 }
 
 // a run's unique key is the pair (userID, runID)
+// the userID is the caller's, unless the request is for a run shared by its owner, '?owner=<userID>' - see share.go
 func (server *Server) uniqueKey(r *http.Request) (userID, runID string) {
 	runID = mux.Vars(r)["runID"]
-	userID = server.userID(r)
+	if userID = r.URL.Query().Get("owner"); userID == "" {
+		userID = server.userID(r)
+	}
 	return userID, runID
 }
 
 // unmarshal the request body to the given go struct
-// fixme: return error
-func unmarshalBody(r *http.Request, v interface{}) interface{} {
-	b := body(r)
-	err := json.Unmarshal(b, v)
+func unmarshalBody(r *http.Request, v interface{}) error {
+	b, err := body(r)
 	if err != nil {
-		fmt.Println("error unmarshalling: ", err)
+		return err
 	}
-	return v
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to unmarshal request body: %v", err)
+	}
+	return nil
 }
 
-// fixme: return error
-func body(r *http.Request) []byte {
+func body(r *http.Request) ([]byte, error) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Println("error reading body: ", err)
+		return nil, fmt.Errorf("failed to read request body: %v", err)
 	}
 	r.Body.Close()
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-	return b
+	return b, nil
 }
@@ -0,0 +1,355 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains run sharing
+//
+// the owner of a run may share it with other users, or with arborist groups:
+// - GET /runs/{runID}/shares returns the run's shares
+// - PUT /runs/{runID}/shares replaces them, e.g., {"shares": [{"user": "bob", "actions": ["read"]}, {"group": "lab", "actions": ["read", "cancel", "rerun"]}]}
+// managing the shares of a run takes the 'share' action on it - see authz.go
+//
+// a share grants, on that one run:
+// - read:   the run's status, log, events, outputs and tasks - always granted
+// - cancel: cancelling the run or its tasks
+// - rerun:  rerunning the run, as a new run of the user's own, and retrying its tasks
+//
+// the run endpoints act on the caller's own runs - a shared run is addressed with its owner, '?owner=<userID>'
+// when the authorizer denies an action on another user's run, the run's shares are checked - see sharedRunAllows
+// GET /runs?scope=shared lists the runs shared with the caller, and with the caller's groups
+//
+// s3 layout, in the server's bucket:
+// {owner}/workflowRuns/{runID}/shares.json         - the run's shares
+// sharedRuns/{user|group}/{name}/{owner}/{runID}    - one marker per share, to list the runs shared with a user or group
+
+const (
+	shareRead   = "read"
+	shareCancel = "cancel"
+	shareRerun  = "rerun"
+
+	sharePrincipalUser  = "user"
+	sharePrincipalGroup = "group"
+
+	pathToSharedRunsf = "sharedRuns/%v/%v/"         // fill with principal type, principal
+	pathToSharedRunf  = pathToSharedRunsf + "%v/%v" // fill with principal type, principal, owner, runID
+
+	runScopeOwn    = "own"
+	runScopeShared = "shared"
+)
+
+var shareActions = []string{shareRead, shareCancel, shareRerun}
+
+// RunShare grants a user or a group actions on a run
+type RunShare struct {
+	User    string   `json:"user,omitempty"`
+	Group   string   `json:"group,omitempty"`
+	Actions []string `json:"actions"`
+}
+
+// RunSharesJSON ..
+type RunSharesJSON struct {
+	RunID  string      `json:"runID"`
+	Owner  string      `json:"owner"`
+	Shares []*RunShare `json:"shares"`
+}
+
+// validate checks the share names exactly one user or group and known actions,
+// and normalizes its actions - sorted, without duplicates, and with read
+func (share *RunShare) validate() error {
+	if (share.User == "") == (share.Group == "") {
+		return fmt.Errorf("a share must have either a user or a group")
+	}
+	if _, name := share.principal(); strings.Contains(name, "/") {
+		return fmt.Errorf("invalid share principal: %v", name)
+	}
+	actions := []string{shareRead}
+	for _, action := range share.Actions {
+		if !contains(shareActions, action) {
+			return fmt.Errorf("invalid share action: %v - must be one of %v", action, strings.Join(shareActions, ", "))
+		}
+		if !contains(actions, action) {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+	share.Actions = actions
+	return nil
+}
+
+func (share *RunShare) principal() (kind, name string) {
+	if share.Group != "" {
+		return sharePrincipalGroup, share.Group
+	}
+	return sharePrincipalUser, share.User
+}
+
+// allows returns true if the share grants the authz action - see authz.go
+func (share *RunShare) allows(action string) bool {
+	switch action {
+	case authzRead:
+		return true
+	case authzCancel:
+		return contains(share.Actions, shareCancel)
+	case authzSubmit:
+		return contains(share.Actions, shareRerun)
+	}
+	return false
+}
+
+// sharesAllow returns true if one of the shares grants the user, or one of the user's groups, the action
+func sharesAllow(shares []*RunShare, userID string, groups []string, action string) bool {
+	for _, share := range shares {
+		if (share.User != "" && share.User == userID) || (share.Group != "" && contains(groups, share.Group)) {
+			if share.allows(action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateShares validates every share, and checks no user or group is listed twice
+func validateShares(shares []*RunShare) error {
+	seen := make(map[string]bool)
+	for _, share := range shares {
+		if err := share.validate(); err != nil {
+			return err
+		}
+		kind, name := share.principal()
+		if seen[kind+"/"+name] {
+			return fmt.Errorf("%v %v is listed more than once", kind, name)
+		}
+		seen[kind+"/"+name] = true
+	}
+	return nil
+}
+
+// shareMarkerKey is the key of the marker of the share of a run
+func shareMarkerKey(share *RunShare, owner, runID string) string {
+	kind, name := share.principal()
+	return fmt.Sprintf(pathToSharedRunf, kind, name, owner, runID)
+}
+
+// removedShareMarkers returns the keys of the markers of the previous shares whose user or group isn't shared with anymore
+func removedShareMarkers(previous, shares []*RunShare, owner, runID string) []string {
+	keep := make(map[string]bool)
+	for _, share := range shares {
+		keep[shareMarkerKey(share, owner, runID)] = true
+	}
+	keys := []string{}
+	for _, share := range previous {
+		if key := shareMarkerKey(share, owner, runID); !keep[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sharedRunKey splits the key of a marker into the owner and ID of the shared run
+func sharedRunKey(key, prefix string) (owner, runID string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+//// authz ////
+
+// sharedRunAllows returns true if the request is for another user's run, which is shared with the caller for the action
+func (server *Server) sharedRunAllows(r *http.Request, action string) (bool, error) {
+	owner, runID := server.uniqueKey(r)
+	userID := server.userID(r)
+	if runID == "" || owner == userID {
+		return false, nil
+	}
+	shares, err := server.fetchRunShares(owner, runID)
+	if err != nil {
+		return false, err
+	}
+	if sharesAllow(shares, userID, nil, action) {
+		return true, nil
+	}
+	for _, share := range shares {
+		if share.Group != "" {
+			// only look up the caller's groups if the run is shared with any group
+			groups, err := server.authorizer.Groups(bearerToken(r), userID)
+			if err != nil {
+				return false, err
+			}
+			return sharesAllow(shares, userID, groups, action), nil
+		}
+	}
+	return false, nil
+}
+
+//// handlers ////
+
+// '/runs/{runID}/shares' - GET
+func (server *Server) handleRunSharesGET(w http.ResponseWriter, r *http.Request) {
+	owner, runID := server.uniqueKey(r)
+	shares, err := server.fetchRunShares(owner, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch shares: %w", err))
+		return
+	}
+	writeJSON(w, &RunSharesJSON{RunID: runID, Owner: owner, Shares: shares})
+}
+
+// '/runs/{runID}/shares' - PUT
+func (server *Server) handleRunSharesPUT(w http.ResponseWriter, r *http.Request) {
+	owner, runID := server.uniqueKey(r)
+	j := &RunSharesJSON{}
+	if err := unmarshalBody(r, j); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), nil)
+		return
+	}
+	if j.Shares == nil {
+		j.Shares = []*RunShare{}
+	}
+	if err := validateShares(j.Shares); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), nil)
+		return
+	}
+	// the run must exist
+	if _, err := server.fetchMainLog(owner, runID); err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	previous, err := server.fetchRunShares(owner, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch shares: %w", err))
+		return
+	}
+	if err = server.storeRunShares(owner, runID, previous, j.Shares); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to store shares: %v", err), nil)
+		return
+	}
+	j.RunID, j.Owner = runID, owner
+	writeJSON(w, j)
+}
+
+//// s3 ////
+
+// fetchRunShares returns the run's shares - none if it has never been shared
+func (server *Server) fetchRunShares(owner, runID string) ([]*RunShare, error) {
+	body, _, err := server.FileManager.Get(fmt.Sprintf(pathToUserRunSharesf, owner, runID))
+	if err != nil {
+		if isNotFound(err) {
+			return []*RunShare{}, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+	shares := []*RunShare{}
+	if err = json.NewDecoder(body).Decode(&shares); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal shares: %v", err)
+	}
+	return shares, nil
+}
+
+// storeRunShares writes the run's shares and the markers of the shares,
+// and deletes the markers of previous shares which have been removed
+func (server *Server) storeRunShares(owner, runID string, previous, shares []*RunShare) error {
+	put := func(key string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return storage.PutBytes(server.FileManager, key, b)
+	}
+	if err := put(fmt.Sprintf(pathToUserRunSharesf, owner, runID), shares); err != nil {
+		return err
+	}
+	for _, share := range shares {
+		if err := put(shareMarkerKey(share, owner, runID), share); err != nil {
+			return err
+		}
+	}
+	return server.deleteShareMarkers(removedShareMarkers(previous, shares, owner, runID))
+}
+
+func (server *Server) deleteShareMarkers(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return server.FileManager.Delete(keys...)
+}
+
+// sharedRunSummaries returns a summary of every run shared with the user or one of the user's groups
+// markers of runs which have been deleted are skipped
+func (server *Server) sharedRunSummaries(userID string, groups []string) ([]*RunSummary, error) {
+	type runKey struct{ owner, runID string }
+	runs := []runKey{}
+	seen := make(map[runKey]bool)
+	prefixes := []string{fmt.Sprintf(pathToSharedRunsf, sharePrincipalUser, userID)}
+	for _, group := range groups {
+		prefixes = append(prefixes, fmt.Sprintf(pathToSharedRunsf, sharePrincipalGroup, group))
+	}
+	for _, prefix := range prefixes {
+		err := storage.Walk(server.FileManager, prefix, func(obj *storage.ObjectInfo) bool {
+			owner, runID, ok := sharedRunKey(obj.Key, prefix)
+			if k := (runKey{owner, runID}); ok && !seen[k] {
+				seen[k] = true
+				runs = append(runs, k)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	summaries := make([]*RunSummary, len(runs))
+	sem := make(chan struct{}, maxConcurrentLogFetches)
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, run runKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			runLog, err := server.fetchMainLog(run.owner, run.runID)
+			switch {
+			case err == nil:
+				summaries[i] = runSummary(run.runID, runLog)
+			case isNotFound(err):
+				return
+			default:
+				summaries[i] = &RunSummary{RunID: run.runID, Status: unknown}
+			}
+			summaries[i].UserID = run.owner
+		}(i, run)
+	}
+	wg.Wait()
+
+	found := []*RunSummary{}
+	for _, s := range summaries {
+		if s != nil {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// scopedRunSummaries returns the summaries of the caller's own runs, or of the runs shared with the caller
+func (server *Server) scopedRunSummaries(r *http.Request, scope string) ([]*RunSummary, error) {
+	userID := server.userID(r)
+	if scope != runScopeShared {
+		return server.runSummaries(userID)
+	}
+	groups, err := server.authorizer.Groups(bearerToken(r), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the user's groups: %v", err)
+	}
+	return server.sharedRunSummaries(userID, groups)
+}
@@ -0,0 +1,100 @@
+package mariner
+
+import (
+	"testing"
+)
+
+func TestValidateShares(t *testing.T) {
+	shares := []*RunShare{
+		{User: "bob", Actions: []string{shareRerun, shareCancel, shareRerun}},
+		{Group: "lab"},
+		{User: "lab", Actions: []string{shareRead}},
+	}
+	if err := validateShares(shares); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !equalStrings(shares[0].Actions, []string{shareCancel, shareRead, shareRerun}) {
+		t.Errorf("wrong actions: %v", shares[0].Actions)
+	}
+	if !equalStrings(shares[1].Actions, []string{shareRead}) {
+		t.Errorf("wrong actions: %v", shares[1].Actions)
+	}
+
+	invalid := [][]*RunShare{
+		{{Actions: []string{shareRead}}},
+		{{User: "bob", Group: "lab"}},
+		{{User: "bob", Actions: []string{"delete"}}},
+		{{User: "bob/../alice"}},
+		{{User: "bob"}, {User: "bob", Actions: []string{shareCancel}}},
+	}
+	for _, shares := range invalid {
+		if err := validateShares(shares); err == nil {
+			t.Errorf("expected an error for %+v", shares[0])
+		}
+	}
+}
+
+func TestSharesAllow(t *testing.T) {
+	shares := []*RunShare{
+		{User: "bob", Actions: []string{shareRead}},
+		{Group: "lab", Actions: []string{shareRead, shareCancel, shareRerun}},
+	}
+	cases := []struct {
+		user    string
+		groups  []string
+		action  string
+		allowed bool
+	}{
+		{"bob", nil, authzRead, true},
+		{"bob", nil, authzCancel, false},
+		{"bob", []string{"lab"}, authzCancel, true},
+		{"carol", []string{"lab"}, authzSubmit, true},
+		{"carol", []string{"lab"}, authzDelete, false},
+		{"carol", []string{"lab"}, authzShare, false},
+		{"carol", []string{"other"}, authzRead, false},
+	}
+	for _, c := range cases {
+		if allowed := sharesAllow(shares, c.user, c.groups, c.action); allowed != c.allowed {
+			t.Errorf("%v %v %v: expected %v, got %v", c.user, c.groups, c.action, c.allowed, allowed)
+		}
+	}
+}
+
+func TestShareMarkers(t *testing.T) {
+	previous := []*RunShare{{User: "bob"}, {Group: "lab"}}
+	shares := []*RunShare{{Group: "lab", Actions: []string{shareCancel}}, {User: "carol"}}
+	removed := removedShareMarkers(previous, shares, "alice", "run-1")
+	if !equalStrings(removed, []string{"sharedRuns/user/bob/alice/run-1"}) {
+		t.Errorf("wrong removed markers: %v", removed)
+	}
+	if len(removedShareMarkers(previous, nil, "alice", "run-1")) != 2 {
+		t.Error("expected every marker removed")
+	}
+
+	prefix := "sharedRuns/group/lab/"
+	if owner, runID, ok := sharedRunKey(prefix+"alice/run-1", prefix); !ok || owner != "alice" || runID != "run-1" {
+		t.Errorf("wrong shared run: %v %v %v", owner, runID, ok)
+	}
+	for _, key := range []string{prefix + "alice", prefix + "alice/run-1/x", prefix + "/run-1"} {
+		if _, _, ok := sharedRunKey(key, prefix); ok {
+			t.Errorf("expected %v not to be a shared run", key)
+		}
+	}
+}
+
+func TestStaticAuthorizerGroups(t *testing.T) {
+	a, err := newAuthorizer(AuthzConfig{Driver: authzDriverStatic, Groups: map[string][]string{
+		"lab":    {"alice", "bob"},
+		"admins": {"alice"},
+		"other":  {"carol"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to make authorizer: %v", err)
+	}
+	if groups, _ := a.Groups("", "alice"); !equalStrings(groups, []string{"admins", "lab"}) {
+		t.Errorf("wrong groups: %v", groups)
+	}
+	if groups, _ := a.Groups("", "dave"); len(groups) != 0 {
+		t.Errorf("wrong groups: %v", groups)
+	}
+}
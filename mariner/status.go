@@ -0,0 +1,206 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains the service-info and health check endpoints
+//
+// GET /service-info - what this deployment of mariner runs and how: version, cwl support, storage, executor, default resources
+// GET /_status      - the health of mariner's dependencies: the k8s API, s3, wts, and arborist if it's the authorizer
+//
+// both are served without auth, so they can be used by probes and by clients before they log in
+
+const (
+	wtsHealthURL = "http://workspace-token-service/_status"
+
+	// how long each dependency gets to answer a health check
+	dependencyCheckTimeout = 3 * time.Second
+
+	statusOK        = "ok"
+	statusUnhealthy = "unhealthy"
+)
+
+// cwl requirements mariner handles - see k8s.go, tool.go, command.go, scatter.go
+var supportedRequirements = []string{
+	CWLDockerRequirement,
+	CWLEnvVarRequirement,
+	CWLInitialWorkDirRequirement,
+	"InlineJavascriptRequirement",
+	CWLResourceRequirement,
+	"ScatterFeatureRequirement",
+	"ShellCommandRequirement",
+	"StepInputExpressionRequirement",
+	"SubworkflowFeatureRequirement",
+}
+
+// endpoints which are served without auth
+var publicPaths = []string{"/_status", "/service-info"}
+
+// MarinerServiceInfo ..
+type MarinerServiceInfo struct {
+	Version          string                `json:"version"`
+	CWLVersions      []string              `json:"cwlVersions"`
+	Requirements     []string              `json:"requirements"`
+	Storage          []*StorageBackend     `json:"storage"`
+	Executor         *ExecutorBackend      `json:"executor"`
+	DefaultResources map[string]*Resources `json:"defaultResources"` // by container: engine, task, s3sidecar, gen3fuse
+	RunIndex         string                `json:"runIndex,omitempty"`
+	WESBasePath      string                `json:"wesBasePath"`
+}
+
+// StorageBackend ..
+type StorageBackend struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+func storageBackend(conf Storage) *StorageBackend {
+	if conf.driver() == storageDriverLocal {
+		return &StorageBackend{Type: storageDriverLocal, Name: conf.Local.Root}
+	}
+	return &StorageBackend{Type: storageDriverS3, Name: conf.S3.Name, Region: conf.S3.Region, Endpoint: conf.S3.Endpoint}
+}
+
+// ExecutorBackend ..
+type ExecutorBackend struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+}
+
+// HealthJSON ..
+type HealthJSON struct {
+	Status       string                       `json:"status"`
+	Version      string                       `json:"version"`
+	Dependencies map[string]*DependencyStatus `json:"dependencies"`
+}
+
+// DependencyStatus ..
+type DependencyStatus struct {
+	Healthy   bool   `json:"healthy"`
+	LatencyMS int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dependencyCheck returns nil if the dependency is reachable and healthy
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func serviceInfo() *MarinerServiceInfo {
+	requirements := append([]string{}, supportedRequirements...)
+	sort.Strings(requirements)
+	return &MarinerServiceInfo{
+		Version:      Version,
+		CWLVersions:  supportedCWLVersions,
+		Requirements: requirements,
+		Storage:      []*StorageBackend{storageBackend(Config.Storage)},
+		Executor:     &ExecutorBackend{Type: "kubernetes", Namespace: os.Getenv("GEN3_NAMESPACE")},
+		DefaultResources: map[string]*Resources{
+			marinerEngine: &Config.Containers.Engine.Resources,
+			marinerTask:   &Config.Containers.Task.Resources,
+			s3sidecar:     &Config.Containers.S3sidecar.Resources,
+			gen3fuse:      &Config.Containers.Gen3fuse.Resources,
+		},
+		RunIndex:    Config.RunIndex.Driver,
+		WESBasePath: wesBasePath,
+	}
+}
+
+// checkDependencies runs the checks concurrently, each with its own timeout
+func checkDependencies(ctx context.Context, checks []*dependencyCheck) *HealthJSON {
+	j := &HealthJSON{Status: statusOK, Version: Version, Dependencies: make(map[string]*DependencyStatus)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c *dependencyCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(checkCtx)
+			status := &DependencyStatus{Healthy: err == nil, LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				status.Error = err.Error()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			j.Dependencies[c.name] = status
+			if err != nil {
+				j.Status = statusUnhealthy
+			}
+		}(c)
+	}
+	wg.Wait()
+	return j
+}
+
+func (server *Server) dependencyChecks() []*dependencyCheck {
+	checks := []*dependencyCheck{
+		{name: "kubernetes", check: checkKubernetes},
+		{name: Config.Storage.driver(), check: server.checkStorage},
+		{name: "wts", check: func(ctx context.Context) error { return checkHTTP(ctx, wtsHealthURL) }},
+	}
+	if arborist, ok := server.authorizer.(*ArboristAuthorizer); ok {
+		checks = append(checks, &dependencyCheck{name: "arborist", check: func(ctx context.Context) error { return checkHTTP(ctx, arborist.URL+"/health") }})
+	}
+	return checks
+}
+
+func checkKubernetes(ctx context.Context) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	_, err = jobsClient.List(ctx, metav1.ListOptions{Limit: 1})
+	return err
+}
+
+func (server *Server) checkStorage(ctx context.Context) error {
+	return server.FileManager.Check(ctx)
+}
+
+func checkHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", url, resp.Status)
+	}
+	return nil
+}
+
+//// handlers ////
+
+// '/service-info' - GET
+func (server *Server) handleServiceInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, serviceInfo())
+}
+
+// '/_status' - GET
+// 200 if every dependency is healthy, 503 otherwise
+func (server *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	j := checkDependencies(r.Context(), server.dependencyChecks())
+	if j.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, j)
+}
@@ -0,0 +1,54 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	healthy := func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return fmt.Errorf("no timeout on check")
+		}
+		return nil
+	}
+	down := func(ctx context.Context) error { return fmt.Errorf("connection refused") }
+
+	j := checkDependencies(context.Background(), []*dependencyCheck{
+		{name: "a", check: healthy},
+		{name: "b", check: healthy},
+	})
+	if j.Status != statusOK || len(j.Dependencies) != 2 || !j.Dependencies["a"].Healthy || !j.Dependencies["b"].Healthy {
+		t.Errorf("expected all healthy: %+v", j)
+	}
+
+	j = checkDependencies(context.Background(), []*dependencyCheck{
+		{name: "a", check: healthy},
+		{name: "b", check: down},
+	})
+	if j.Status != statusUnhealthy || !j.Dependencies["a"].Healthy || j.Dependencies["b"].Healthy || j.Dependencies["b"].Error != "connection refused" {
+		t.Errorf("expected b unhealthy: %+v", j)
+	}
+}
+
+func TestCheckHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	if err := checkHTTP(context.Background(), ts.URL+"/health"); err != nil {
+		t.Errorf("expected healthy: %v", err)
+	}
+	if err := checkHTTP(context.Background(), ts.URL+"/broken"); err == nil {
+		t.Error("expected an error for a 500 response")
+	}
+	ts.Close()
+	if err := checkHTTP(context.Background(), ts.URL+"/health"); err == nil {
+		t.Error("expected an error for an unreachable service")
+	}
+}
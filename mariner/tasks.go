@@ -0,0 +1,611 @@
+package mariner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains the task-level endpoints
+//
+// a task is identified by its step ID, e.g., "#main/align" (URL-encoded as "%23main/align")
+// the leading '#' may be left out
+// a scatter subtask is identified by the step ID and its scatter index, e.g., "#main/align[3]"
+//
+// cancel and retry requests are passed from the server to the engine through s3 (see pathToUserTaskControlf)
+// since the engine owns the task jobs - the engine picks them up while it waits on the task job
+// - cancel: the job is deleted and the task is marked cancelled
+// - retry:  the job is deleted and the task is dispatched again, in a new job
+//
+// a failed task job fails its task, and so the run, unless the request sets 'retryWait', e.g., "30m" -
+// then the failed task waits that long for a retry or cancel request before it fails
+// a failed or cancelled task's downstream steps are skipped - they end up cancelled -
+// and the run ends failed if any task failed, else cancelled
+
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+
+	maxTailLines   = 10000
+	tailChunkBytes = 64 << 10
+
+	taskCancel = "cancel"
+	taskRetry  = "retry"
+
+	// how often the engine checks the task job and the task control requests
+	taskPollInterval = 5 * time.Second
+
+	// the longest a failed task may wait for a retry or cancel request
+	maxRetryWait = 24 * time.Hour
+)
+
+var (
+	// errTaskCancelled is returned by listenForDone when the task was cancelled by request
+	errTaskCancelled = errors.New("task cancelled")
+	// errTaskFailed is returned by listenForDone when the task job failed and wasn't retried
+	errTaskFailed = errors.New("task failed")
+)
+
+// retryWait returns how long a failed task of the run waits for a retry or cancel request - 0 if it fails right away
+func retryWait(request *WorkflowRequest) (time.Duration, error) {
+	if request == nil || request.RetryWait == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(request.RetryWait)
+	if err != nil || wait < 0 || wait > maxRetryWait {
+		return 0, fmt.Errorf("retryWait must be a duration between 0s and %v, e.g., \"30m\": %v", maxRetryWait, request.RetryWait)
+	}
+	return wait, nil
+}
+
+// TaskSummary is the listing entry for one task or scatter subtask
+type TaskSummary struct {
+	TaskID         string  `json:"taskID"`
+	Parent         string  `json:"parent,omitempty"` // for scatter subtasks, the ID of the scatter task
+	Status         string  `json:"status"`
+	Created        string  `json:"created,omitempty"`
+	LastUpdated    string  `json:"lastUpdated,omitempty"`
+	Duration       float64 `json:"duration"`
+	JobName        string  `json:"jobName,omitempty"`
+	ContainerImage string  `json:"containerImage,omitempty"`
+	CPURequest     int64   `json:"cpuReq,omitempty"`
+	MemoryRequest  int64   `json:"memReq,omitempty"`
+	PeakCPU        int64   `json:"peakCPU,omitempty"`
+	PeakMemory     int64   `json:"peakMem,omitempty"`
+	NFailures      int     `json:"nfailures"`
+	NRetries       int     `json:"nretries"`
+	NSubtasks      int     `json:"nsubtasks,omitempty"`
+}
+
+// TaskListJSON ..
+type TaskListJSON struct {
+	Tasks         []*TaskSummary `json:"tasks"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// TaskJSON is the summary of a task along with its full log
+type TaskJSON struct {
+	*TaskSummary
+	Log *Log `json:"log"`
+}
+
+// TaskActionJSON ..
+type TaskActionJSON struct {
+	RunID  string `json:"runID"`
+	TaskID string `json:"taskID"`
+	Action string `json:"action"`
+	Result string `json:"result"`
+}
+
+// TaskControl is a cancel or retry request for a task
+type TaskControl struct {
+	Action    string `json:"action"`
+	Requested string `json:"requested"`
+}
+
+// findTaskLog returns the log of the given task from the run log
+func findTaskLog(runLog *MainLog, taskID string) (*Log, bool) {
+	scatterIndex := -1
+	if i := strings.LastIndex(taskID, "["); i > 0 && strings.HasSuffix(taskID, "]") {
+		n, err := strconv.Atoi(taskID[i+1 : len(taskID)-1])
+		if err != nil {
+			return nil, false
+		}
+		taskID, scatterIndex = taskID[:i], n
+	}
+	task, ok := runLog.ByProcess[taskID]
+	if !ok && !strings.HasPrefix(taskID, "#") {
+		task, ok = runLog.ByProcess["#"+taskID]
+	}
+	if !ok {
+		return nil, false
+	}
+	if scatterIndex < 0 {
+		return task, true
+	}
+	subtask, ok := task.Scatter[scatterIndex]
+	return subtask, ok
+}
+
+func taskSummary(taskID string, log *Log) *TaskSummary {
+	s := &TaskSummary{
+		TaskID:         taskID,
+		Status:         log.Status,
+		Created:        log.Created,
+		LastUpdated:    log.LastUpdated,
+		JobName:        log.JobName,
+		ContainerImage: log.ContainerImage,
+		NSubtasks:      len(log.Scatter),
+	}
+	if stats := log.Stats; stats != nil {
+		s.Duration = stats.Duration
+		s.CPURequest = stats.CPUReq.Min
+		s.MemoryRequest = stats.MemoryReq.Min
+		s.NFailures = stats.NFailures
+		s.NRetries = stats.NRetries
+		for _, p := range stats.ResourceUsage.Series {
+			if p.CPU > s.PeakCPU {
+				s.PeakCPU = p.CPU
+			}
+			if p.Memory > s.PeakMemory {
+				s.PeakMemory = p.Memory
+			}
+		}
+	}
+	return s
+}
+
+// taskSummaries lists every task of the run, scatter subtasks included, ordered by task ID
+func taskSummaries(runLog *MainLog) []*TaskSummary {
+	tasks := []*TaskSummary{}
+	for taskID, log := range runLog.ByProcess {
+		tasks = append(tasks, taskSummary(taskID, log))
+		for i, subtask := range log.Scatter {
+			s := taskSummary(scatterProcess(taskID, i), subtask)
+			s.Parent = taskID
+			tasks = append(tasks, s)
+		}
+	}
+	sort.Slice(tasks, func(i, k int) bool {
+		return tasks[i].TaskID < tasks[k].TaskID
+	})
+	return tasks
+}
+
+// listTaskSummaries filters the tasks by status and returns the requested page
+// the page token is the ID of the last task on the previous page
+func listTaskSummaries(tasks []*TaskSummary, states map[string]bool, pageSize int, pageToken string) (page []*TaskSummary, nextPageToken string) {
+	matches := []*TaskSummary{}
+	for _, t := range tasks {
+		if (len(states) == 0 || states[t.Status]) && t.TaskID > pageToken {
+			matches = append(matches, t)
+		}
+	}
+	if len(matches) <= pageSize {
+		return matches, ""
+	}
+	return matches[:pageSize], matches[pageSize-1].TaskID
+}
+
+//// handlers ////
+
+// '/runs/{runID}/tasks' - GET
+// takes the 'state', 'page_size' and 'page_token' query parameters of the '/runs' listing - see runs.go
+func (server *Server) handleTasksGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	filter, err := runFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	// task page tokens are task IDs, not run cursors
+	pageToken := ""
+	if token := r.URL.Query().Get("page_token"); token != "" {
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid page_token: %v", token), nil)
+			return
+		}
+		pageToken = string(b)
+	}
+	j := &TaskListJSON{}
+	j.Tasks, j.NextPageToken = listTaskSummaries(taskSummaries(runLog), filter.States, filter.PageSize, pageToken)
+	if j.NextPageToken != "" {
+		j.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(j.NextPageToken))
+	}
+	writeJSON(w, j)
+}
+
+// '/runs/{runID}/tasks/{taskID}' - GET
+func (server *Server) handleTaskGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	taskID := mux.Vars(r)["taskID"]
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	task, ok := findTaskLog(runLog, taskID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no such task: %v", taskID), nil)
+		return
+	}
+	writeJSON(w, &TaskJSON{TaskSummary: taskSummary(task.Event.process, task), Log: task})
+}
+
+// '/runs/{runID}/tasks/{taskID}/cancel' - POST
+func (server *Server) handleTaskCancelPOST(w http.ResponseWriter, r *http.Request) {
+	server.requestTaskAction(w, r, taskCancel)
+}
+
+// '/runs/{runID}/tasks/{taskID}/retry' - POST
+func (server *Server) handleTaskRetryPOST(w http.ResponseWriter, r *http.Request) {
+	server.requestTaskAction(w, r, taskRetry)
+}
+
+func (server *Server) requestTaskAction(w http.ResponseWriter, r *http.Request, action string) {
+	userID, runID := server.uniqueKey(r)
+	taskID := mux.Vars(r)["taskID"]
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	task, ok := findTaskLog(runLog, taskID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no such task: %v", taskID), nil)
+		return
+	}
+	if err := taskActionAllowed(runLog, task, action); err != nil {
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error(), nil)
+		return
+	}
+	process := task.Event.process
+	if err := server.writeTaskControl(userID, runID, process, &TaskControl{Action: action, Requested: ts()}); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStorage, fmt.Sprintf("failed to write %v request: %v", action, err), nil)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, &TaskActionJSON{RunID: runID, TaskID: process, Action: action, Result: "requested"})
+}
+
+func taskActionAllowed(runLog *MainLog, task *Log, action string) error {
+	if finalStatus(runLog.Main.Status) {
+		return fmt.Errorf("run is already %v", runLog.Main.Status)
+	}
+	if len(task.Scatter) > 0 {
+		return fmt.Errorf("can't %v a scatter task - %v its subtasks instead", action, action)
+	}
+	switch action {
+	case taskCancel:
+		if task.Status == completed || task.Status == cancelled {
+			return fmt.Errorf("task is already %v", task.Status)
+		}
+	case taskRetry:
+		if task.Status != running && task.Status != failed {
+			return fmt.Errorf("only a running or failed task can be retried - task is %v", task.Status)
+		}
+		if wait, _ := retryWait(runLog.Request); task.Status == failed && wait == 0 {
+			return fmt.Errorf("the run doesn't wait for retries of failed tasks - see retryWait")
+		}
+	}
+	return nil
+}
+
+// '/runs/{runID}/tasks/{taskID}/logs' - GET
+//
+// returns the captured console output of the task container as text
+// - stream: "stdout" (default) or "stderr"
+// - tail:   return only the last n lines
+// - the Range header is supported too, e.g., "Range: bytes=1024-"
+//
+// output is uploaded when the task finishes, so it's not available for a running task
+func (server *Server) handleTaskLogsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	taskID := mux.Vars(r)["taskID"]
+
+	stream := r.URL.Query().Get("stream")
+	switch stream {
+	case "":
+		stream = stdoutStream
+	case stdoutStream, stderrStream:
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid stream, expected 'stdout' or 'stderr': %v", stream), nil)
+		return
+	}
+	tail := 0
+	if s := r.URL.Query().Get("tail"); s != "" {
+		var err error
+		if tail, err = strconv.Atoi(s); err != nil || tail < 1 || tail > maxTailLines {
+			writeError(w, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("invalid tail, expected 1 to %v lines: %v", maxTailLines, s), nil)
+			return
+		}
+	}
+	if tail > 0 && r.Header.Get("Range") != "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, "tail and Range can't be used together", nil)
+		return
+	}
+
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	task, ok := findTaskLog(runLog, taskID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no such task: %v", taskID), nil)
+		return
+	}
+	if task.WorkingDir == "" || task.ContainerImage == "" {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("task %v has no container output", taskID), nil)
+		return
+	}
+
+	file := taskStdoutFile
+	if stream == stderrStream {
+		file = taskStderrFile
+	}
+	key := strings.TrimPrefix(server.FileManager.s3Key(taskLogDir(task.WorkingDir)+file, userID), "/")
+	if tail > 0 {
+		b, err := tailObject(server.FileManager, key, tail)
+		if err != nil {
+			writeTaskLogError(w, taskID, task, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+		return
+	}
+
+	info, err := server.FileManager.Stat(key)
+	if err != nil {
+		writeTaskLogError(w, taskID, task, err)
+		return
+	}
+	offset, length, ranged, err := byteRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		writeTaskLogError(w, taskID, task, err)
+		return
+	}
+	var body io.ReadCloser
+	if ranged {
+		body, _, err = server.FileManager.GetRange(key, offset, length)
+	} else {
+		body, info, err = server.FileManager.Get(key)
+		length = info.Size
+	}
+	if err != nil {
+		writeTaskLogError(w, taskID, task, err)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, offset+length-1, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	io.Copy(w, body)
+}
+
+// byteRange parses a Range header - "bytes=a-b", "bytes=a-" or "bytes=-n" - for an object of the given size
+// ranged is false if there's no header, or it isn't a single byte range - the whole object is served then
+// an error means the range doesn't overlap the object
+func byteRange(header string, size int64) (offset, length int64, ranged bool, err error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	i := strings.Index(spec, "-")
+	if spec == header || i < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	unsatisfiable := fmt.Errorf("%w: %v of %v bytes", storage.ErrInvalidRange, header, size)
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, unsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+	offset, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < offset {
+			return 0, 0, false, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if offset >= size {
+		return 0, 0, false, unsatisfiable
+	}
+	return offset, end - offset + 1, true, nil
+}
+
+func writeTaskLogError(w http.ResponseWriter, taskID string, task *Log, err error) {
+	switch {
+	case errors.Is(err, storage.ErrInvalidRange):
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, errCodeInvalidQuery, fmt.Sprintf("invalid range: %v", err), nil)
+	case isNotFound(err) && !finalStatus(task.Status):
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("output of task %v is available once the task finishes", taskID), nil)
+	default:
+		writeStorageError(w, fmt.Errorf("failed to fetch output of task %v: %w", taskID, err))
+	}
+}
+
+// tailObject returns the last n lines of the object
+// fetching bigger and bigger chunks from the end of the object until there are enough lines
+func tailObject(s storage.Storage, key string, n int) ([]byte, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size
+	if size == 0 {
+		return []byte{}, nil
+	}
+	for chunk := int64(tailChunkBytes); ; chunk *= 4 {
+		start := size - chunk
+		if start < 0 {
+			start = 0
+		}
+		body, _, err := s.GetRange(key, start, size-start)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		_, err = io.Copy(buf, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b := buf.Bytes()
+		if start == 0 || bytes.Count(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) >= n {
+			return lastLines(b, n), nil
+		}
+	}
+}
+
+// lastLines returns the last n lines of b
+func lastLines(b []byte, n int) []byte {
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end--
+	}
+	i := end
+	for ; n > 0; n-- {
+		i = bytes.LastIndexByte(b[:i], '\n')
+		if i < 0 {
+			return b
+		}
+	}
+	return b[i+1:]
+}
+
+//// task control ////
+
+func taskControlKey(userID, runID, process string) string {
+	return fmt.Sprintf(pathToUserTaskControlf, userID, runID, url.PathEscape(process))
+}
+
+func (server *Server) writeTaskControl(userID, runID, process string, control *TaskControl) error {
+	b, err := json.Marshal(control)
+	if err != nil {
+		return err
+	}
+	return storage.PutBytes(server.FileManager, taskControlKey(userID, runID, process), b)
+}
+
+// taskControl returns the pending cancel or retry request for the task, if any
+func (engine *K8sEngine) taskControl(task *Task) (*TaskControl, error) {
+	body, _, err := engine.FileManager.Get(taskControlKey(engine.UserID, engine.RunID, task.Log.Event.process))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+	control := &TaskControl{}
+	if err = json.NewDecoder(body).Decode(control); err != nil {
+		return nil, err
+	}
+	return control, nil
+}
+
+func (engine *K8sEngine) clearTaskControl(task *Task) error {
+	return engine.FileManager.Delete(taskControlKey(engine.UserID, engine.RunID, task.Log.Event.process))
+}
+
+// handleTaskControl carries out a pending cancel or retry request for the tool's task
+// returns errTaskCancelled if the task got cancelled
+func (engine *K8sEngine) handleTaskControl(tool *Tool) error {
+	task := tool.Task
+	control, err := engine.taskControl(task)
+	if err != nil {
+		engine.warnf("failed to check for task control requests: %v; error: %v", task.Root.ID, err)
+		return nil
+	}
+	if control == nil {
+		return nil
+	}
+	if err = engine.clearTaskControl(task); err != nil {
+		engine.warnf("failed to clear task control request: %v; error: %v", task.Root.ID, err)
+	}
+
+	if control.Action != taskCancel && control.Action != taskRetry {
+		engine.warnf("unknown task control action: %v", control.Action)
+		return nil
+	}
+
+	task.infof("%v requested at %v", control.Action, control.Requested)
+	if err = engine.deleteTaskJob(tool); err != nil {
+		return engine.errorf("failed to delete task job: %v; error: %v", task.Root.ID, err)
+	}
+	switch control.Action {
+	case taskCancel:
+		task.Log.setStatus(cancelled)
+		engine.infof("cancelled task: %v", task.Root.ID)
+		return errTaskCancelled
+	case taskRetry:
+		task.Log.Stats.NRetries++
+		if err = engine.dispatchTaskJob(tool); err != nil {
+			return engine.errorf("failed to dispatch task job for retry: %v; error: %v", task.Root.ID, err)
+		}
+		task.Log.setStatus(running)
+		engine.infof("retrying task: %v", task.Root.ID)
+	}
+	return nil
+}
+
+// deleteTaskJob deletes the job of the task and its pvc
+func (engine *K8sEngine) deleteTaskJob(tool *Tool) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	propagation := metav1.DeletePropagationBackground
+	err = jobsClient.Delete(context.TODO(), tool.JobName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	if err = engine.deletePVC(tool); err != nil && !k8serrors.IsNotFound(err) {
+		engine.warnf("failed to delete pvc for tool: %v", tool.Task.Root.ID)
+	}
+	if err = engine.deleteTaskTokenSecret(tool); err != nil {
+		engine.warnf("failed to delete token secret for tool: %v", tool.Task.Root.ID)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package mariner
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFindTaskLog(t *testing.T) {
+	runLog := mainLog("")
+	task, subtask := logger(), logger()
+	task.Scatter = map[int]*Log{2: subtask}
+	runLog.ByProcess["#main/align"] = task
+
+	cases := map[string]*Log{
+		"#main/align":    task,
+		"main/align":     task,
+		"#main/align[2]": subtask,
+		"#main/align[3]": nil,
+		"#main/align[x]": nil,
+		"#main/sort":     nil,
+	}
+	for taskID, expected := range cases {
+		log, ok := findTaskLog(runLog, taskID)
+		if ok != (expected != nil) || log != expected {
+			t.Errorf("task '%v': wrong log returned", taskID)
+		}
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	cases := []struct {
+		in       string
+		n        int
+		expected string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 3, "a\nb\nc\n"},
+		{"a\nb\nc\n", 10, "a\nb\nc\n"},
+		{"a\n\nc\n", 2, "\nc\n"},
+		{"", 1, ""},
+	}
+	for _, c := range cases {
+		if got := string(lastLines([]byte(c.in), c.n)); got != c.expected {
+			t.Errorf("last %v lines of %q: expected %q, got %q", c.n, c.in, c.expected, got)
+		}
+	}
+}
+
+func TestTaskSummaries(t *testing.T) {
+	runLog := mainLog("")
+	align, sort, subtask := logger(), logger(), logger()
+	align.Status, sort.Status, subtask.Status = running, completed, failed
+	align.Stats.ResourceUsage.Series = ResourceUsageSeries{{CPU: 2, Memory: 10}, {CPU: 5, Memory: 4}}
+	sort.Scatter = map[int]*Log{0: subtask}
+	runLog.ByProcess["#main/align"] = align
+	runLog.ByProcess["#main/sort"] = sort
+
+	tasks := taskSummaries(runLog)
+	ids := []string{}
+	for _, task := range tasks {
+		ids = append(ids, task.TaskID)
+	}
+	if expected := []string{"#main/align", "#main/sort", "#main/sort[0]"}; !equalStrings(ids, expected) {
+		t.Fatalf("expected tasks %v, got %v", expected, ids)
+	}
+	if tasks[0].PeakCPU != 5 || tasks[0].PeakMemory != 10 {
+		t.Errorf("wrong peak usage: %+v", tasks[0])
+	}
+	if tasks[1].NSubtasks != 1 || tasks[2].Parent != "#main/sort" {
+		t.Errorf("wrong scatter summaries: %+v, %+v", tasks[1], tasks[2])
+	}
+
+	page, next := listTaskSummaries(tasks, nil, 2, "")
+	if len(page) != 2 || next != "#main/sort" {
+		t.Fatalf("wrong first page: %v tasks, next page token %q", len(page), next)
+	}
+	if page, next = listTaskSummaries(tasks, nil, 2, next); len(page) != 1 || page[0].TaskID != "#main/sort[0]" || next != "" {
+		t.Errorf("wrong last page: %v tasks, next page token %q", len(page), next)
+	}
+	if page, _ = listTaskSummaries(tasks, map[string]bool{failed: true}, 2, ""); len(page) != 1 || page[0].TaskID != "#main/sort[0]" {
+		t.Errorf("wrong filtered page: %v", page)
+	}
+}
+
+func TestTaskActionAllowed(t *testing.T) {
+	runLog := mainLog("")
+	runLog.Main.Status = running
+	runLog.Request = &WorkflowRequest{RetryWait: "30m"}
+	task := logger()
+	cases := []struct {
+		status  string
+		action  string
+		allowed bool
+	}{
+		{running, taskCancel, true},
+		{notStarted, taskCancel, true},
+		{completed, taskCancel, false},
+		{running, taskRetry, true},
+		{failed, taskRetry, true},
+		{notStarted, taskRetry, false},
+		{cancelled, taskRetry, false},
+	}
+	for _, c := range cases {
+		task.Status = c.status
+		if err := taskActionAllowed(runLog, task, c.action); (err == nil) != c.allowed {
+			t.Errorf("%v a %v task: expected allowed=%v, got %v", c.action, c.status, c.allowed, err)
+		}
+	}
+
+	runLog.Request.RetryWait = ""
+	task.Status = failed
+	if err := taskActionAllowed(runLog, task, taskRetry); err == nil {
+		t.Errorf("retry of a failed task in a run without retryWait passed")
+	}
+
+	task.Status = running
+	task.Scatter = map[int]*Log{0: logger()}
+	if err := taskActionAllowed(runLog, task, taskCancel); err == nil {
+		t.Errorf("cancel of a scatter task passed")
+	}
+	task.Scatter = nil
+	runLog.Main.Status = completed
+	if err := taskActionAllowed(runLog, task, taskCancel); err == nil {
+		t.Errorf("cancel of a task in a finished run passed")
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	cases := []struct {
+		retryWait string
+		wait      time.Duration
+		valid     bool
+	}{
+		{"", 0, true},
+		{"0s", 0, true},
+		{"30m", 30 * time.Minute, true},
+		{"24h", 24 * time.Hour, true},
+		{"25h", 0, false},
+		{"-1m", 0, false},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		wait, err := retryWait(&WorkflowRequest{RetryWait: c.retryWait})
+		if (err == nil) != c.valid || wait != c.wait {
+			t.Errorf("retryWait %q: expected %v, valid=%v, got %v, %v", c.retryWait, c.wait, c.valid, wait, err)
+		}
+	}
+	if wait, err := retryWait(nil); wait != 0 || err != nil {
+		t.Errorf("no request: expected 0, got %v, %v", wait, err)
+	}
+}
+
+func TestSubtasksEndStatus(t *testing.T) {
+	step := func(status string) *Task {
+		task := &Task{Log: logger()}
+		task.Log.Status = status
+		return task
+	}
+	cases := []struct {
+		statuses []string
+		expected string
+	}{
+		{[]string{completed, completed}, ""},
+		{[]string{completed, cancelled}, cancelled},
+		{[]string{cancelled, failed, completed}, failed},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		workflow := &Task{Children: make(map[string]*Task)}
+		scatter := &Task{ScatterTasks: make(map[int]*Task)}
+		for i, status := range c.statuses {
+			workflow.Children[fmt.Sprint(i)] = step(status)
+			scatter.ScatterTasks[i] = step(status)
+		}
+		if status := workflow.subtasksEndStatus(); status != c.expected {
+			t.Errorf("steps %v: expected %q, got %q", c.statuses, c.expected, status)
+		}
+		if status := scatter.subtasksEndStatus(); status != c.expected {
+			t.Errorf("scattered subtasks %v: expected %q, got %q", c.statuses, c.expected, status)
+		}
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	cases := []struct {
+		header         string
+		offset, length int64
+		ranged, bad    bool
+	}{
+		{"", 0, 0, false, false},
+		{"bytes=0-99", 0, 100, true, false},
+		{"bytes=900-", 900, 100, true, false},
+		{"bytes=950-2000", 950, 50, true, false},
+		{"bytes=-10", 990, 10, true, false},
+		{"bytes=-5000", 0, 1000, true, false},
+		{"bytes=1000-", 0, 0, false, true},
+		{"bytes=-0", 0, 0, false, true},
+		{"bytes=0-9,20-29", 0, 0, false, false},
+		{"bytes=9-0", 0, 0, false, false},
+		{"lines=0-9", 0, 0, false, false},
+	}
+	for _, c := range cases {
+		offset, length, ranged, err := byteRange(c.header, 1000)
+		if (err != nil) != c.bad {
+			t.Errorf("'%v': unexpected error: %v", c.header, err)
+			continue
+		}
+		if offset != c.offset || length != c.length || ranged != c.ranged {
+			t.Errorf("'%v': expected %v, %v, %v - got %v, %v, %v", c.header, c.offset, c.length, c.ranged, offset, length, ranged)
+		}
+	}
+}
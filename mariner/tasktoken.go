@@ -0,0 +1,204 @@
+package mariner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains user access tokens for tasks
+//
+// by default tasks reach commons data only through gen3fuse and the manifest -
+// a run whose request has 'taskToken' also gets the user's access token in each of its task pods,
+// so that tools can call gen3 APIs or fetch DRS objects themselves:
+// - before creating a task job, the engine gets a token from wts - wts knows the user by the engine pod's annotation
+// - the token goes into a k8s secret, '<task job>-token', which is owned by the task job
+// - the task container gets the token in GEN3_ACCESS_TOKEN, and in the file named by GEN3_ACCESS_TOKEN_FILE,
+//   and the commons' hostname in GEN3_HOSTNAME
+// - the secret is deleted when the task finishes, or is cancelled or retried - otherwise k8s deletes it with the job
+//
+// the token expires after 'expiresIn' seconds - 1h by default, 24h at most - a retried task gets a new token
+
+const (
+	wtsTokenURL = "http://workspace-token-service/token/"
+
+	defaultTaskTokenExpiry = 3600
+	maxTaskTokenExpiry     = 86400
+
+	taskTokenSecretKey   = "token"
+	taskTokenVolumeName  = "user-token"
+	taskTokenMountPath   = "/mariner-token/"
+	taskTokenEnvVar      = "GEN3_ACCESS_TOKEN"
+	taskTokenFileEnvVar  = "GEN3_ACCESS_TOKEN_FILE"
+	taskHostnameEnvVar   = "GEN3_HOSTNAME"
+	taskTokenSecretLabel = "mariner-task-token"
+)
+
+// TaskTokenRequest asks for the user's access token in every task pod of the run
+type TaskTokenRequest struct {
+	ExpiresIn int `json:"expiresIn,omitempty"` // seconds
+}
+
+// WTSToken is the response of wts' token endpoint
+type WTSToken struct {
+	Token string `json:"token"`
+}
+
+func (t *TaskTokenRequest) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.ExpiresIn < 0 || t.ExpiresIn > maxTaskTokenExpiry {
+		return fmt.Errorf("taskToken.expiresIn must be between 1 and %v seconds, or 0 for the default of %v", maxTaskTokenExpiry, defaultTaskTokenExpiry)
+	}
+	return nil
+}
+
+func (t *TaskTokenRequest) expiry() int {
+	if t.ExpiresIn == 0 {
+		return defaultTaskTokenExpiry
+	}
+	return t.ExpiresIn
+}
+
+func taskTokenSecretName(jobName string) string {
+	return jobName + "-token"
+}
+
+// taskTokenSecret returns the spec of the secret holding the token of a task job
+func taskTokenSecret(jobName, userID, token string) *k8sv1.Secret {
+	return &k8sv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        taskTokenSecretName(jobName),
+			Labels:      map[string]string{"app": taskTokenSecretLabel},
+			Annotations: map[string]string{userAnnotation: userID},
+		},
+		Type:       k8sv1.SecretTypeOpaque,
+		StringData: map[string]string{taskTokenSecretKey: token},
+	}
+}
+
+// addTaskToken mounts the job's token secret into the named container of the job, and exposes it in its env
+func addTaskToken(job *batchv1.Job, containerName string) {
+	secretName := taskTokenSecretName(job.Name)
+	podSpec := &job.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes, k8sv1.Volume{
+		Name: taskTokenVolumeName,
+		VolumeSource: k8sv1.VolumeSource{
+			Secret: &k8sv1.SecretVolumeSource{SecretName: secretName},
+		},
+	})
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name != containerName {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, k8sv1.VolumeMount{
+			Name:      taskTokenVolumeName,
+			MountPath: taskTokenMountPath,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env,
+			k8sv1.EnvVar{
+				Name: taskTokenEnvVar,
+				ValueFrom: &k8sv1.EnvVarSource{
+					SecretKeyRef: &k8sv1.SecretKeySelector{
+						LocalObjectReference: k8sv1.LocalObjectReference{Name: secretName},
+						Key:                  taskTokenSecretKey,
+					},
+				},
+			},
+			k8sv1.EnvVar{Name: taskTokenFileEnvVar, Value: taskTokenMountPath + taskTokenSecretKey},
+			k8sv1.EnvVar{Name: taskHostnameEnvVar, ValueFrom: envVarHostname},
+		)
+	}
+}
+
+// fetchUserToken gets an access token for the user of this pod from wts
+func fetchUserToken(expiresIn int) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("%v?expires=%v", wtsTokenURL, expiresIn))
+	if err != nil {
+		return "", fmt.Errorf("failed to reach wts: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("wts returned %v", resp.Status)
+	}
+	t := &WTSToken{}
+	if err = json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return "", fmt.Errorf("failed to unmarshal wts token: %v", err)
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("wts returned no token")
+	}
+	return t.Token, nil
+}
+
+//// k8s ////
+
+// wantsTaskToken is true if the run's tasks get the user's token
+func (engine *K8sEngine) wantsTaskToken() bool {
+	return engine.Log.Request != nil && engine.Log.Request.TaskToken != nil
+}
+
+// createTaskTokenSecret gets a token for the user and stores it in the secret of the task job
+func (engine *K8sEngine) createTaskTokenSecret(tool *Tool) error {
+	token, err := fetchUserToken(engine.Log.Request.TaskToken.expiry())
+	if err != nil {
+		return fmt.Errorf("failed to get the user's token: %v", err)
+	}
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return err
+	}
+	_, err = coreClient.Secrets(os.Getenv("GEN3_NAMESPACE")).Create(context.TODO(), taskTokenSecret(tool.JobName, engine.UserID, token), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create token secret: %v", err)
+	}
+	tool.Task.infof("created token secret for task job %v", tool.JobName)
+	return nil
+}
+
+// ownTaskTokenSecret makes the job the owner of its token secret, so that k8s deletes the secret with the job
+func (engine *K8sEngine) ownTaskTokenSecret(job *batchv1.Job) error {
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return err
+	}
+	secrets := coreClient.Secrets(os.Getenv("GEN3_NAMESPACE"))
+	secret, err := secrets.Get(context.TODO(), taskTokenSecretName(job.Name), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	secret.OwnerReferences = append(secret.OwnerReferences, metav1.OwnerReference{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Name:       job.Name,
+		UID:        job.UID,
+	})
+	_, err = secrets.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteTaskTokenSecret deletes the token secret of the tool's job, if the run asked for tokens
+func (engine *K8sEngine) deleteTaskTokenSecret(tool *Tool) error {
+	if !engine.wantsTaskToken() || tool.JobName == "" {
+		return nil
+	}
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return err
+	}
+	err = coreClient.Secrets(os.Getenv("GEN3_NAMESPACE")).Delete(context.TODO(), taskTokenSecretName(tool.JobName), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package mariner
+
+import (
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+)
+
+func TestTaskTokenRequest(t *testing.T) {
+	var none *TaskTokenRequest
+	if err := none.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if expiry := (&TaskTokenRequest{}).expiry(); expiry != defaultTaskTokenExpiry {
+		t.Errorf("expected the default expiry, got %v", expiry)
+	}
+	if expiry := (&TaskTokenRequest{ExpiresIn: 600}).expiry(); expiry != 600 {
+		t.Errorf("expected 600, got %v", expiry)
+	}
+	for _, expiresIn := range []int{-1, maxTaskTokenExpiry + 1} {
+		if err := (&TaskTokenRequest{ExpiresIn: expiresIn}).validate(); err == nil {
+			t.Errorf("expected an error for expiresIn %v", expiresIn)
+		}
+	}
+}
+
+func TestAddTaskToken(t *testing.T) {
+	job := &batchv1.Job{}
+	job.Name = "task-1"
+	job.Spec.Template.Spec.Containers = []k8sv1.Container{{Name: "mariner-task"}, {Name: "gen3fuse"}}
+	addTaskToken(job, "mariner-task")
+
+	volumes := job.Spec.Template.Spec.Volumes
+	if len(volumes) != 1 || volumes[0].Secret == nil || volumes[0].Secret.SecretName != "task-1-token" {
+		t.Fatalf("wrong volumes: %+v", volumes)
+	}
+	task, sidecar := job.Spec.Template.Spec.Containers[0], job.Spec.Template.Spec.Containers[1]
+	if len(sidecar.Env) != 0 || len(sidecar.VolumeMounts) != 0 {
+		t.Errorf("expected only the task container to get the token")
+	}
+	if len(task.VolumeMounts) != 1 || task.VolumeMounts[0].MountPath != taskTokenMountPath || !task.VolumeMounts[0].ReadOnly {
+		t.Errorf("wrong volume mounts: %+v", task.VolumeMounts)
+	}
+	env := make(map[string]k8sv1.EnvVar)
+	for _, v := range task.Env {
+		env[v.Name] = v
+	}
+	if ref := env[taskTokenEnvVar].ValueFrom; ref == nil || ref.SecretKeyRef.Name != "task-1-token" || ref.SecretKeyRef.Key != taskTokenSecretKey {
+		t.Errorf("wrong token env var: %+v", env[taskTokenEnvVar])
+	}
+	if env[taskTokenFileEnvVar].Value != "/mariner-token/token" {
+		t.Errorf("wrong token file: %v", env[taskTokenFileEnvVar].Value)
+	}
+
+	secret := taskTokenSecret("task-1", "alice", "abc")
+	if secret.Name != "task-1-token" || secret.StringData[taskTokenSecretKey] != "abc" || secret.Annotations[userAnnotation] != "alice" {
+		t.Errorf("wrong secret: %+v", secret)
+	}
+}
@@ -1,78 +1,198 @@
 package mariner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/uc-cdis/go-authutils/authutils"
+)
+
+// this file contains authentication
+//
+// every request, except to the public endpoints (see status.go), must carry an access token from fence as a bearer token:
+// - the token's signature is checked against the JWKS, then its claims - expiry, issuer, audience and purpose
+// - the user named by the token is stored in the request's context - see userID
+// - wts is asked, on the user's behalf, whether the user is connected - the run's tasks get their tokens from wts
+//
+// a missing, malformed or expired token gets 401, a user who isn't connected to wts gets 403
+// what the user may do is checked by each endpoint - see authz.go
+
+const (
+	wtsConnectedURL = "http://workspace-token-service/oauth2/connected"
+	wtsTimeout      = 10 * time.Second
+
+	// the default issuer is the JWKS endpoint without this suffix, e.g., https://<hostname>/user
+	jwksPathSuffix = "/.well-known/jwks"
+
+	tokenPurpose = "access"
 )
 
+var (
+	defaultTokenAudiences = []string{"openid"}
+
+	errMissingToken = errors.New("no token in Authorization header")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// tokenContextKey is the key of the request context's TokenInfo
+type tokenContextKey struct{}
+
+// TokenInfo is the authenticated user of a request
 type TokenInfo struct {
 	UserID string
+	Token  string
 }
 
-func (server *Server) userID(r *http.Request) (userID string) {
-	authHeader := r.Header.Get(authHeader)
-	if authHeader == "" {
-		fmt.Println("no token in Authorization header")
+// AuthConfig ..
+type AuthConfig struct {
+	Issuers   []string `json:"issuers"`   // defaults to the JWKS endpoint without /.well-known/jwks
+	Audiences []string `json:"audiences"` // defaults to ["openid"]
+}
+
+// tokenExpectations returns what the claims of a token must satisfy
+func tokenExpectations(conf AuthConfig, jwksEndpoint string) (*authutils.Expected, error) {
+	issuers := conf.Issuers
+	if len(issuers) == 0 && strings.HasSuffix(jwksEndpoint, jwksPathSuffix) {
+		issuers = []string{strings.TrimSuffix(jwksEndpoint, jwksPathSuffix)}
+	}
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("no token issuers - set auth.issuers in the config")
+	}
+	audiences := conf.Audiences
+	if len(audiences) == 0 {
+		audiences = defaultTokenAudiences
+	}
+	purpose := tokenPurpose
+	return &authutils.Expected{Issuers: issuers, Audiences: audiences, Purpose: &purpose}, nil
+}
+
+// authenticate validates the request's token and returns the user it names
+func (server *Server) authenticate(r *http.Request) (*TokenInfo, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errMissingToken
 	}
-	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-	userJWT = strings.TrimPrefix(userJWT, "bearer ")
-	info, err := server.decodeToken(userJWT)
+	claims, err := server.jwtApp.Decode(token)
 	if err != nil {
-		// log error
-		fmt.Println("error decoding token: ", err)
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
 	}
-	return info.UserID
+	if server.tokenExpected != nil {
+		if err = server.tokenExpected.Validate(claims); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+		}
+	}
+	userID, err := tokenUserID(*claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return &TokenInfo{UserID: userID, Token: token}, nil
 }
 
-func (server *Server) decodeToken(token string) (*TokenInfo, error) {
+// tokenUserID returns context.user.name of fence's claims
+func tokenUserID(claims map[string]interface{}) (string, error) {
 	missingRequiredField := func(field string) error {
-		msg := fmt.Sprintf(
-			"failed to decode token: missing required field `%s`",
-			field,
-		)
-		return errors.New(msg)
+		return fmt.Errorf("missing required field `%s`", field)
 	}
 	fieldTypeError := func(field string) error {
-		msg := fmt.Sprintf(
-			"failed to decode token: field `%s` has wrong type",
-			field,
-		)
-		return errors.New(msg)
-	}
-	// server.logger.Debug("decoding token: %s", token)
-
-	claims, err := server.jwtApp.Decode(token)
-	if err != nil {
-		fmt.Println("error decoding token: ", err)
+		return fmt.Errorf("field `%s` has wrong type", field)
 	}
-	contextInterface, exists := (*claims)["context"]
+	contextInterface, exists := claims["context"]
 	if !exists {
-		return nil, missingRequiredField("context")
+		return "", missingRequiredField("context")
 	}
 	context, casted := contextInterface.(map[string]interface{})
 	if !casted {
-		return nil, fieldTypeError("context")
+		return "", fieldTypeError("context")
 	}
 	userInterface, exists := context["user"]
 	if !exists {
-		return nil, missingRequiredField("user")
+		return "", missingRequiredField("user")
 	}
 	user, casted := userInterface.(map[string]interface{})
 	if !casted {
-		return nil, fieldTypeError("user")
+		return "", fieldTypeError("user")
 	}
 	usernameInterface, exists := user["name"]
 	if !exists {
-		return nil, missingRequiredField("name")
+		return "", missingRequiredField("name")
 	}
 	username, casted := usernameInterface.(string)
 	if !casted {
-		return nil, fieldTypeError("name")
+		return "", fieldTypeError("name")
 	}
-	info := TokenInfo{
-		UserID: username,
+	if username == "" {
+		return "", missingRequiredField("name")
 	}
-	return &info, nil
+	return username, nil
+}
+
+// userID returns the authenticated user of the request, as stored by handleAuth
+// a request which didn't go through handleAuth is authenticated here - "" if it can't be
+func (server *Server) userID(r *http.Request) string {
+	if info, ok := r.Context().Value(tokenContextKey{}).(*TokenInfo); ok {
+		return info.UserID
+	}
+	info, err := server.authenticate(r)
+	if err != nil {
+		fmt.Println("failed to authenticate request: ", err)
+		return ""
+	}
+	return info.UserID
+}
+
+// wtsConnected asks wts, with the user's token, whether the user has a valid refresh token
+func (server *Server) wtsConnected(token string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, server.wtsURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(authHeader, "Bearer "+token)
+	client := &http.Client{Timeout: wtsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("wts returned %v", resp.Status)
+}
+
+//// middleware ////
+
+// handleAuth authenticates the request, and checks the user is connected to wts
+func (server *Server) handleAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// health checks and service-info - see status.go
+		if contains(publicPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := server.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error(), nil)
+			return
+		}
+		if server.wtsURL != "" {
+			connected, err := server.wtsConnected(info.Token)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, errCodeInternal, fmt.Sprintf("failed to check the user's wts connection: %v", err), nil)
+				return
+			}
+			if !connected {
+				writeError(w, http.StatusForbidden, errCodeForbidden, "user is not connected to the workspace token service - log in to it, then retry", nil)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, info)))
+	})
 }
@@ -0,0 +1,143 @@
+package mariner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// decodes the tokens it knows into their claims
+type claimsJWTApp map[string]map[string]interface{}
+
+func (app claimsJWTApp) Decode(token string) (*map[string]interface{}, error) {
+	claims, ok := app[token]
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	return &claims, nil
+}
+
+func testClaims(user string, exp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":     "https://example.org/user",
+		"aud":     []interface{}{"openid", "user"},
+		"pur":     "access",
+		"exp":     float64(exp.Unix()),
+		"context": map[string]interface{}{"user": map[string]interface{}{"name": user}},
+	}
+}
+
+func TestTokenExpectations(t *testing.T) {
+	expected, err := tokenExpectations(AuthConfig{}, "https://example.org/user/.well-known/jwks")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !equalStrings(expected.Issuers, []string{"https://example.org/user"}) || !equalStrings(expected.Audiences, []string{"openid"}) {
+		t.Errorf("wrong expectations: %+v", expected)
+	}
+	expected, _ = tokenExpectations(AuthConfig{Issuers: []string{"https://other.org/user"}}, "https://example.org/user/.well-known/jwks")
+	if !equalStrings(expected.Issuers, []string{"https://other.org/user"}) {
+		t.Errorf("expected the configured issuers, got %v", expected.Issuers)
+	}
+	if _, err = tokenExpectations(AuthConfig{}, "http://fence-service/jwks"); err == nil {
+		t.Error("expected an error without issuers")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	expected, _ := tokenExpectations(AuthConfig{}, "https://example.org/user/.well-known/jwks")
+	noUser := testClaims("", time.Now().Add(time.Hour))
+	otherIssuer := testClaims("alice", time.Now().Add(time.Hour))
+	otherIssuer["iss"] = "https://other.org/user"
+	refresh := testClaims("alice", time.Now().Add(time.Hour))
+	refresh["pur"] = "refresh"
+	server := server().withJWTApp(claimsJWTApp{
+		"valid":        testClaims("alice", time.Now().Add(time.Hour)),
+		"expired":      testClaims("alice", time.Now().Add(-time.Hour)),
+		"no-user":      noUser,
+		"other-issuer": otherIssuer,
+		"refresh":      refresh,
+	}, expected)
+
+	cases := map[string]error{
+		"Bearer valid":        nil,
+		"bearer  valid ":      nil,
+		"":                    errMissingToken,
+		"Bearer ":             errMissingToken,
+		"Bearer garbage":      errInvalidToken,
+		"Bearer expired":      errInvalidToken,
+		"Bearer no-user":      errInvalidToken,
+		"Bearer other-issuer": errInvalidToken,
+		"Bearer refresh":      errInvalidToken,
+	}
+	for header, expectedErr := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/runs", nil)
+		r.Header.Set(authHeader, header)
+		info, err := server.authenticate(r)
+		if !errors.Is(err, expectedErr) {
+			t.Errorf("%q: expected %v, got %v", header, expectedErr, err)
+			continue
+		}
+		if err == nil && (info.UserID != "alice" || info.Token != "valid") {
+			t.Errorf("%q: wrong token info: %+v", header, info)
+		}
+	}
+}
+
+func TestHandleAuth(t *testing.T) {
+	wts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authHeader) != "Bearer alice" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer wts.Close()
+	server := server().withJWTApp(claimsJWTApp{
+		"alice": testClaims("alice", time.Now().Add(time.Hour)),
+		"bob":   testClaims("bob", time.Now().Add(time.Hour)),
+	}, nil).withWTS(wts.URL)
+	handler := server.handleAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.userID(r.WithContext(context.Background())) != "alice" {
+			t.Error("expected the request to be authenticated")
+		}
+		if server.userID(r) != "alice" {
+			t.Error("expected the user in the request's context")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for header, expected := range map[string]int{
+		"Bearer alice":   http.StatusNoContent,
+		"Bearer bob":     http.StatusForbidden,
+		"Bearer garbage": http.StatusUnauthorized,
+		"":               http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/runs", nil)
+		r.Header.Set(authHeader, header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("%q: expected %v, got %v", header, expected, w.Code)
+			continue
+		}
+		if expected == http.StatusUnauthorized {
+			j := &ErrorJSON{}
+			if err := json.NewDecoder(w.Body).Decode(j); err != nil || j.Code != errCodeUnauthorized {
+				t.Errorf("%q: expected an unauthorized error document, got %v", header, w.Body.String())
+			}
+		}
+	}
+
+	public := server.handleAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/_status", nil)
+	w := httptest.NewRecorder()
+	public.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected a public path to skip auth, got %v", w.Code)
+	}
+}
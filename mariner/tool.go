@@ -1,13 +1,11 @@
 package mariner
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // this file contains some methods/functions for setting up and working with Tools (i.e., commandlinetools and expressiontools)
@@ -67,9 +65,6 @@ func (engine *K8sEngine) initWorkDirReq(tool *Tool) (err error) {
 
 					// #no-fuse
 
-					sess := engine.S3FileManager.newS3Session()
-					uploader := s3manager.NewUploader(sess)
-
 					// Q: what about the case of creating directories?
 					// guess: this is probably not currently supported
 					key := strings.TrimPrefix(engine.localPathToS3Key(entryName), "/")
@@ -86,15 +81,10 @@ func (engine *K8sEngine) initWorkDirReq(tool *Tool) (err error) {
 						}
 					}
 
-					result, err := uploader.Upload(&s3manager.UploadInput{
-						Bucket: aws.String(engine.S3FileManager.S3BucketName),
-						Key:    aws.String(key),
-						Body:   bytes.NewReader(b),
-					})
-					if err != nil {
+					if err = storage.PutBytes(engine.FileManager, key, b); err != nil {
 						return fmt.Errorf("upload to s3 failed: %v", err)
 					}
-					fmt.Println("wrote initdir bytes to s3 object:", result.Location)
+					fmt.Println("wrote initdir bytes to s3 object:", key)
 					// log
 				}
 			}
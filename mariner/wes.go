@@ -0,0 +1,469 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the GA4GH WES 1.x API
+// see: https://ga4gh.github.io/workflow-execution-service-schemas
+//
+// the WES endpoints are thin wrappers around the same run storage and engine dispatch
+// used by the original mariner endpoints in server.go
+// the main job here is translating between mariner's log/request structures and the WES schemas
+
+const (
+	wesBasePath = "/ga4gh/wes/v1"
+
+	// WES states
+	// see: https://ga4gh.github.io/workflow-execution-service-schemas/docs/#tag/State
+	wesUnknown       = "UNKNOWN"
+	wesQueued        = "QUEUED"
+	wesInitializing  = "INITIALIZING"
+	wesRunning       = "RUNNING"
+	wesPaused        = "PAUSED"
+	wesComplete      = "COMPLETE"
+	wesExecutorError = "EXECUTOR_ERROR"
+	wesSystemError   = "SYSTEM_ERROR"
+	wesCanceled      = "CANCELED"
+	wesCanceling     = "CANCELING"
+
+	wesWorkflowType = "CWL"
+)
+
+// cwl versions mariner runs
+var supportedCWLVersions = []string{"v1.0"}
+
+// ServiceInfo ..
+type ServiceInfo struct {
+	WorkflowTypeVersions         map[string]*WorkflowTypeVersion `json:"workflow_type_versions"`
+	SupportedWESVersions         []string                        `json:"supported_wes_versions"`
+	SupportedFilesystemProtocols []string                        `json:"supported_filesystem_protocols"`
+	WorkflowEngineVersions       map[string]string               `json:"workflow_engine_versions"`
+	DefaultWorkflowEngineParams  []*DefaultWorkflowEngineParam   `json:"default_workflow_engine_parameters"`
+	SystemStateCounts            map[string]int                  `json:"system_state_counts"`
+	AuthInstructionsURL          string                          `json:"auth_instructions_url"`
+	ContactInfoURL               string                          `json:"contact_info_url,omitempty"`
+	Tags                         map[string]string               `json:"tags"`
+}
+
+// WorkflowTypeVersion ..
+type WorkflowTypeVersion struct {
+	WorkflowTypeVersion []string `json:"workflow_type_version"`
+}
+
+// DefaultWorkflowEngineParam ..
+type DefaultWorkflowEngineParam struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	DefaultValue string `json:"default_value"`
+}
+
+// RunListResponse ..
+type RunListResponse struct {
+	Runs          []*RunStatus `json:"runs"`
+	NextPageToken string       `json:"next_page_token"`
+}
+
+// RunStatus ..
+type RunStatus struct {
+	RunID string `json:"run_id"`
+	State string `json:"state"`
+}
+
+// RunID ..
+type RunID struct {
+	RunID string `json:"run_id"`
+}
+
+// RunRequest ..
+type RunRequest struct {
+	WorkflowParams           json.RawMessage   `json:"workflow_params"`
+	WorkflowType             string            `json:"workflow_type"`
+	WorkflowTypeVersion      string            `json:"workflow_type_version"`
+	Tags                     map[string]string `json:"tags,omitempty"`
+	WorkflowEngineParameters *EngineParameters `json:"workflow_engine_parameters,omitempty"`
+	WorkflowURL              string            `json:"workflow_url"`
+}
+
+// EngineParameters are the mariner-specific fields of a WorkflowRequest,
+// passed through the WES 'workflow_engine_parameters' field
+type EngineParameters struct {
+	Manifest           Manifest       `json:"manifest,omitempty"`
+	ServiceAccountName string         `json:"serviceAccountName,omitempty"`
+	Notifications      *Notifications `json:"notifications,omitempty"`
+}
+
+// RunLog ..
+type RunLog struct {
+	RunID    string                 `json:"run_id"`
+	Request  *RunRequest            `json:"request"`
+	State    string                 `json:"state"`
+	RunLog   *WESLog                `json:"run_log"`
+	TaskLogs []*WESLog              `json:"task_logs"`
+	Outputs  map[string]interface{} `json:"outputs"`
+}
+
+// WESLog is the WES 'Log' object - named so as not to collide with mariner's Log
+type WESLog struct {
+	Name      string   `json:"name"`
+	Cmd       []string `json:"cmd"`
+	StartTime string   `json:"start_time,omitempty"`
+	EndTime   string   `json:"end_time,omitempty"`
+	Stdout    string   `json:"stdout,omitempty"`
+	Stderr    string   `json:"stderr,omitempty"`
+	ExitCode  *int     `json:"exit_code"`
+}
+
+func (server *Server) addWESRoutes(router *mux.Router) {
+	userRuns, run := server.userRunsResource, server.runResource
+	router.HandleFunc("/service-info", server.authorize(authzRead, userRuns, server.handleWESServiceInfo)).Methods("GET")
+	router.HandleFunc("/runs", server.authorize(authzRead, userRuns, server.handleWESRunsGET)).Methods("GET")
+	router.HandleFunc("/runs", server.authorize(authzSubmit, userRuns, server.handleWESRunsPOST)).Methods("POST")
+	router.HandleFunc("/runs/{runID}", server.authorize(authzRead, run, server.handleWESRunLogGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/status", server.authorize(authzRead, run, server.handleWESRunStatusGET)).Methods("GET")
+	router.HandleFunc("/runs/{runID}/cancel", server.authorize(authzCancel, run, server.handleWESCancelRunPOST)).Methods("POST")
+	// the task_logs stdout and stderr URLs of a RunLog - see wesTaskLogsURL
+	router.HandleFunc("/runs/{runID}/tasks/{taskID:.+}/logs", server.authorize(authzRead, run, server.handleTaskLogsGET)).Methods("GET")
+}
+
+// wesState maps a mariner process status to a WES state
+func wesState(status string) string {
+	switch status {
+	case notStarted, queued:
+		return wesQueued
+	case running:
+		return wesRunning
+	case completed:
+		return wesComplete
+	case failed:
+		return wesExecutorError
+	case cancelled:
+		return wesCanceled
+	}
+	return wesUnknown
+}
+
+// mariner log timestamps are written by timef()
+// WES wants RFC 3339
+func wesTime(ts string) string {
+	if ts == "" {
+		return ""
+	}
+	t, err := parseTimef(ts)
+	if err != nil {
+		return ts
+	}
+	return t.Format(time.RFC3339)
+}
+
+//// handlers ////
+
+// '/service-info' - GET
+func (server *Server) handleWESServiceInfo(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int)
+	if runs, err := server.runSummaries(server.userID(r)); err == nil {
+		for _, run := range runs {
+			counts[wesState(run.Status)]++
+		}
+	}
+	j := &ServiceInfo{
+		WorkflowTypeVersions: map[string]*WorkflowTypeVersion{
+			wesWorkflowType: {WorkflowTypeVersion: supportedCWLVersions},
+		},
+		SupportedWESVersions:         []string{"1.0.0"},
+		SupportedFilesystemProtocols: []string{"s3", "drs"},
+		WorkflowEngineVersions:       map[string]string{"mariner": Version},
+		DefaultWorkflowEngineParams:  []*DefaultWorkflowEngineParam{},
+		SystemStateCounts:            counts,
+		AuthInstructionsURL:          "https://gen3.org/resources/user/using-api/",
+		Tags:                         map[string]string{},
+	}
+	writeJSON(w, j)
+}
+
+// '/runs' - GET
+// takes the same filter, sort and pagination parameters as the mariner '/runs' endpoint - see runs.go
+func (server *Server) handleWESRunsGET(w http.ResponseWriter, r *http.Request) {
+	filter, err := runFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidQuery, err.Error(), nil)
+		return
+	}
+	summaries, err := server.scopedRunSummaries(r, filter.Scope)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch runs: %w", err))
+		return
+	}
+	page, nextPageToken := listRunSummaries(summaries, filter)
+	j := &RunListResponse{Runs: []*RunStatus{}, NextPageToken: nextPageToken}
+	for _, s := range page {
+		j.Runs = append(j.Runs, &RunStatus{RunID: s.RunID, State: wesState(s.Status)})
+	}
+	writeJSON(w, j)
+}
+
+// '/runs' - POST
+// accepts either the WES multipart/form-data RunRequest
+// or a mariner WorkflowRequest as JSON
+func (server *Server) handleWESRunsPOST(w http.ResponseWriter, r *http.Request) {
+	workflowRequest := &WorkflowRequest{}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		workflowRequest, err = workflowRequestFromForm(r)
+	} else {
+		err = unmarshalBody(r, workflowRequest)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), &RequestGrievances{
+			Request: wflib.Grievances{err.Error()},
+		})
+		return
+	}
+	runID, ok := server.submitRun(w, r, workflowRequest, "")
+	if !ok {
+		return
+	}
+	writeJSON(w, &RunID{RunID: runID})
+}
+
+// builds a WorkflowRequest from a WES RunRequest form
+//
+// the workflow is either packed workflow JSON (see wftool)
+// passed as a 'workflow_attachment' whose filename is the 'workflow_url',
+// or the cwl files of the workflow, with the path of the top-level one as the 'workflow_url'
+// the caller limits the body to maxUploadSize
+func workflowRequestFromForm(r *http.Request) (*WorkflowRequest, error) {
+	if err := r.ParseMultipartForm(maxBundleSize); err != nil {
+		return nil, fmt.Errorf("failed to parse multipart form: %v", err)
+	}
+	form := r.MultipartForm
+	value := func(key string) string {
+		if v := form.Value[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if t := value("workflow_type"); t != "" && t != wesWorkflowType {
+		return nil, fmt.Errorf("unsupported workflow_type: %v", t)
+	}
+	if v := value("workflow_type_version"); v != "" && !contains(supportedCWLVersions, v) {
+		return nil, fmt.Errorf("unsupported workflow_type_version: %v", v)
+	}
+
+	workflowRequest := &WorkflowRequest{}
+	if params := value("workflow_params"); params != "" {
+		workflowRequest.Input = json.RawMessage(params)
+	}
+	if tags := value("tags"); tags != "" {
+		if err := json.Unmarshal([]byte(tags), &workflowRequest.Tags); err != nil {
+			return nil, fmt.Errorf("invalid tags: %v", err)
+		}
+	}
+	if params := value("workflow_engine_parameters"); params != "" {
+		engineParams := &EngineParameters{}
+		if err := json.Unmarshal([]byte(params), engineParams); err != nil {
+			return nil, fmt.Errorf("invalid workflow_engine_parameters: %v", err)
+		}
+		workflowRequest.Manifest = engineParams.Manifest
+		workflowRequest.ServiceAccountName = engineParams.ServiceAccountName
+		workflowRequest.Notifications = engineParams.Notifications
+	}
+
+	workflowURL := value("workflow_url")
+	if workflowURL == "" {
+		return nil, fmt.Errorf("missing workflow_url")
+	}
+	// unpacked cwl files - packed by the server, see bundle.go
+	if strings.ToLower(path.Ext(workflowURL)) == ".cwl" {
+		bundle, err := bundleFromForm(form, workflowURL)
+		if err != nil {
+			return nil, err
+		}
+		workflowRequest.bundle = bundle
+		return workflowRequest, nil
+	}
+	for _, header := range form.File["workflow_attachment"] {
+		if header.Filename != workflowURL {
+			continue
+		}
+		if header.Size > maxBundleSize {
+			return nil, fmt.Errorf("workflow attachment is larger than %v MB", maxBundleSize>>20)
+		}
+		f, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open workflow attachment: %v", err)
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workflow attachment: %v", err)
+		}
+		workflowRequest.Workflow = json.RawMessage(b)
+		return workflowRequest, nil
+	}
+	return nil, fmt.Errorf("workflow_url must be the filename of a packed workflow JSON workflow_attachment: %v", workflowURL)
+}
+
+// '/runs/{runID}' - GET
+func (server *Server) handleWESRunLogGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch log: %w", err))
+		return
+	}
+	writeJSON(w, wesRunLog(runID, runLog, wesTaskLogsURL(r, runID)))
+}
+
+// '/runs/{runID}/status' - GET
+func (server *Server) handleWESRunStatusGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	status, err := server.runStatus(userID, runID)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("failed to fetch status: %w", err))
+		return
+	}
+	writeJSON(w, &RunStatus{RunID: runID, State: wesState(status)})
+}
+
+// '/runs/{runID}/cancel' - POST
+func (server *Server) handleWESCancelRunPOST(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	if _, err := server.cancelRun(userID, runID); err != nil {
+		if isNotFound(err) {
+			writeStorageError(w, fmt.Errorf("failed to cancel run: %w", err))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeCancel, fmt.Sprintf("failed to cancel run: %v", err), nil)
+		return
+	}
+	writeJSON(w, &RunID{RunID: runID})
+}
+
+//// translation from mariner structures to WES structures ////
+
+// wesTaskLogsURL returns a function which gives the URL of the console output of a task of the run,
+// e.g., https://<host>/ga4gh/wes/v1/runs/<runID>/tasks/<taskID>/logs?stream=stdout - served by handleTaskLogsGET
+// the URLs are on the host the run log was requested from, and keep the 'owner' of a shared run
+func wesTaskLogsURL(r *http.Request, runID string) func(taskID, stream string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	tasksURL := fmt.Sprintf("%v://%v%v/runs/%v/tasks/", scheme, r.Host, wesBasePath, url.PathEscape(runID))
+	owner := r.URL.Query().Get("owner")
+	return func(taskID, stream string) string {
+		query := url.Values{"stream": {stream}}
+		if owner != "" {
+			query.Set("owner", owner)
+		}
+		return tasksURL + url.PathEscape(taskID) + "/logs?" + query.Encode()
+	}
+}
+
+// logsURL gives the URLs of the tasks' console output - see wesTaskLogsURL
+func wesRunLog(runID string, runLog *MainLog, logsURL func(taskID, stream string) string) *RunLog {
+	j := &RunLog{
+		RunID:    runID,
+		State:    wesState(runLog.Main.Status),
+		RunLog:   wesLog(runID, runLog.Main, nil),
+		TaskLogs: []*WESLog{},
+		Outputs:  runLog.Main.Output,
+	}
+	if runLog.Request != nil {
+		j.Request = wesRunRequest(runLog.Request)
+	}
+
+	// task logs ordered by start time, then by task ID
+	taskIDs := make([]string, 0, len(runLog.ByProcess))
+	for taskID := range runLog.ByProcess {
+		taskIDs = append(taskIDs, taskID)
+	}
+	sort.Slice(taskIDs, func(i, k int) bool {
+		a, b := runLog.ByProcess[taskIDs[i]], runLog.ByProcess[taskIDs[k]]
+		if ta, tb := wesTime(a.Created), wesTime(b.Created); ta != tb {
+			return ta < tb
+		}
+		return taskIDs[i] < taskIDs[k]
+	})
+	for _, taskID := range taskIDs {
+		task := runLog.ByProcess[taskID]
+		j.TaskLogs = append(j.TaskLogs, wesLog(taskID, task, logsURL))
+		for _, i := range sortedScatterIndices(task) {
+			j.TaskLogs = append(j.TaskLogs, wesLog(fmt.Sprintf("%v[%v]", taskID, i), task.Scatter[i], logsURL))
+		}
+	}
+	return j
+}
+
+// the stdout and stderr URLs are filled in for a task which ran a container, if logsURL is given
+func wesLog(name string, log *Log, logsURL func(taskID, stream string) string) *WESLog {
+	j := &WESLog{
+		Name:      name,
+		Cmd:       []string{},
+		StartTime: wesTime(log.Created),
+		ExitCode:  log.ExitCode,
+	}
+	if logsURL != nil && log.WorkingDir != "" && log.ContainerImage != "" {
+		j.Stdout, j.Stderr = logsURL(name, stdoutStream), logsURL(name, stderrStream)
+	}
+	switch log.Status {
+	case completed, failed, cancelled:
+		j.EndTime = wesTime(log.LastUpdated)
+	}
+	return j
+}
+
+func wesRunRequest(request *WorkflowRequest) *RunRequest {
+	j := &RunRequest{
+		WorkflowParams: request.Input,
+		WorkflowType:   wesWorkflowType,
+		Tags:           request.Tags,
+		WorkflowURL:    "#main",
+	}
+	wf := &wflib.WorkflowJSON{}
+	if err := json.Unmarshal(request.Workflow, wf); err == nil {
+		j.WorkflowTypeVersion = wf.CWLVersion
+	}
+	if len(request.Manifest) > 0 || request.ServiceAccountName != "" || request.Notifications != nil {
+		j.WorkflowEngineParameters = &EngineParameters{
+			Manifest:           request.Manifest,
+			ServiceAccountName: request.ServiceAccountName,
+			Notifications:      request.Notifications,
+		}
+	}
+	return j
+}
+
+func sortedScatterIndices(log *Log) []int {
+	indices := make([]int, 0, len(log.Scatter))
+	for i := range log.Scatter {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
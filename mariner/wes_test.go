@@ -0,0 +1,196 @@
+package mariner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+func TestWESState(t *testing.T) {
+	cases := map[string]string{
+		notStarted: wesQueued,
+		queued:     wesQueued,
+		running:    wesRunning,
+		completed:  wesComplete,
+		failed:     wesExecutorError,
+		cancelled:  wesCanceled,
+		unknown:    wesUnknown,
+		"":         wesUnknown,
+	}
+	for status, expected := range cases {
+		if state := wesState(status); state != expected {
+			t.Errorf("'%v': expected %v, got %v", status, expected, state)
+		}
+	}
+}
+
+// multipartRequest returns a multipart/form-data body of the fields, with a workflow attachment of each file
+func multipartRequest(t *testing.T, fields map[string]string, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range files {
+		fw, err := mw.CreateFormFile("workflow_attachment", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(contents))
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestWorkflowRequestFromForm(t *testing.T) {
+	packed := `{"$graph": [], "cwlVersion": "v1.0"}`
+	body, contentType := multipartRequest(t, map[string]string{
+		"workflow_type":              "CWL",
+		"workflow_type_version":      "v1.0",
+		"workflow_url":               "workflow.json",
+		"workflow_params":            `{"reads": {"class": "File", "location": "USER/reads.fastq"}}`,
+		"tags":                       `{"project": "x"}`,
+		"workflow_engine_parameters": `{"serviceAccountName": "runner"}`,
+	}, map[string]string{"workflow.json": packed, "notes.txt": "unrelated"})
+	r := httptest.NewRequest("POST", wesBasePath+"/runs", body)
+	r.Header.Set("Content-Type", contentType)
+	request, err := workflowRequestFromForm(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request.Workflow) != packed {
+		t.Errorf("expected the packed workflow, got %s", request.Workflow)
+	}
+	if request.Tags["project"] != "x" || request.ServiceAccountName != "runner" {
+		t.Errorf("expected the tags and engine parameters, got %v, '%v'", request.Tags, request.ServiceAccountName)
+	}
+	input := map[string]interface{}{}
+	if err = json.Unmarshal(request.Input, &input); err != nil || input["reads"] == nil {
+		t.Errorf("expected the workflow params as input, got %s", request.Input)
+	}
+
+	bad := []map[string]string{
+		{"workflow_type": "WDL", "workflow_url": "workflow.json"},
+		{"workflow_type_version": "v1.2", "workflow_url": "workflow.json"},
+		{"workflow_url": "workflow.json", "tags": "project"},
+		{},
+		{"workflow_url": "missing.json"},
+	}
+	for _, fields := range bad {
+		body, contentType := multipartRequest(t, fields, map[string]string{"workflow.json": packed})
+		r := httptest.NewRequest("POST", wesBasePath+"/runs", body)
+		r.Header.Set("Content-Type", contentType)
+		if _, err = workflowRequestFromForm(r); err == nil {
+			t.Errorf("%v: expected an error", fields)
+		}
+	}
+}
+
+func TestWESRunLog(t *testing.T) {
+	runLog := mainLog("")
+	runLog.Main.Status = completed
+	runLog.Main.Created = "2021/1/2 10:0:0"
+	runLog.Main.LastUpdated = "2021/1/2 11:0:0"
+	runLog.Main.Output = map[string]interface{}{"bam": "out.bam"}
+	runLog.Request = &WorkflowRequest{
+		Workflow: json.RawMessage(`{"cwlVersion": "v1.0"}`),
+		Input:    json.RawMessage(`{}`),
+		Tags:     map[string]string{"project": "x"},
+	}
+	align, sort, scattered := logger(), logger(), logger()
+	align.Status, align.Created = completed, "2021/1/2 10:5:0"
+	sort.Status, sort.Created = running, "2021/1/2 10:1:0"
+	align.Scatter = map[int]*Log{1: scattered}
+	exitCode := 2
+	align.WorkingDir, align.ContainerImage, align.ExitCode = "/engine-workspace/workflowRuns/run/align", "ubuntu", &exitCode
+	runLog.ByProcess["#main/align"] = align
+	runLog.ByProcess["#main/sort"] = sort
+
+	j := wesRunLog("run", runLog, wesTaskLogsURL(httptest.NewRequest("GET", "https://mariner/ga4gh/wes/v1/runs/run?owner=bob", nil), "run"))
+	if j.RunID != "run" || j.State != wesComplete || j.Outputs["bam"] != "out.bam" {
+		t.Errorf("wrong run log: %+v", j)
+	}
+	if j.RunLog.StartTime == "" || j.RunLog.EndTime == "" {
+		t.Errorf("expected the start and end of the run, got %+v", j.RunLog)
+	}
+	if j.Request == nil || j.Request.WorkflowTypeVersion != "v1.0" || j.Request.WorkflowType != wesWorkflowType {
+		t.Errorf("wrong request: %+v", j.Request)
+	}
+	names := []string{}
+	for _, task := range j.TaskLogs {
+		names = append(names, task.Name)
+	}
+	if !equalStrings(names, []string{"#main/sort", "#main/align", "#main/align[1]"}) {
+		t.Errorf("expected task logs by start time, got %v", names)
+	}
+	if j.TaskLogs[0].EndTime != "" {
+		t.Errorf("expected no end time for a running task, got %v", j.TaskLogs[0].EndTime)
+	}
+	if j.TaskLogs[0].Stdout != "" || j.TaskLogs[0].ExitCode != nil {
+		t.Errorf("expected no console output or exit code for a task without a container, got %+v", j.TaskLogs[0])
+	}
+	if align := j.TaskLogs[1]; align.ExitCode == nil || *align.ExitCode != 2 ||
+		align.Stdout != "https://mariner/ga4gh/wes/v1/runs/run/tasks/%23main%2Falign/logs?owner=bob&stream=stdout" ||
+		align.Stderr != "https://mariner/ga4gh/wes/v1/runs/run/tasks/%23main%2Falign/logs?owner=bob&stream=stderr" {
+		t.Errorf("expected the exit code and console output URLs of the task, got %+v", align)
+	}
+
+	// task_logs is a list, never null
+	b, _ := json.Marshal(wesRunLog("run", mainLog(""), nil))
+	if !bytes.Contains(b, []byte(`"task_logs":[]`)) {
+		t.Errorf("expected an empty task_logs list, got %s", b)
+	}
+}
+
+func TestWESRunsPaging(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		runLog := mainLog("")
+		runLog.Main.Status = completed
+		runLog.Main.Created = fmt.Sprintf("2021/1/%v 10:0:0", i)
+		b, _ := json.Marshal(runLog)
+		if err = storage.PutBytes(local, fmt.Sprintf(pathToUserRunLogf, "user", fmt.Sprintf("run%v", i)), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := server().withFileManager(&FileManager{Storage: local})
+
+	runIDs, token := []string{}, ""
+	for pages := 0; pages < 5; pages++ {
+		r := httptest.NewRequest("GET", wesBasePath+"/runs?page_size=2&page_token="+token, nil)
+		r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, &TokenInfo{UserID: "user"}))
+		w := httptest.NewRecorder()
+		server.handleWESRunsGET(w, r)
+		j := &RunListResponse{}
+		if err = json.Unmarshal(w.Body.Bytes(), j); err != nil {
+			t.Fatal(err)
+		}
+		if len(j.Runs) > 2 {
+			t.Fatalf("expected at most 2 runs a page, got %v", len(j.Runs))
+		}
+		for _, run := range j.Runs {
+			if run.State != wesComplete {
+				t.Errorf("wrong state of %v: %v", run.RunID, run.State)
+			}
+			runIDs = append(runIDs, run.RunID)
+		}
+		if token = j.NextPageToken; token == "" {
+			break
+		}
+	}
+	if !equalStrings(runIDs, []string{"run5", "run4", "run3", "run2", "run1"}) {
+		t.Errorf("expected every run, newest first, got %v", runIDs)
+	}
+}
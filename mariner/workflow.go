@@ -138,6 +138,7 @@ func (engine *K8sEngine) resolveGraph(rootMap map[string]*cwl.Root, curTask *Tas
 				Done:         &falseVal,
 			}
 			engine.Log.ByProcess[step.ID] = newTask.Log
+			engine.Log.Journal.attach(step.ID, newTask.Log)
 
 			engine.resolveGraph(rootMap, newTask)
 
@@ -205,6 +206,7 @@ func (engine *K8sEngine) runWorkflow() error {
 
 	// fixme: refactor
 	engine.Log.Main = mainTask.Log
+	engine.Log.Journal.attach(mainProcessID, mainTask.Log)
 
 	mainTask.Log.JobName = engine.Log.Request.JobName
 	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
@@ -222,6 +224,10 @@ func (engine *K8sEngine) runWorkflow() error {
 	if err = engine.run(mainTask); err != nil {
 		return engine.errorf("failed to run main task: %v", err)
 	}
+	// a cancelled run ends cancelled, not failed
+	if mainTask.Log.Status == failed {
+		return engine.errorf("failed to run main task: a task failed")
+	}
 
 	engine.infof("end run workflow")
 	engine.writeLogToS3()
@@ -243,23 +249,59 @@ func (engine *K8sEngine) run(task *Task) (err error) {
 	engine.startTask(task)
 	switch {
 	case task.Scatter != nil:
-		engine.runScatter(task)
+		if err = engine.runScatter(task); err != nil {
+			task.Log.setStatus(failed)
+		}
 		engine.gatherScatterOutputs(task) // Q. does this mean final log doesn't get written for scattered tasks?
+		if status := task.subtasksEndStatus(); status != "" {
+			task.Log.setStatus(status)
+		}
 	case task.Root.Class == "Workflow":
 		// this is not a leaf in the graph
 		engine.runSteps(task)
+		// a failed or cancelled step leaves outputs of the workflow unset - there's nothing to merge
+		if status := task.subtasksEndStatus(); status != "" {
+			engine.warnf("workflow %v has %v steps", task.Root.ID, status)
+			task.Log.setStatus(status)
+			break
+		}
 		if err = engine.mergeChildParams(task); err != nil {
 			return engine.errorf("failed to merge child params for task: %v; error: %v", task.Root.ID, err)
 		}
 	default:
 		// this is a leaf in the graph
-		engine.dispatchTask(task)
+		if err = engine.dispatchTask(task); err != nil && task.Log.Status != cancelled {
+			task.Log.setStatus(failed)
+		}
 	}
 	engine.finishTask(task)
 	engine.infof("end run task: %v", task.Root.ID)
 	return nil
 }
 
+// subtasksEndStatus returns failed if any of the task's steps or scattered subtasks failed,
+// else cancelled if any of them was cancelled, else ""
+func (task *Task) subtasksEndStatus() string {
+	status := ""
+	check := func(subtask *Task) {
+		switch subtask.Log.Status {
+		case failed:
+			status = failed
+		case cancelled:
+			if status == "" {
+				status = cancelled
+			}
+		}
+	}
+	for _, child := range task.Children {
+		check(child)
+	}
+	for _, scatterTask := range task.ScatterTasks {
+		check(scatterTask)
+	}
+	return status
+}
+
 func (engine *K8sEngine) mergeChildParams(task *Task) (err error) {
 	engine.infof("begin merge child params for task: %v", task.Root.ID)
 	if err = task.mergeChildOutputs(); err != nil {
@@ -342,6 +384,14 @@ func (engine *K8sEngine) runStep(curStepID string, parentTask *Task, task *Task)
 			done := false
 			for inputPresent := false; !inputPresent; _, inputPresent = task.Parameters[taskInput] {
 				done = *depTask.Done
+				if done && (depTask.Log.Status == failed || depTask.Log.Status == cancelled) {
+					// the dependency has no output for this step - skip it
+					engine.warnf("skipping step %v: dependency step %v %v", curStepID, depStepID, depTask.Log.Status)
+					engine.startTask(task)
+					task.Log.setStatus(cancelled)
+					engine.finishTask(task)
+					return
+				}
 				if done {
 					task.Parameters[taskInput] = depTask.Outputs[outputID] // #race #ok (?)
 					if task.Parameters[taskInput] == nil {
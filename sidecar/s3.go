@@ -8,18 +8,25 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 const (
 	// environment variables
-	awsCredsEnvVar         = "AWSCREDS"
-	s3RegionEnvVar         = "S3_REGION"
-	s3BucketNameEnvVar     = "S3_BUCKET_NAME"
-	userIDEnvVar           = "USER_ID"
-	sharedVolumeNameEnvVar = "ENGINE_WORKSPACE"
-	taskWorkingDirEnvVar   = "TOOL_WORKING_DIR"
+	awsCredsEnvVar          = "AWSCREDS"
+	s3RegionEnvVar          = "S3_REGION"
+	s3BucketNameEnvVar      = "S3_BUCKET_NAME"
+	s3EndpointEnvVar        = "S3_ENDPOINT"
+	s3PathStyleEnvVar       = "S3_FORCE_PATH_STYLE"
+	s3CredentialsEnvVar     = "S3_CREDENTIALS"
+	s3RoleARNEnvVar         = "S3_ROLE_ARN"
+	s3RoleSessionNameEnvVar = "S3_ROLE_SESSION_NAME"
+	s3SessionPolicyEnvVar   = "S3_SESSION_POLICY"
+	storageDriverEnvVar     = "STORAGE_DRIVER"
+	storageRootEnvVar       = "STORAGE_ROOT"
+	userIDEnvVar            = "USER_ID"
+	sharedVolumeNameEnvVar  = "ENGINE_WORKSPACE"
+	taskWorkingDirEnvVar    = "TOOL_WORKING_DIR"
 
 	// setting a max so as to prevent the error of having too many files being open at once
 	// need to investigate how high we can set this bound without running into problems
@@ -31,10 +38,9 @@ const (
 	inputFileListName = "_mariner_s3_input.json"
 )
 
-// S3FileManager manages interactions with S3
-type S3FileManager struct {
-	AWSConfig             *aws.Config
-	S3BucketName          string
+// FileManager manages interactions with the storage of runs - see storage/
+type FileManager struct {
+	storage.Storage
 	InputFileListS3Key    string
 	UserID                string
 	SharedVolumeMountPath string
@@ -47,12 +53,19 @@ type awsCredentials struct {
 	Secret string `json:"secret"`
 }
 
-func (fm *S3FileManager) setup() (err error) {
-	fm.AWSConfig, err = loadAWSConfig()
+func (fm *FileManager) setup() (err error) {
+	if os.Getenv(storageDriverEnvVar) == "local" {
+		fm.Storage, err = storage.NewLocal(os.Getenv(storageRootEnvVar))
+	} else {
+		var awsConfig *aws.Config
+		if awsConfig, err = loadAWSConfig(); err != nil {
+			return err
+		}
+		fm.Storage, err = storage.NewS3(awsConfig, os.Getenv(s3BucketNameEnvVar))
+	}
 	if err != nil {
 		return err
 	}
-	fm.S3BucketName = os.Getenv(s3BucketNameEnvVar)
 	fm.UserID = os.Getenv(userIDEnvVar)
 
 	// "/engine-workspace"
@@ -81,27 +94,37 @@ func (fm *S3FileManager) setup() (err error) {
 
 	so, replace "/engine-workspace" with "/userID"
 */
-func (fm *S3FileManager) s3Key(path string) string {
+// taskLogDir is where the task container captures its console output
+// must match taskLogDir in mariner/engine.go
+func taskLogDir(workingDir string) string {
+	return strings.TrimSuffix(workingDir, "/") + ".logs/"
+}
+
+func (fm *FileManager) s3Key(path string) string {
 	userIDPrefix := fmt.Sprintf("/%v", fm.UserID)
 	key := strings.Replace(path, fm.SharedVolumeMountPath, userIDPrefix, 1)
 	return key
 }
 
-func (fm *S3FileManager) newS3Session() *session.Session {
-	return session.Must(session.NewSession(fm.AWSConfig))
-}
-
+// loadAWSConfig returns the aws config for the bucket, with the credentials the engine gave the task - see S3Config in mariner/config.go
 func loadAWSConfig() (*aws.Config, error) {
-	secret := []byte(os.Getenv(awsCredsEnvVar))
-	creds := &awsCredentials{}
-	err := json.Unmarshal(secret, creds)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling aws secret: %v", err)
+	s3Config := &storage.S3Config{
+		Region:          os.Getenv(s3RegionEnvVar),
+		Endpoint:        os.Getenv(s3EndpointEnvVar), // S3-compatible storage, e.g., MinIO
+		ForcePathStyle:  os.Getenv(s3PathStyleEnvVar) == "true",
+		Credentials:     os.Getenv(s3CredentialsEnvVar),
+		RoleARN:         os.Getenv(s3RoleARNEnvVar),
+		RoleSessionName: os.Getenv(s3RoleSessionNameEnvVar),
+		Policy:          os.Getenv(s3SessionPolicyEnvVar),
 	}
-	credsConfig := credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
-	awsConfig := &aws.Config{
-		Region:      aws.String(os.Getenv(s3RegionEnvVar)),
-		Credentials: credsConfig,
+	if s3Config.Credentials == "" || s3Config.Credentials == storage.CredentialsStatic {
+		secret := []byte(os.Getenv(awsCredsEnvVar))
+		creds := &awsCredentials{}
+		err := json.Unmarshal(secret, creds)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling aws secret: %v", err)
+		}
+		s3Config.AccessKeyID, s3Config.SecretAccessKey = creds.ID, creds.Secret
 	}
-	return awsConfig, nil
+	return s3Config.AWSConfig()
 }
@@ -1,17 +1,18 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // TaskS3Input ..
@@ -21,8 +22,11 @@ type TaskS3Input struct {
 
 func main() {
 
-	fm := &S3FileManager{}
-	fm.setup()
+	fm := &FileManager{}
+	if err := fm.setup(); err != nil {
+		fmt.Println("failed to set up storage:", err)
+		return
+	}
 
 	// 1. read in the target s3 paths
 	taskS3Input, err := fm.fetchTaskS3InputList()
@@ -58,27 +62,12 @@ func main() {
 }
 
 // 1. read this task's input file list from s3
-func (fm *S3FileManager) fetchTaskS3InputList() (*TaskS3Input, error) {
-	sess := fm.newS3Session()
-
-	// Create a downloader with the session and default options
-	downloader := s3manager.NewDownloader(sess)
-
-	// Create a buffer to write the S3 Object contents to.
-	// see: https://stackoverflow.com/questions/41645377/golang-s3-download-to-buffer-using-s3manager-downloader
-	buf := &aws.WriteAtBuffer{}
-
-	// Write the contents of S3 Object to the buffer
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(fm.S3BucketName),
-		Key:    aws.String(fm.InputFileListS3Key),
-	}
-	_, err := downloader.Download(buf, s3Obj)
+func (fm *FileManager) fetchTaskS3InputList() (*TaskS3Input, error) {
+	b, err := storage.ReadAll(fm, fm.InputFileListS3Key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
 
-	b := buf.Bytes()
 	taskS3Input := &TaskS3Input{}
 	err = json.Unmarshal(b, taskS3Input)
 	if err != nil {
@@ -89,12 +78,9 @@ func (fm *S3FileManager) fetchTaskS3InputList() (*TaskS3Input, error) {
 }
 
 // 2. download this task's input files from s3
-func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error) {
-
-	// note: downloader is safe for concurrent use
-	sess := fm.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
+func (fm *FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error) {
 
+	// note: the storage is safe for concurrent use
 	var n int64
 	var wg sync.WaitGroup
 	guard := make(chan struct{}, fm.MaxConcurrent)
@@ -121,10 +107,7 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error
 			fmt.Println("trying to download obj with key:", fm.s3Key(path))
 
 			// write s3 object content into file
-			n, err = downloader.Download(f, &s3.GetObjectInput{
-				Bucket: aws.String(fm.S3BucketName),
-				Key:    aws.String(strings.TrimPrefix(fm.s3Key(path), "/")),
-			})
+			n, err = fm.download(f, strings.TrimPrefix(fm.s3Key(path), "/"))
 			if err != nil {
 				fmt.Println("failed to download file:", path, err)
 			}
@@ -145,11 +128,21 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error
 	return nil
 }
 
+// download copies the object into the file
+func (fm *FileManager) download(f *os.File, key string) (int64, error) {
+	body, _, err := fm.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return io.Copy(f, body)
+}
+
 // 3. signal to main container to run
 // fixme - WHY is it that the sidecar passes the task command to the main container?
 // ------> WHY doesn't the engine simply give the task container its command directly?
 // ------> early design decision, probably doesn't make sense any more, should fix it
-func (fm *S3FileManager) signalTaskToRun() error {
+func (fm *FileManager) signalTaskToRun() error {
 
 	// cushion to ensure gen3fuse finishes setting up..
 	time.Sleep(7 * time.Second)
@@ -176,7 +169,7 @@ func (fm *S3FileManager) signalTaskToRun() error {
 
 // 4. wait for main container to finish
 // not sure if this fn should actually return an error or not
-func (fm *S3FileManager) waitForTaskToFinish() error {
+func (fm *FileManager) waitForTaskToFinish() error {
 	time.Sleep(10 * time.Second)
 
 	var err error
@@ -208,17 +201,17 @@ func (fm *S3FileManager) waitForTaskToFinish() error {
 }
 
 // uploadOutputFiles utilizes a file manager to upload output files for a task.
-func (fm *S3FileManager) uploadOutputFiles() (err error) {
+// the captured console output of the task container, in the task log dir, gets uploaded too
+func (fm *FileManager) uploadOutputFiles() (err error) {
 	paths := []string{}
-	_ = filepath.Walk(fm.TaskWorkingDir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			paths = append(paths, path)
-		}
-		return nil
-	})
-	sess := fm.newS3Session()
-	uploader := s3manager.NewUploader(sess)
-	var result *s3manager.UploadOutput
+	for _, dir := range []string{fm.TaskWorkingDir, taskLogDir(fm.TaskWorkingDir)} {
+		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
 	var wg sync.WaitGroup
 	guard := make(chan struct{}, fm.MaxConcurrent)
 	for _, p := range paths {
@@ -226,27 +219,49 @@ func (fm *S3FileManager) uploadOutputFiles() (err error) {
 		wg.Add(1)
 		go func(path string) {
 			defer wg.Done()
+			defer func() { <-guard }()
 			f, err := os.Open(path)
 			if err != nil {
 				fmt.Println("failed to open file:", path, err)
 				return
 			}
-			result, err = uploader.Upload(&s3manager.UploadInput{
-				Bucket: aws.String(fm.S3BucketName),
-				Key:    aws.String(strings.TrimPrefix(fm.s3Key(path), "/")),
-				Body:   f,
-			})
-			if err != nil {
+			defer func() {
+				if err := f.Close(); err != nil {
+					fmt.Println("failed to close file:", err)
+				}
+			}()
+			// the checksum is served along with the file's download url - see mariner/outputs.go
+			// the file is uploaded without it if it can't be computed
+			var metadata map[string]string
+			if checksum, err := fileSHA1(f); err != nil {
+				fmt.Println("failed to compute checksum of file:", path, err)
+				if _, err = f.Seek(0, io.SeekStart); err != nil {
+					fmt.Println("failed to rewind file:", path, err)
+					return
+				}
+			} else {
+				metadata = map[string]string{"sha1": checksum}
+			}
+			key := strings.TrimPrefix(fm.s3Key(path), "/")
+			if err = fm.Put(key, f, metadata); err != nil {
 				fmt.Println("failed to upload file:", path, err)
 				return
 			}
-			fmt.Println("file uploaded to location:", result.Location)
-			if err = f.Close(); err != nil {
-				fmt.Println("failed to close file:", err)
-			}
-			<-guard
+			fmt.Println("file uploaded to location:", key)
 		}(p)
 	}
 	wg.Wait()
 	return nil
 }
+
+// fileSHA1 returns the hex sha1 of the file and rewinds it
+func fileSHA1(f *os.File) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
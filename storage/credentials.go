@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// this file contains the credential sources of S3Storage
+//
+// - static (the default) - an access key id and secret, e.g., from a k8s secret
+// - default - the AWS SDK's default chain: environment variables, shared config files, the web identity of the
+//   pod's service account (IRSA) if it's annotated with a role, then the role of the ECS task or EC2 instance
+// - web_identity - only the web identity of the pod's service account (IRSA), with the role and token file
+//   from AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, as set by the EKS pod identity webhook, unless given
+//
+// with any source, another role may be assumed, e.g., to act as one user, with a session policy
+// which limits the role to that user's objects
+//
+// STS is reached at its regional endpoint - the endpoint of the bucket is only used for S3
+
+// credential sources
+const (
+	CredentialsStatic      = "static"
+	CredentialsDefault     = "default"
+	CredentialsWebIdentity = "web_identity"
+)
+
+// S3Config is where a bucket is, and how to authenticate to it
+type S3Config struct {
+	Region         string
+	Endpoint       string // for S3-compatible storage, e.g., MinIO
+	ForcePathStyle bool
+
+	Credentials string // credential source - "" is CredentialsStatic
+
+	// CredentialsStatic
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// CredentialsWebIdentity - from the environment if ""
+	WebIdentityRoleARN   string
+	WebIdentityTokenFile string
+
+	// role to assume with the credentials of the source, if not ""
+	RoleARN         string
+	RoleSessionName string // generated if ""
+	Policy          string // session policy - what the assumed role may do is limited to what it allows
+}
+
+// AWSConfig returns the aws config for NewS3
+func (c *S3Config) AWSConfig() (*aws.Config, error) {
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	config := &aws.Config{
+		Region:           aws.String(c.Region),
+		Credentials:      creds,
+		S3ForcePathStyle: aws.Bool(c.ForcePathStyle),
+	}
+	if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+	}
+	return config, nil
+}
+
+func (c *S3Config) credentials() (creds *credentials.Credentials, err error) {
+	base := &aws.Config{Region: aws.String(c.Region)}
+	switch c.Credentials {
+	case "", CredentialsStatic:
+		creds = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")
+	case CredentialsDefault:
+		sess, err := session.NewSession(base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aws session: %v", err)
+		}
+		creds = sess.Config.Credentials
+	case CredentialsWebIdentity:
+		roleARN, tokenFile := c.WebIdentityRoleARN, c.WebIdentityTokenFile
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		if roleARN == "" || tokenFile == "" {
+			return nil, fmt.Errorf("no web identity role or token file - is the service account annotated with a role?")
+		}
+		sess, err := session.NewSession(base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aws session: %v", err)
+		}
+		creds = stscreds.NewWebIdentityCredentials(sess, roleARN, "", tokenFile)
+	default:
+		return nil, fmt.Errorf("unknown credential source: %v", c.Credentials)
+	}
+
+	if c.RoleARN == "" {
+		return creds, nil
+	}
+	sess, err := session.NewSession(base.Copy(&aws.Config{Credentials: creds}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+	return stscreds.NewCredentials(sess, c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if c.RoleSessionName != "" {
+			p.RoleSessionName = c.RoleSessionName
+		}
+		if c.Policy != "" {
+			p.Policy = aws.String(c.Policy)
+		}
+	}), nil
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestS3ConfigCredentials(t *testing.T) {
+	config, err := (&S3Config{Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret", Endpoint: "http://minio:9000"}).AWSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := config.Credentials.Get()
+	if err != nil || creds.AccessKeyID != "id" || creds.SecretAccessKey != "secret" {
+		t.Errorf("expected the static credentials, got %v, %v", creds, err)
+	}
+	if *config.Endpoint != "http://minio:9000" {
+		t.Errorf("expected the endpoint, got %v", *config.Endpoint)
+	}
+
+	// no role or token file in the environment
+	os.Unsetenv("AWS_ROLE_ARN")
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if _, err = (&S3Config{Region: "us-east-1", Credentials: CredentialsWebIdentity}).AWSConfig(); err == nil {
+		t.Errorf("expected an error without a web identity")
+	}
+	if _, err = (&S3Config{Region: "us-east-1", Credentials: CredentialsWebIdentity, WebIdentityRoleARN: "arn:aws:iam::123456789012:role/mariner", WebIdentityTokenFile: "/var/run/token"}).AWSConfig(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = (&S3Config{Credentials: "keychain"}).AWSConfig(); err == nil {
+		t.Errorf("expected an error for an unknown source")
+	}
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// this file contains the local filesystem implementation of Storage
+//
+// the object with key "a/b" is the file <root>/a/b - a key can't reach outside the root
+// user metadata is kept in <root>/.metadata/<key>.json, which listings skip
+
+const metadataDir = ".metadata"
+
+// LocalStorage keeps objects in a directory
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocal returns the storage of the directory, which is created if it doesn't exist
+func NewLocal(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no root directory for local storage")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage root: %v", err)
+	}
+	return &LocalStorage{Root: root}, nil
+}
+
+// cleanKey returns the key without a leading "/", and without any ".." which would reach outside the root
+func cleanKey(key string) string {
+	return normalKey(path.Clean("/" + key))
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(cleanKey(key)))
+}
+
+func (s *LocalStorage) metadataPath(key string) string {
+	return filepath.Join(s.Root, metadataDir, filepath.FromSlash(cleanKey(key))+".json")
+}
+
+// localError wraps the errors of missing files in ErrNotFound
+func localError(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+func (s *LocalStorage) open(key string) (*os.File, *ObjectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, nil, localError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: %v is a directory", ErrNotFound, key)
+	}
+	return f, &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+// Get ..
+func (s *LocalStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	f, info, err := s.open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// limitedFile reads part of a file
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.f.Close()
+}
+
+// GetRange ..
+func (s *LocalStorage) GetRange(key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if offset < 0 || length == 0 {
+		return nil, nil, fmt.Errorf("%w: offset %v, length %v", ErrInvalidRange, offset, length)
+	}
+	f, info, err := s.open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset >= info.Size {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: offset %v of %v bytes", ErrInvalidRange, offset, info.Size)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if length < 0 {
+		return f, info, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(f, length), f: f}, info, nil
+}
+
+// Put ..
+// the file is written next to its destination, then moved there, so that readers never see part of it
+func (s *LocalStorage) Put(key string, body io.Reader, metadata map[string]string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	mp := s.metadataPath(key)
+	if len(metadata) == 0 {
+		if err = os.Remove(mp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(mp), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mp, b, 0644)
+}
+
+// List ..
+// the token is the last key or prefix of the previous page
+func (s *LocalStorage) List(prefix, delimiter, token string) (*Page, error) {
+	prefix = normalKey(prefix)
+	// walk the deepest directory which holds every match
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = cleanKey(prefix[:i])
+	}
+	// the entries of the listing - objects, and prefixes if there's a delimiter
+	entries := []string{}
+	infos := map[string]*ObjectInfo{}
+	err := filepath.Walk(filepath.Join(s.Root, filepath.FromSlash(dir)), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			if rel == metadataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// files being written by Put
+		if strings.HasPrefix(fi.Name(), ".") && strings.Contains(fi.Name(), ".tmp") {
+			return nil
+		}
+		key := rel
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if _, ok := infos[common]; !ok && (token == "" || common > token) {
+					entries = append(entries, common)
+					infos[common] = nil
+				}
+				return nil
+			}
+		}
+		if token == "" || key > token {
+			entries = append(entries, key)
+			infos[key] = &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(entries)
+	page := &Page{}
+	for i, entry := range entries {
+		if i == maxPageSize {
+			page.NextToken = entries[i-1]
+			break
+		}
+		if info := infos[entry]; info != nil {
+			page.Objects = append(page.Objects, info)
+		} else {
+			page.Prefixes = append(page.Prefixes, entry)
+		}
+	}
+	return page, nil
+}
+
+// Stat ..
+func (s *LocalStorage) Stat(key string) (*ObjectInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, localError(err)
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%w: %v is a directory", ErrNotFound, key)
+	}
+	info := &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+	if b, err := ioutil.ReadFile(s.metadataPath(key)); err == nil {
+		if err = json.Unmarshal(b, &info.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metadata of %v: %v", key, err)
+		}
+	}
+	return info, nil
+}
+
+// Exists ..
+func (s *LocalStorage) Exists(key string) (bool, error) {
+	fi, err := os.Stat(s.path(key))
+	switch {
+	case err == nil:
+		return !fi.IsDir(), nil
+	case os.IsNotExist(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete ..
+func (s *LocalStorage) Delete(keys ...string) error {
+	for _, key := range keys {
+		for _, p := range []string{s.path(key), s.metadataPath(key)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Presign returns a file:// URL - the filename can't be set
+func (s *LocalStorage) Presign(key string, expiry time.Duration, filename string) (string, error) {
+	if _, err := s.Stat(key); err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(s.path(key)), nil
+}
+
+// Check ..
+func (s *LocalStorage) Check(ctx context.Context) error {
+	fi, err := os.Stat(s.Root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("storage root %v is not a directory", s.Root)
+	}
+	return nil
+}
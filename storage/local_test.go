@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func localStorage(t *testing.T) *LocalStorage {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLocalPutGet(t *testing.T) {
+	s := localStorage(t)
+	if err := s.Put("/user/run/log.txt", strings.NewReader("0123456789"), map[string]string{"sha1": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a leading "/" is ignored
+	b, err := ReadAll(s, "user/run/log.txt")
+	if err != nil || string(b) != "0123456789" {
+		t.Errorf("expected the contents, got '%s', %v", b, err)
+	}
+
+	info, err := s.Stat("/user/run/log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 10 || info.Metadata["sha1"] != "abc" {
+		t.Errorf("wrong info: %+v", info)
+	}
+
+	body, info, err := s.GetRange("/user/run/log.txt", 7, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(b) != "789" || info.Size != 10 {
+		t.Errorf("expected the last 3 of 10 bytes, got '%s' of %v", b, info.Size)
+	}
+
+	body, _, err = s.GetRange("/user/run/log.txt", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(b) != "234" {
+		t.Errorf("expected '234', got '%s'", b)
+	}
+
+	if _, _, err = s.GetRange("/user/run/log.txt", 10, -1); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("expected an invalid range, got %v", err)
+	}
+	if _, _, err = s.Get("/user/run/missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err = s.Stat("/user/run"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a directory to not be an object, got %v", err)
+	}
+
+	// keys can't reach outside the root
+	if s.path("../../etc/passwd") != s.path("etc/passwd") {
+		t.Errorf("key reaches outside the root: %v", s.path("../../etc/passwd"))
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	s := localStorage(t)
+	keys := []string{}
+	for i := 0; i < maxPageSize+5; i++ {
+		keys = append(keys, fmt.Sprintf("/user/workflowRuns/run-%04d/request.json", i))
+	}
+	keys = append(keys, "/user/workflowRuns/run-0000/logs.json", "/user/other.json")
+	for _, key := range keys {
+		if err := PutBytes(s, key, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// objects, across pages
+	n := 0
+	if err := Walk(s, "/user/workflowRuns/", func(obj *ObjectInfo) bool {
+		if !strings.HasPrefix(obj.Key, "user/workflowRuns/run-") {
+			t.Errorf("unexpected key: %v", obj.Key)
+		}
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != maxPageSize+6 {
+		t.Errorf("expected %v objects, got %v", maxPageSize+6, n)
+	}
+
+	page, err := s.List("/user/workflowRuns/", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Objects) != maxPageSize || page.NextToken == "" {
+		t.Errorf("expected a full first page, got %v objects, next token '%v'", len(page.Objects), page.NextToken)
+	}
+
+	// prefixes, across pages
+	prefixes, err := Prefixes(s, "/user/workflowRuns/", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != maxPageSize+5 || prefixes[0] != "user/workflowRuns/run-0000/" {
+		t.Errorf("expected %v prefixes, got %v, from %v", maxPageSize+5, len(prefixes), prefixes[0])
+	}
+
+	page, err = s.List("/user/", "/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Prefixes, []string{"user/workflowRuns/"}) || len(page.Objects) != 1 || page.Objects[0].Key != "user/other.json" {
+		t.Errorf("wrong listing with a delimiter: %v, %+v", page.Prefixes, page.Objects)
+	}
+
+	// a leading "/" makes no difference
+	page, err = s.List("user/", "/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Prefixes, []string{"user/workflowRuns/"}) || len(page.Objects) != 1 || page.Objects[0].Key != "user/other.json" {
+		t.Errorf("wrong listing without a leading \"/\": %v, %+v", page.Prefixes, page.Objects)
+	}
+
+	// a prefix which isn't a directory
+	page, err = s.List("/user/oth", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Objects) != 1 {
+		t.Errorf("expected 1 object, got %v", len(page.Objects))
+	}
+	page, err = s.List("/nobody/", "", "")
+	if err != nil || len(page.Objects) != 0 {
+		t.Errorf("expected an empty listing, got %v, %v", page, err)
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	s := localStorage(t)
+	if err := s.Put("a/b", strings.NewReader("x"), map[string]string{"sha1": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists("a/b"); !ok || err != nil {
+		t.Errorf("expected the object to exist: %v", err)
+	}
+	if err := s.Delete("a/b", "a/missing"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists("a/b"); ok || err != nil {
+		t.Errorf("expected the object to be deleted: %v", err)
+	}
+
+	// the metadata goes with the object
+	if err := PutBytes(s, "a/b", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat("a/b")
+	if err != nil || len(info.Metadata) != 0 {
+		t.Errorf("expected no metadata, got %v, %v", info, err)
+	}
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// this file contains the S3 implementation of Storage
+// the aws config picks the endpoint - for S3-compatible storage, set Endpoint, and S3ForcePathStyle
+// if the storage doesn't support virtual-hosted-style addressing, as MinIO doesn't by default
+
+// S3Storage keeps objects in an S3 bucket
+type S3Storage struct {
+	Bucket   string
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3 returns the storage of the bucket, reached with the given aws config
+func NewS3(config *aws.Config, bucket string) (*S3Storage, error) {
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+	return &S3Storage{
+		Bucket:   bucket,
+		svc:      s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+// s3Error wraps the errors of missing objects and bad ranges in ErrNotFound and ErrInvalidRange
+func s3Error(err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%w: %v", ErrNotFound, err)
+		case "InvalidRange":
+			return fmt.Errorf("%w: %v", ErrInvalidRange, err)
+		}
+	}
+	return err
+}
+
+// Get ..
+func (s *S3Storage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	obj, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(normalKey(key)),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	info := &ObjectInfo{
+		Key:          normalKey(key),
+		Size:         aws.Int64Value(obj.ContentLength),
+		LastModified: aws.TimeValue(obj.LastModified),
+	}
+	return obj.Body, info, nil
+}
+
+// GetRange ..
+func (s *S3Storage) GetRange(key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if offset < 0 || length == 0 {
+		return nil, nil, fmt.Errorf("%w: offset %v, length %v", ErrInvalidRange, offset, length)
+	}
+	rng := fmt.Sprintf("bytes=%v-", offset)
+	if length > 0 {
+		rng = fmt.Sprintf("bytes=%v-%v", offset, offset+length-1)
+	}
+	obj, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(normalKey(key)),
+		Range:  aws.String(rng),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	info := &ObjectInfo{
+		Key:          normalKey(key),
+		Size:         aws.Int64Value(obj.ContentLength),
+		LastModified: aws.TimeValue(obj.LastModified),
+	}
+	// e.g., "bytes 0-99/1234"
+	if cr := aws.StringValue(obj.ContentRange); cr != "" {
+		if size, err := strconv.ParseInt(cr[strings.LastIndex(cr, "/")+1:], 10, 64); err == nil {
+			info.Size = size
+		}
+	}
+	return obj.Body, info, nil
+}
+
+// Put ..
+func (s *S3Storage) Put(key string, body io.Reader, metadata map[string]string) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(normalKey(key)),
+		Body:     body,
+		Metadata: aws.StringMap(metadata),
+	})
+	return err
+}
+
+// List ..
+func (s *S3Storage) List(prefix, delimiter, token string) (*Page, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.Bucket),
+		Prefix:  aws.String(normalKey(prefix)),
+		MaxKeys: aws.Int64(maxPageSize),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	out, err := s.svc.ListObjectsV2(input)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{}
+	for _, obj := range out.Contents {
+		page.Objects = append(page.Objects, &ObjectInfo{
+			Key:          aws.StringValue(obj.Key),
+			Size:         aws.Int64Value(obj.Size),
+			LastModified: aws.TimeValue(obj.LastModified),
+		})
+	}
+	for _, p := range out.CommonPrefixes {
+		page.Prefixes = append(page.Prefixes, aws.StringValue(p.Prefix))
+	}
+	if aws.BoolValue(out.IsTruncated) {
+		page.NextToken = aws.StringValue(out.NextContinuationToken)
+	}
+	return page, nil
+}
+
+// Stat ..
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(normalKey(key)),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Key:          normalKey(key),
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		Metadata:     aws.StringValueMap(head.Metadata),
+	}, nil
+}
+
+// Exists ..
+func (s *S3Storage) Exists(key string) (bool, error) {
+	_, err := s.Stat(key)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrNotFound):
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete ..
+func (s *S3Storage) Delete(keys ...string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		objects := make([]*s3.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(normalKey(key))}
+		}
+		out, err := s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %v objects, e.g., %v: %v", len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Presign ..
+func (s *S3Storage) Presign(key string, expiry time.Duration, filename string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(normalKey(key)),
+	}
+	if filename != "" {
+		input.ResponseContentDisposition = aws.String(fmt.Sprintf("attachment; filename=%q", filename))
+	}
+	req, _ := s.svc.GetObjectRequest(input)
+	return req.Presign(expiry)
+}
+
+// Check ..
+func (s *S3Storage) Check(ctx context.Context) error {
+	_, err := s.svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	return err
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// this file contains the Storage interface, through which mariner reads and writes
+// run logs, requests, task files and everything else it keeps in object storage
+//
+// implementations:
+// - S3Storage - AWS S3, or any S3-compatible endpoint, e.g., MinIO - see s3.go
+// - LocalStorage - a directory of the local filesystem, for tests and local runs - see local.go
+//
+// a leading "/" in a key or prefix is dropped, so "/a/b" and "a/b" are the same object in every implementation -
+// the S3 SDK drops it from the request path of most calls anyway - and listed keys never have one
+
+const (
+	// the most objects a page of a listing holds
+	maxPageSize = 1000
+)
+
+var (
+	// ErrNotFound is returned, wrapped, when the object doesn't exist
+	ErrNotFound = errors.New("object not found")
+	// ErrInvalidRange is returned, wrapped, when a range doesn't overlap the object
+	ErrInvalidRange = errors.New("invalid range")
+)
+
+// ObjectInfo ..
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string // user metadata - only filled in by Stat
+}
+
+// Page is one page of a listing
+type Page struct {
+	Objects   []*ObjectInfo
+	Prefixes  []string // with a delimiter, the distinct prefixes of keys up to the delimiter after the listing's prefix
+	NextToken string   // pass to List to get the next page - "" on the last page
+}
+
+// Storage ..
+type Storage interface {
+	// Get returns the contents of the object, and its size and modification time
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetRange returns length bytes of the object from offset, or to its end if length < 0
+	// the info has the size of the whole object
+	GetRange(key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	// Put writes the object, with the given user metadata, which may be nil
+	Put(key string, body io.Reader, metadata map[string]string) error
+	// List returns a page of the objects whose keys start with prefix, in key order
+	// with a delimiter, keys which have it after the prefix are grouped into Prefixes instead, e.g.,
+	// "a/b/c" and "a/b/d" listed with prefix "a/" and delimiter "/" are the prefix "a/b/"
+	// token is "" for the first page, then the NextToken of the previous page
+	List(prefix, delimiter, token string) (*Page, error)
+	Stat(key string) (*ObjectInfo, error)
+	Exists(key string) (bool, error)
+	// Delete deletes the objects - objects which don't exist are skipped
+	Delete(keys ...string) error
+	// Presign returns a URL from which the object can be downloaded without credentials until expiry,
+	// as filename if it's not ""
+	Presign(key string, expiry time.Duration, filename string) (string, error)
+	// Check returns an error if the storage can't be reached
+	Check(ctx context.Context) error
+}
+
+// normalKey returns the key, or prefix, without its leading "/"s
+func normalKey(key string) string {
+	return strings.TrimLeft(key, "/")
+}
+
+// Walk calls fn for every object whose key starts with prefix, in key order, following the pages of the listing
+// the walk stops early if fn returns false
+func Walk(s Storage, prefix string, fn func(*ObjectInfo) bool) error {
+	token := ""
+	for {
+		page, err := s.List(prefix, "", token)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Objects {
+			if !fn(obj) {
+				return nil
+			}
+		}
+		if page.NextToken == "" {
+			return nil
+		}
+		token = page.NextToken
+	}
+}
+
+// Prefixes returns the distinct prefixes of keys up to the delimiter after prefix, following the pages of the listing
+func Prefixes(s Storage, prefix, delimiter string) ([]string, error) {
+	prefixes := []string{}
+	token := ""
+	for {
+		page, err := s.List(prefix, delimiter, token)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, page.Prefixes...)
+		if page.NextToken == "" {
+			return prefixes, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// ReadAll returns the contents of the object
+func ReadAll(s Storage, key string) ([]byte, error) {
+	body, _, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// PutBytes writes b to the object
+func PutBytes(s Storage, key string, b []byte) error {
+	return s.Put(key, bytes.NewReader(b), nil)
+}
@@ -0,0 +1,380 @@
+package wflib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+	input validation answers the question -
+	"does this input object satisfy the inputs of the '#main' routine?"
+
+	checked here:
+	- every required input has a value
+	- values match the declared types (including unions, arrays, enums and records)
+	- File and Directory values are well-formed objects
+	- secondaryFiles, if listed on a File value, are well-formed File or Directory objects
+
+	not checked here:
+	- whether the referenced files actually exist - that happens at runtime
+*/
+
+// InputGrievances ..
+type InputGrievances struct {
+	Main    Grievances            `json:"main"`
+	ByInput map[string]Grievances `json:"byInput"`
+}
+
+// InputValidator ..
+type InputValidator struct {
+	Workflow   *WorkflowJSON
+	Input      map[string]interface{}
+	Grievances *InputGrievances
+}
+
+// ValidateInput validates the input JSON 'in' against the '#main' inputs of the packed workflow JSON 'wf'
+func ValidateInput(wf []byte, in []byte) (bool, *InputGrievances) {
+	g := &InputGrievances{
+		Main:    make(Grievances, 0),
+		ByInput: make(map[string]Grievances),
+	}
+
+	workflow := &WorkflowJSON{}
+	if err := json.Unmarshal(wf, workflow); err != nil || workflow.Graph == nil {
+		g.Main.log("invalid workflow json structure")
+		return false, g
+	}
+
+	input := make(map[string]interface{})
+	if len(in) > 0 && string(in) != "null" {
+		if err := json.Unmarshal(in, &input); err != nil {
+			g.Main.log("invalid input json structure - input must be an object")
+			return false, g
+		}
+	}
+
+	v := &InputValidator{
+		Workflow:   workflow,
+		Input:      input,
+		Grievances: g,
+	}
+	return v.Validate(), g
+}
+
+// Validate ..
+func (v *InputValidator) Validate() bool {
+	g := v.Grievances
+
+	var main map[string]interface{}
+	for _, obj := range *v.Workflow.Graph {
+		if obj["id"] == mainID {
+			main = obj
+			break
+		}
+	}
+	if main == nil {
+		g.Main.log("missing '#main' workflow")
+		return false
+	}
+
+	params, ok := main["inputs"].([]interface{})
+	if !ok {
+		if main["inputs"] != nil {
+			g.Main.log("value for field 'inputs' of '#main' must be an array")
+			return false
+		}
+		params = []interface{}{}
+	}
+
+	for _, i := range params {
+		param, ok := i.(map[string]interface{})
+		if !ok {
+			g.Main.log("input parameter is not a map")
+			continue
+		}
+		v.validateParam(param)
+	}
+
+	return g.empty()
+}
+
+func (g *InputGrievances) empty() bool {
+	if len(g.Main) > 0 {
+		return false
+	}
+	for _, byInput := range g.ByInput {
+		if len(byInput) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validate the value provided for a single '#main' input parameter
+func (v *InputValidator) validateParam(param map[string]interface{}) {
+	id, ok := param["id"].(string)
+	if !ok {
+		v.Grievances.Main.log("input parameter missing id")
+		return
+	}
+
+	// "#main/input_bam" -> "input_bam"
+	localID := strings.TrimPrefix(id, mainID+"/")
+
+	g := make(Grievances, 0)
+	defer func() {
+		if len(g) > 0 {
+			v.Grievances.ByInput[localID] = g
+		}
+	}()
+
+	t, ok := param["type"]
+	if !ok {
+		g.log("input parameter has no type")
+		return
+	}
+
+	val, provided := v.Input[localID]
+	if !provided || val == nil {
+		if _, hasDefault := param["default"]; hasDefault || optional(t) {
+			return
+		}
+		g.log("missing value for required input")
+		return
+	}
+
+	if err := checkType(val, t); err != nil {
+		g.log("%v", err)
+		return
+	}
+
+	// secondaryFiles are resolved by the engine from the patterns in the workflow
+	// so here we only check that any secondaryFiles listed in the input are well-formed
+	if _, ok := param["secondaryFiles"]; ok {
+		for _, f := range fileValues(val) {
+			if err := checkSecondaryFiles(f); err != nil {
+				g.log("%v", err)
+			}
+		}
+	}
+}
+
+// returns true if the given type allows a null value
+func optional(t interface{}) bool {
+	switch x := t.(type) {
+	case string:
+		return x == "null" || strings.HasSuffix(x, "?")
+	case []interface{}:
+		for _, member := range x {
+			if optional(member) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkType returns an error if 'val' doesn't match CWL type 't'
+//
+// 't' is any of the forms a type may take in packed workflow json:
+// - a type name, e.g., "File", "string", "File?", "int[]"
+// - a union, i.e., an array of types
+// - a schema, i.e., a map with a 'type' field of "array", "enum" or "record"
+func checkType(val interface{}, t interface{}) error {
+	switch x := t.(type) {
+	case string:
+		return checkNamedType(val, x)
+	case []interface{}:
+		for _, member := range x {
+			if checkType(val, member) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("value does not match any type in %v", typeString(x))
+	case map[string]interface{}:
+		return checkSchema(val, x)
+	}
+	return fmt.Errorf("unsupported type definition: %v", t)
+}
+
+func checkNamedType(val interface{}, t string) error {
+	switch {
+	case strings.HasSuffix(t, "?"):
+		if val == nil {
+			return nil
+		}
+		return checkNamedType(val, strings.TrimSuffix(t, "?"))
+	case strings.HasSuffix(t, "[]"):
+		return checkSchema(val, map[string]interface{}{
+			"type":  "array",
+			"items": strings.TrimSuffix(t, "[]"),
+		})
+	}
+
+	ok := false
+	switch t {
+	case "null":
+		ok = val == nil
+	case "Any":
+		ok = val != nil
+	case "boolean":
+		_, ok = val.(bool)
+	case "int", "long":
+		var n float64
+		if n, ok = val.(float64); ok {
+			ok = n == math.Trunc(n)
+		}
+	case "float", "double":
+		_, ok = val.(float64)
+	case "string":
+		_, ok = val.(string)
+	case "File":
+		return checkFile(val)
+	case "Directory":
+		return checkDirectory(val)
+	default:
+		return fmt.Errorf("unsupported type: %v", t)
+	}
+	if !ok {
+		return fmt.Errorf("expected value of type '%v' but got: %v", t, val)
+	}
+	return nil
+}
+
+func checkSchema(val interface{}, schema map[string]interface{}) error {
+	t, _ := schema["type"].(string)
+	switch t {
+	case "array":
+		arr, ok := val.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected an array but got: %v", val)
+		}
+		for i, item := range arr {
+			if err := checkType(item, schema["items"]); err != nil {
+				return fmt.Errorf("array item %v: %v", i, err)
+			}
+		}
+		return nil
+	case "enum":
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("expected an enum symbol but got: %v", val)
+		}
+		symbols, _ := schema["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			// packed symbols look like "#main/param/symbol"
+			if sym, ok := symbol.(string); ok && (sym == s || lastInPath(sym) == s) {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%v' is not a valid symbol for enum %v", s, typeString(symbols))
+	case "record":
+		rec, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a record but got: %v", val)
+		}
+		fields, _ := schema["fields"].([]interface{})
+		for _, i := range fields {
+			field, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := field["name"].(string)
+			name = lastInPath(name)
+			fieldVal, provided := rec[name]
+			if !provided || fieldVal == nil {
+				if optional(field["type"]) {
+					continue
+				}
+				return fmt.Errorf("record missing required field: %v", name)
+			}
+			if err := checkType(fieldVal, field["type"]); err != nil {
+				return fmt.Errorf("record field '%v': %v", name, err)
+			}
+		}
+		return nil
+	case "":
+		return fmt.Errorf("type schema missing field 'type'")
+	}
+	// e.g., {"type": "File"}
+	return checkNamedType(val, t)
+}
+
+// see: https://www.commonwl.org/v1.0/CommandLineTool.html#File
+func checkFile(val interface{}) error {
+	obj, ok := val.(map[string]interface{})
+	if !ok || obj["class"] != "File" {
+		return fmt.Errorf("expected a File object with class 'File' but got: %v", val)
+	}
+	_, hasContents := obj["contents"]
+	if !hasPathString(obj) && !hasContents {
+		return fmt.Errorf("File object must specify one of 'location', 'path' or 'contents'")
+	}
+	return nil
+}
+
+// see: https://www.commonwl.org/v1.0/CommandLineTool.html#Directory
+func checkDirectory(val interface{}) error {
+	obj, ok := val.(map[string]interface{})
+	if !ok || obj["class"] != "Directory" {
+		return fmt.Errorf("expected a Directory object with class 'Directory' but got: %v", val)
+	}
+	_, hasListing := obj["listing"]
+	if !hasPathString(obj) && !hasListing {
+		return fmt.Errorf("Directory object must specify one of 'location', 'path' or 'listing'")
+	}
+	return nil
+}
+
+func hasPathString(obj map[string]interface{}) bool {
+	for _, field := range []string{"location", "path"} {
+		if s, ok := obj[field].(string); ok && s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func checkSecondaryFiles(file map[string]interface{}) error {
+	i, ok := file["secondaryFiles"]
+	if !ok || i == nil {
+		return nil
+	}
+	sFiles, ok := i.([]interface{})
+	if !ok {
+		return fmt.Errorf("secondaryFiles must be an array")
+	}
+	for _, sf := range sFiles {
+		if checkFile(sf) != nil && checkDirectory(sf) != nil {
+			return fmt.Errorf("invalid secondaryFile - must be a File or Directory object: %v", sf)
+		}
+	}
+	return nil
+}
+
+// collect all the File objects in a value which passed type checking
+func fileValues(val interface{}) (files []map[string]interface{}) {
+	switch x := val.(type) {
+	case map[string]interface{}:
+		if x["class"] == "File" {
+			files = append(files, x)
+		}
+	case []interface{}:
+		for _, item := range x {
+			files = append(files, fileValues(item)...)
+		}
+	}
+	return files
+}
+
+func typeString(i interface{}) string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
+
+func lastInPath(s string) string {
+	tmp := strings.Split(s, "/")
+	return tmp[len(tmp)-1]
+}
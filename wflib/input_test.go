@@ -0,0 +1,91 @@
+package wflib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+const (
+	// positive test cases - (workflow, input)
+	userDataInputJSON = "../testdata/user_data_test/workflow/inputs.json"
+	noInputInputJSON  = "../testdata/no_input_test/workflow/inputs.json"
+
+	typesWorkflow = `{
+		"cwlVersion": "v1.0",
+		"$graph": [{
+			"id": "#main",
+			"class": "Workflow",
+			"inputs": [
+				{"id": "#main/bam", "type": "File", "secondaryFiles": [".bai"]},
+				{"id": "#main/n", "type": "int"},
+				{"id": "#main/label", "type": ["null", "string"]},
+				{"id": "#main/mode", "type": {"type": "enum", "symbols": ["#main/mode/fast", "#main/mode/slow"]}},
+				{"id": "#main/refs", "type": {"type": "array", "items": "File"}},
+				{"id": "#main/threads", "type": "int", "default": 4}
+			],
+			"outputs": [],
+			"steps": []
+		}]
+	}`
+
+	typesInput = `{
+		"bam": {"class": "File", "location": "USER/a.bam", "secondaryFiles": [{"class": "File", "location": "USER/a.bam.bai"}]},
+		"n": 3,
+		"mode": "fast",
+		"refs": [{"class": "File", "path": "USER/ref.fa"}]
+	}`
+)
+
+var posInput = map[string]string{
+	userDataTargetJSON: userDataInputJSON,
+	noInputTargetJSON:  noInputInputJSON,
+}
+
+// each negative case should produce a grievance for exactly the listed input
+var negInput = map[string]string{
+	"bam":  `{"n": 3, "mode": "fast", "refs": []}`,
+	"n":    `{"bam": {"class": "File", "location": "a.bam"}, "n": 3.5, "mode": "fast", "refs": []}`,
+	"mode": `{"bam": {"class": "File", "location": "a.bam"}, "n": 3, "mode": "medium", "refs": []}`,
+	"refs": `{"bam": {"class": "File", "location": "a.bam"}, "n": 3, "mode": "fast", "refs": [{"class": "Directory", "location": "d"}]}`,
+}
+
+func TestValidateInput(t *testing.T) {
+	for wfPath, inPath := range posInput {
+		wf, err := ioutil.ReadFile(wfPath)
+		if err != nil {
+			t.Fatalf("failed to read workflow: %v", err)
+		}
+		in, err := ioutil.ReadFile(inPath)
+		if err != nil {
+			t.Fatalf("failed to read input: %v", err)
+		}
+		if valid, g := ValidateInput(wf, in); !valid {
+			fmt.Println("validation grievances: ")
+			PrintJSON(g)
+			t.Errorf("%v failed input validation", inPath)
+		}
+	}
+
+	if valid, g := ValidateInput([]byte(typesWorkflow), []byte(typesInput)); !valid {
+		fmt.Println("validation grievances: ")
+		PrintJSON(g)
+		t.Errorf("typed input failed validation")
+	}
+
+	for param, in := range negInput {
+		valid, g := ValidateInput([]byte(typesWorkflow), []byte(in))
+		if valid {
+			t.Errorf("negative test case passed validation:\n%v", in)
+			continue
+		}
+		if len(g.ByInput[param]) == 0 || len(g.ByInput) != 1 {
+			PrintJSON(g)
+			t.Errorf("expected grievance for input '%v' only", param)
+		}
+	}
+
+	if valid, _ := ValidateInput([]byte(typesWorkflow), []byte(`[]`)); valid {
+		t.Errorf("non-object input passed validation")
+	}
+}
@@ -236,33 +236,25 @@ func (p *Packer) PackCWLFile(path string, prevPath string) (string, error) {
 	return id, nil
 }
 
-// this feels like a sin
-// but not sure offhand how to otherwise handle resolving paths
+// absPath resolves path relative to refPath - the directory refPath, or the directory of the file refPath
+// the path is resolved lexically, without changing the working directory of the process,
+// so that workflows can be packed concurrently
 func absPath(path string, refPath string) (string, error) {
-	origDir, _ := os.Getwd()
-	defer os.Chdir(origDir)
-
-	var wd string
-	if refPath != "" {
-		refInfo, err := os.Stat(refPath)
-		if err != nil {
-			return "", err
-		}
-		if refInfo.IsDir() {
-			refPath = fmt.Sprintf("%v/", refPath)
-		}
-		if err = os.Chdir(filepath.Dir(refPath)); err != nil {
-			return "", err
-		}
-		if err = os.Chdir(filepath.Dir(path)); err != nil {
-			return "", err
-		}
-		if wd, err = os.Getwd(); err != nil {
-			return "", err
-		}
-		path = fmt.Sprintf("%v/%v", wd, filepath.Base(path))
+	if refPath == "" {
+		return path, nil
+	}
+	refInfo, err := os.Stat(refPath)
+	if err != nil {
+		return "", err
+	}
+	refDir := refPath
+	if !refInfo.IsDir() {
+		refDir = filepath.Dir(refPath)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(refDir, path)
 	}
-	return path, nil
+	return filepath.Abs(path)
 }
 
 // PrintJSON pretty prints a struct as JSON
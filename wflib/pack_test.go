@@ -1,7 +1,9 @@
 package wflib
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -24,3 +26,36 @@ func TestPack(t *testing.T) {
 	p(noInputCWL)
 	p(userDataCWL)
 }
+
+func TestAbsPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "cwl", "tools"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ref := filepath.Join(dir, "cwl", "workflow.cwl")
+	if err := ioutil.WriteFile(ref, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	cases := []struct {
+		path, refPath, expected string
+	}{
+		{"tools/align.cwl", ref, filepath.Join(dir, "cwl", "tools", "align.cwl")},
+		{"../shared/sort.cwl", ref, filepath.Join(dir, "shared", "sort.cwl")},
+		{"align.cwl", filepath.Join(dir, "cwl", "tools"), filepath.Join(dir, "cwl", "tools", "align.cwl")},
+		{"/abs/sort.cwl", ref, "/abs/sort.cwl"},
+		{"workflow.cwl", "", "workflow.cwl"},
+	}
+	for _, c := range cases {
+		path, err := absPath(c.path, c.refPath)
+		if err != nil || path != c.expected {
+			t.Errorf("%v relative to %v: expected %v, got %v, %v", c.path, c.refPath, c.expected, path, err)
+		}
+	}
+	if _, err := absPath("align.cwl", filepath.Join(dir, "missing.cwl")); err == nil {
+		t.Error("expected an error for a missing reference path")
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("expected the working directory to stay %v, got %v", wd, now)
+	}
+}